@@ -0,0 +1,202 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// adminSessionsPath serves the admin API on the monitoring listener, if an admin token is configured
+const adminSessionsPath = "/admin/sessions"
+
+var errSessionNotFound = errors.New("No such session")
+
+// AdminSession describes a device in the middle of a test, as listed by the admin API.
+// UDP sessions are probes waiting for their reply or clients expected to follow up, all others are open connections.
+type AdminSession struct {
+	// ID identifies the session in the admin API, UDP sessions use the trace ID of their probe
+	ID       string
+	Protocol string
+	Remote   string
+	IMEI     string `json:",omitempty"`
+	Operator string `json:",omitempty"`
+	// Interval is the interval of the current probe in seconds
+	Interval int `json:",omitempty"`
+	// Started is when the probe of a UDP session was received, or when the connection was accepted
+	Started time.Time
+	TraceID string `json:",omitempty"`
+	// Pending is true while the server waits out the interval of a UDP probe before replying
+	Pending bool `json:",omitempty"`
+}
+
+// udpAdminSession returns the session of a client expected to follow up the probe of e
+func udpAdminSession(e NATLogEntry) AdminSession {
+	return AdminSession{
+		ID:       e.TraceID,
+		Protocol: e.Protocol,
+		Remote:   e.IP,
+		IMEI:     e.Message.IMEI,
+		Operator: e.Message.Operator,
+		Interval: e.Message.Interval,
+		Started:  e.Timestamp,
+		TraceID:  e.TraceID,
+	}
+}
+
+// updateConnection records the last message received on the open connection between local and remote
+func (s *Server) updateConnection(local net.Addr, remote net.Addr, imei string, operator string, interval int, traceID string) {
+	s.openConnections.Mux.Lock()
+	defer s.openConnections.Mux.Unlock()
+	c, ok := s.openConnections.ByAddr[connectionKey(local, remote)]
+	if !ok {
+		return
+	}
+	c.Session.IMEI = imei
+	c.Session.Operator = operator
+	c.Session.Interval = interval
+	c.Session.TraceID = traceID
+}
+
+// activeSessions returns the UDP probes waiting for their reply, the UDP clients expected to follow up and the open connections, oldest first
+func (s *Server) activeSessions() []AdminSession {
+	sessions := []AdminSession{}
+	s.udpReplies.Mux.Lock()
+	for _, v := range s.udpReplies.Map {
+		session := udpAdminSession(v.Log)
+		session.Pending = true
+		sessions = append(sessions, session)
+	}
+	s.udpReplies.Mux.Unlock()
+
+	s.updClientTimeouts.Mux.Lock()
+	for _, v := range s.updClientTimeouts.Map {
+		sessions = append(sessions, udpAdminSession(v.Log))
+	}
+	s.updClientTimeouts.Mux.Unlock()
+
+	s.openConnections.Mux.Lock()
+	for _, c := range s.openConnections.Map {
+		sessions = append(sessions, c.Session)
+	}
+	s.openConnections.Mux.Unlock()
+
+	sort.Slice(sessions, func(i, j int) bool {
+		if !sessions[i].Started.Equal(sessions[j].Started) {
+			return sessions[i].Started.Before(sessions[j].Started)
+		}
+		return sessions[i].ID < sessions[j].ID
+	})
+	return sessions
+}
+
+// endSession cancels the reply to the UDP probe, expires the UDP session or closes the connection with id,
+// the probe waiting on it is recorded as interrupted
+func (s *Server) endSession(id string) error {
+	if s.isStopping() {
+		return errInterrupted
+	}
+
+	s.udpReplies.Mux.Lock()
+	v, ok := s.udpReplies.Map[id]
+	// The reply cannot be canceled anymore once it is due
+	if ok && s.scheduler.Cancel(v.Timeout) {
+		delete(s.udpReplies.Map, id)
+		s.udpReplies.Mux.Unlock()
+		entryLogger(v.Log).Info("UDP response canceled through the admin API")
+		s.releasePendingProbe(v.Log.IP)
+		v.Log.Interrupted = true
+		s.writeLog <- v.Log
+		s.releaseHandler()
+		return nil
+	}
+	s.udpReplies.Mux.Unlock()
+
+	s.updClientTimeouts.Mux.Lock()
+	for key, v := range s.updClientTimeouts.Map {
+		if v.Log.TraceID != id {
+			continue
+		}
+		// The timeout does not record the probe once it is removed, even if it is already running
+		delete(s.updClientTimeouts.Map, key)
+		s.scheduler.Cancel(v.Timeout)
+		s.updClientTimeouts.Mux.Unlock()
+		entryLogger(v.Log).Info("UDP session expired through the admin API")
+		v.Log.Interrupted = true
+		s.writeLog <- v.Log
+		s.releaseHandler()
+		return nil
+	}
+	s.updClientTimeouts.Mux.Unlock()
+
+	s.openConnections.Mux.Lock()
+	for _, c := range s.openConnections.Map {
+		if c.Session.ID != id {
+			continue
+		}
+		c.Closed = true
+		s.openConnections.Mux.Unlock()
+		slog.Info("Connection closed through the admin API", "protocol", c.Session.Protocol, "remote", c.Session.Remote, "traceID", c.Session.TraceID)
+		c.Conn.Close()
+		return nil
+	}
+	s.openConnections.Mux.Unlock()
+	return errSessionNotFound
+}
+
+// requireAdminToken answers 401 unless the request carries the admin token as bearer token.
+// Browsers cannot set headers on an EventSource, so the token may be passed as token query parameter instead.
+func (s *Server) requireAdminToken(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if len(token) == 0 {
+			token = r.URL.Query().Get("token")
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.config.AdminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// handleAdminSessions answers with all active sessions
+func (s *Server) handleAdminSessions(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.activeSessions())
+}
+
+// handleAdminSession answers with the session of the ID in the path
+func (s *Server) handleAdminSession(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	for _, session := range s.activeSessions() {
+		if session.ID == id {
+			writeJSON(w, session)
+			return
+		}
+	}
+	http.Error(w, errSessionNotFound.Error(), http.StatusNotFound)
+}
+
+// handleEndAdminSession expires or closes the session of the ID in the path
+func (s *Server) handleEndAdminSession(w http.ResponseWriter, r *http.Request) {
+	err := s.endSession(r.PathValue("id"))
+	if err == errSessionNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testAdminToken = "admin-token"
+
+// adminRequest sends a request with token to the admin API of server and returns the status code, decoding the body into v if it is not nil
+func adminRequest(t *testing.T, server *Server, method string, path string, token string, v interface{}) int {
+	request, err := http.NewRequest(method, "http://"+server.MonitoringAddr().String()+path, nil)
+	if err != nil {
+		t.Fatalf("Failed to create request: %s", err)
+	}
+	if len(token) > 0 {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatalf("Failed to %s %s: %s", method, path, err)
+	}
+	defer response.Body.Close()
+	if v != nil && response.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(response.Body).Decode(v); err != nil {
+			t.Fatalf("Failed to decode the response: %s", err)
+		}
+	}
+	return response.StatusCode
+}
+
+// adminAPI serves the admin API with testAdminToken on a random local port
+func adminAPI(t *testing.T) func(*Config) {
+	return func(config *Config) {
+		config.AdminToken = testAdminToken
+		config.MonitoringListener = localTCPListener(t)
+	}
+}
+
+func TestAdminSessions(t *testing.T) {
+	assert := assert.New(t)
+	sink := &memorySink{}
+	server, clock := newFakeClockServer(t, sink, adminAPI(t))
+
+	assert.Equal(http.StatusUnauthorized, adminRequest(t, server, http.MethodGet, adminSessionsPath, "", nil), "Requests without token should be rejected")
+	assert.Equal(http.StatusUnauthorized, adminRequest(t, server, http.MethodGet, adminSessionsPath, "wrong", nil), "Requests with the wrong token should be rejected")
+
+	// A UDP client waits for its follow-up, a TCP client for the response to its second message
+	udpConn := dialUDP(t, server)
+	defer udpConn.Close()
+	udpReply := probe(t, clock, udpConn, NATtestCases[0])
+	tcpConn, err := net.Dial("tcp", server.TCPAddr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect to the server: %s", err)
+	}
+	defer tcpConn.Close()
+	_, err = tcpConn.Write(NATtestCases[1])
+	assert.NoError(err, "The message should be sent")
+	if !clock.WaitForTimer(2 * time.Second) {
+		t.Fatal("Server did not wait for the interval")
+	}
+
+	var sessions []AdminSession
+	assert.Eventually(func() bool {
+		sessions = nil
+		adminRequest(t, server, http.MethodGet, adminSessionsPath, testAdminToken, &sessions)
+		return len(sessions) == 2 && len(sessions[1].TraceID) > 0
+	}, replyTimeout, time.Millisecond, "The UDP and the TCP session should be listed")
+	if !assert.Len(sessions, 2) {
+		return
+	}
+	udp, tcp := sessions[0], sessions[1]
+	if udp.Protocol != "UDP" {
+		udp, tcp = tcp, udp
+	}
+	assert.Equal("UDP", udp.Protocol)
+	assert.Equal(replyTraceID(udpReply), udp.ID, "UDP sessions are identified by their trace ID")
+	assert.Equal(udpConn.LocalAddr().String(), udp.Remote)
+	assert.Equal("352656100367872", udp.IMEI)
+	assert.Equal("24201", udp.Operator)
+	assert.Equal(1, udp.Interval)
+	assert.Equal("TCP", tcp.Protocol)
+	assert.Equal(tcpConn.LocalAddr().String(), tcp.Remote)
+	assert.Equal("352656100367872", tcp.IMEI)
+	assert.Equal(2, tcp.Interval)
+
+	var session AdminSession
+	assert.Equal(http.StatusOK, adminRequest(t, server, http.MethodGet, adminSessionsPath+"/"+tcp.ID, testAdminToken, &session))
+	assert.Equal(tcp, session, "A single session should be inspectable")
+	assert.Equal(http.StatusNotFound, adminRequest(t, server, http.MethodGet, adminSessionsPath+"/unknown", testAdminToken, nil))
+	assert.Equal(http.StatusNotFound, adminRequest(t, server, http.MethodDelete, adminSessionsPath+"/unknown", testAdminToken, nil))
+
+	assert.Equal(http.StatusNoContent, adminRequest(t, server, http.MethodDelete, adminSessionsPath+"/"+udp.ID, testAdminToken, nil), "The UDP session should be expired")
+	assert.Equal(http.StatusNoContent, adminRequest(t, server, http.MethodDelete, adminSessionsPath+"/"+tcp.ID, testAdminToken, nil), "The TCP connection should be closed")
+	clock.Advance(2 * time.Second)
+
+	assert.Eventually(func() bool {
+		return len(sink.natLogEntries()) == 2
+	}, replyTimeout, time.Millisecond, "Both probes should be recorded")
+	for _, entry := range sink.natLogEntries() {
+		assert.True(entry.Interrupted, "Probes of ended sessions should be recorded as interrupted")
+		assert.False(entry.Timeout, "Probes of ended sessions did not time out")
+	}
+	assert.Eventually(func() bool {
+		sessions = nil
+		adminRequest(t, server, http.MethodGet, adminSessionsPath, testAdminToken, &sessions)
+		return len(sessions) == 0
+	}, replyTimeout, time.Millisecond, "No sessions should be left")
+}
+
+func TestAdminPendingUDPReply(t *testing.T) {
+	assert := assert.New(t)
+	sink := &memorySink{}
+	server, clock := newFakeClockServer(t, sink, adminAPI(t))
+
+	conn := dialUDP(t, server)
+	defer conn.Close()
+	_, err := conn.Write(NATtestCases[1])
+	assert.NoError(err, "The message should be sent")
+	if !clock.WaitForTimer(2 * time.Second) {
+		t.Fatal("Server did not wait for the interval")
+	}
+
+	var sessions []AdminSession
+	assert.Equal(http.StatusOK, adminRequest(t, server, http.MethodGet, adminSessionsPath, testAdminToken, &sessions))
+	if !assert.Len(sessions, 1, "The probe waiting for its reply should be listed") {
+		return
+	}
+	assert.Equal("UDP", sessions[0].Protocol)
+	assert.True(sessions[0].Pending, "The server has not replied yet")
+	assert.Equal(conn.LocalAddr().String(), sessions[0].Remote)
+	assert.Equal(2, sessions[0].Interval)
+
+	assert.Equal(http.StatusNoContent, adminRequest(t, server, http.MethodDelete, adminSessionsPath+"/"+sessions[0].ID, testAdminToken, nil), "The reply should be canceled")
+	assert.Eventually(func() bool {
+		return len(sink.natLogEntries()) == 1
+	}, replyTimeout, time.Millisecond, "The probe should be recorded")
+	entries := sink.natLogEntries()
+	if assert.Len(entries, 1) {
+		assert.True(entries[0].Interrupted, "The probe of the canceled reply should be recorded as interrupted")
+		assert.Equal(sessions[0].ID, entries[0].TraceID)
+	}
+
+	clock.Advance(2 * time.Second)
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err = conn.Read(make([]byte, 256))
+	assert.Error(err, "The server should not reply anymore")
+	sessions = nil
+	assert.Equal(http.StatusOK, adminRequest(t, server, http.MethodGet, adminSessionsPath, testAdminToken, &sessions))
+	assert.Empty(sessions, "No sessions should be left")
+}
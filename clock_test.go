@@ -0,0 +1,136 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeClock is a Clock for tests which only moves forward when Advance is called
+type fakeClock struct {
+	now    time.Time
+	timers map[*fakeTimer]struct{}
+	Mux    sync.Mutex
+}
+
+// fakeTimer fires once its clock has been advanced past At
+type fakeTimer struct {
+	clock *fakeClock
+	At    time.Time
+	c     chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{
+		now:    time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		timers: make(map[*fakeTimer]struct{}),
+	}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.Mux.Lock()
+	defer c.Mux.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) Timer {
+	t := &fakeTimer{clock: c, c: make(chan time.Time, 1)}
+	t.Reset(d)
+	return t
+}
+
+// Advance moves the clock forward by d and fires all timers which are due
+func (c *fakeClock) Advance(d time.Duration) {
+	c.Mux.Lock()
+	defer c.Mux.Unlock()
+	c.now = c.now.Add(d)
+	for t := range c.timers {
+		if !t.At.After(c.now) {
+			t.fire()
+		}
+	}
+}
+
+// WaitForTimer waits until a timer is due within d and returns false if there is none after a second.
+// Call it before Advance, so that a timer which is about to be created or reset is not missed.
+func (c *fakeClock) WaitForTimer(d time.Duration) bool {
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		c.Mux.Lock()
+		limit := c.now.Add(d)
+		for t := range c.timers {
+			if !t.At.After(limit) {
+				c.Mux.Unlock()
+				return true
+			}
+		}
+		c.Mux.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+	return false
+}
+
+// fire sends the current time on the timer's channel, the clock must be locked
+func (t *fakeTimer) fire() {
+	delete(t.clock.timers, t)
+	select {
+	case t.c <- t.clock.now:
+	default:
+	}
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.Mux.Lock()
+	defer t.clock.Mux.Unlock()
+	_, active := t.clock.timers[t]
+	delete(t.clock.timers, t)
+	return active
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.Mux.Lock()
+	defer t.clock.Mux.Unlock()
+	_, active := t.clock.timers[t]
+	t.At = t.clock.now.Add(d)
+	t.clock.timers[t] = struct{}{}
+	if d <= 0 {
+		t.fire()
+	}
+	return active
+}
+
+func TestFakeClock(t *testing.T) {
+	assert := assert.New(t)
+	clock := newFakeClock()
+	start := clock.Now()
+
+	timer := clock.NewTimer(time.Minute)
+	assert.True(clock.WaitForTimer(time.Minute), "The timer should be due within a minute")
+	assert.False(clock.WaitForTimer(time.Second), "The timer should not be due within a second")
+
+	clock.Advance(59 * time.Second)
+	select {
+	case <-timer.C():
+		t.Error("The timer should not fire early")
+	default:
+	}
+
+	clock.Advance(time.Second)
+	assert.Equal(start.Add(time.Minute), <-timer.C(), "The timer should fire once its time has passed")
+	assert.False(timer.Stop(), "A fired timer should not be active")
+
+	assert.False(timer.Reset(time.Second), "A fired timer should not be active")
+	assert.True(timer.Stop(), "A reset timer should be active")
+	clock.Advance(time.Second)
+	select {
+	case <-timer.C():
+		t.Error("A stopped timer should not fire")
+	default:
+	}
+}
@@ -0,0 +1,616 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// CoAP message types, RFC 7252 section 3
+const (
+	coapConfirmable     = 0
+	coapNonConfirmable  = 1
+	coapAcknowledgement = 2
+	coapReset           = 3
+)
+
+// coapCode returns the code of a CoAP message with class and detail, e.g. coapCode(2, 5) for 2.05
+func coapCode(class uint8, detail uint8) uint8 {
+	return class<<5 | detail
+}
+
+// CoAP method and response codes
+var (
+	coapEmpty              = coapCode(0, 0)
+	coapGET                = coapCode(0, 1)
+	coapPOST               = coapCode(0, 2)
+	coapContent            = coapCode(2, 5)
+	coapBadRequest         = coapCode(4, 0)
+	coapNotFound           = coapCode(4, 4)
+	coapMethodNotAllowed   = coapCode(4, 5)
+	coapServiceUnavailable = coapCode(5, 3)
+)
+
+// CoAP option numbers
+const (
+	coapOptionObserve       = 6
+	coapOptionURIPath       = 11
+	coapOptionContentFormat = 12
+)
+
+// coapTextPlain is the content format of the responses
+const coapTextPlain = 0
+
+// coapPath is the resource devices post their NAT test messages to
+const coapPath = "nat"
+
+// Transmission parameters, RFC 7252 section 4.8
+const coapAckTimeout = 2 * time.Second
+const coapAckRandomFactor = 1.5
+const coapMaxRetransmit = 4
+
+// Observe values of a request, RFC 7641 section 2
+const (
+	coapObserveRegister   = 0
+	coapObserveDeregister = 1
+)
+
+var errCoAPFormat = errors.New("Message is not a valid CoAP message")
+
+// CoAPInfo describes how the response to a CoAP NAT test message was delivered
+type CoAPInfo struct {
+	// Observe is true if the device observes the resource, the response is then one of its notifications
+	Observe bool
+	// Sequence is the number of the notification
+	Sequence uint32 `json:",omitempty"`
+	// Retransmissions is how often the response had to be sent again before the device acknowledged it
+	Retransmissions int
+	// Reset is true if the device rejected the response with a reset message, e.g. to cancel its observation
+	Reset bool `json:",omitempty"`
+}
+
+// coapOption is an option of a CoAP message
+type coapOption struct {
+	Number uint16
+	Value  []byte
+}
+
+// coapMessage is a CoAP message, RFC 7252 section 3
+type coapMessage struct {
+	Type      uint8
+	Code      uint8
+	MessageID uint16
+	Token     []byte
+	Options   []coapOption
+	Payload   []byte
+}
+
+// MarshalBinary encodes the message, the options are sorted by their number
+func (m coapMessage) MarshalBinary() ([]byte, error) {
+	if len(m.Token) > 8 {
+		return nil, errCoAPFormat
+	}
+	buffer := []byte{1<<6 | m.Type<<4 | uint8(len(m.Token)), m.Code, 0, 0}
+	binary.BigEndian.PutUint16(buffer[2:], m.MessageID)
+	buffer = append(buffer, m.Token...)
+
+	options := append([]coapOption(nil), m.Options...)
+	sort.SliceStable(options, func(i, j int) bool {
+		return options[i].Number < options[j].Number
+	})
+	var previous uint16
+	for _, option := range options {
+		delta, deltaExt := coapOptionNibble(int(option.Number - previous))
+		length, lengthExt := coapOptionNibble(len(option.Value))
+		buffer = append(buffer, delta<<4|length)
+		buffer = append(buffer, deltaExt...)
+		buffer = append(buffer, lengthExt...)
+		buffer = append(buffer, option.Value...)
+		previous = option.Number
+	}
+
+	if len(m.Payload) > 0 {
+		buffer = append(buffer, 0xff)
+		buffer = append(buffer, m.Payload...)
+	}
+	return buffer, nil
+}
+
+// coapOptionNibble returns the 4 bit value and the extended bytes encoding an option delta or length of v
+func coapOptionNibble(v int) (uint8, []byte) {
+	switch {
+	case v < 13:
+		return uint8(v), nil
+	case v < 269:
+		return 13, []byte{uint8(v - 13)}
+	default:
+		ext := make([]byte, 2)
+		binary.BigEndian.PutUint16(ext, uint16(v-269))
+		return 14, ext
+	}
+}
+
+// UnmarshalBinary decodes a CoAP message
+func (m *coapMessage) UnmarshalBinary(data []byte) error {
+	if len(data) < 4 || data[0]>>6 != 1 {
+		return errCoAPFormat
+	}
+	tokenLength := int(data[0] & 0x0f)
+	if tokenLength > 8 || len(data) < 4+tokenLength {
+		return errCoAPFormat
+	}
+	*m = coapMessage{
+		Type:      data[0] >> 4 & 0x03,
+		Code:      data[1],
+		MessageID: binary.BigEndian.Uint16(data[2:]),
+		Token:     append([]byte(nil), data[4:4+tokenLength]...),
+	}
+
+	rest := data[4+tokenLength:]
+	var number int
+	for len(rest) > 0 {
+		if rest[0] == 0xff {
+			if len(rest) == 1 {
+				return errCoAPFormat
+			}
+			m.Payload = append([]byte(nil), rest[1:]...)
+			return nil
+		}
+		delta, length := int(rest[0]>>4), int(rest[0]&0x0f)
+		rest = rest[1:]
+		var err error
+		delta, rest, err = coapOptionValue(delta, rest)
+		if err != nil {
+			return err
+		}
+		length, rest, err = coapOptionValue(length, rest)
+		if err != nil {
+			return err
+		}
+		if len(rest) < length {
+			return errCoAPFormat
+		}
+		number += delta
+		m.Options = append(m.Options, coapOption{Number: uint16(number), Value: append([]byte(nil), rest[:length]...)})
+		rest = rest[length:]
+	}
+	return nil
+}
+
+// coapOptionValue decodes the option delta or length starting with the 4 bit value nibble from rest
+func coapOptionValue(nibble int, rest []byte) (int, []byte, error) {
+	switch nibble {
+	case 13:
+		if len(rest) < 1 {
+			return 0, nil, errCoAPFormat
+		}
+		return int(rest[0]) + 13, rest[1:], nil
+	case 14:
+		if len(rest) < 2 {
+			return 0, nil, errCoAPFormat
+		}
+		return int(binary.BigEndian.Uint16(rest)) + 269, rest[2:], nil
+	case 15:
+		return 0, nil, errCoAPFormat
+	}
+	return nibble, rest, nil
+}
+
+// path returns the Uri-Path options of the message separated by slashes
+func (m coapMessage) path() string {
+	var segments []string
+	for _, option := range m.Options {
+		if option.Number == coapOptionURIPath {
+			segments = append(segments, string(option.Value))
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// uintOption returns the value of the first option with number as unsigned integer
+func (m coapMessage) uintOption(number uint16) (uint32, bool) {
+	for _, option := range m.Options {
+		if option.Number == number {
+			var v uint32
+			for _, b := range option.Value {
+				v = v<<8 | uint32(b)
+			}
+			return v, true
+		}
+	}
+	return 0, false
+}
+
+// coapUint encodes v as the value of an unsigned integer option, with as few bytes as possible
+func coapUint(v uint32) []byte {
+	var value []byte
+	for ; v > 0; v >>= 8 {
+		value = append([]byte{uint8(v)}, value...)
+	}
+	return value
+}
+
+// coapExchange is a NAT test of a device at Addr, identified by the token of its request.
+// Once the requested interval has passed the response is sent as confirmable message,
+// which times out if the device does not acknowledge it.
+type coapExchange struct {
+	Conn     net.PacketConn
+	Addr     net.Addr
+	Token    []byte
+	Observe  bool
+	Sequence uint32
+	Log      NATLogEntry
+	// RequestID is the message ID of the request, to recognize retransmissions of it
+	RequestID uint16
+	// ResponseID and Response are the message ID and encoding of the response waiting to be acknowledged,
+	// Response is nil until the first response has been sent
+	ResponseID      uint16
+	Response        []byte
+	Retransmissions int
+	// AckTimeout is the wait for the acknowledgement of the first transmission of the response, it doubles with each retransmission
+	AckTimeout time.Duration
+	// Task is the scheduled response or retransmission, it is nil once the exchange has ended
+	Task *scheduledTask
+}
+
+// coapExchangeMap stores the exchanges by address and token, and the ones waiting for an acknowledgement by address and message ID
+type coapExchangeMap struct {
+	Map     map[string]*coapExchange
+	Pending map[string]*coapExchange
+	Mux     sync.Mutex
+}
+
+func coapTokenKey(addr net.Addr, token []byte) string {
+	return fmt.Sprintf("%s/%x", addr, token)
+}
+
+func coapMessageIDKey(addr net.Addr, id uint16) string {
+	return fmt.Sprintf("%s#%d", addr, id)
+}
+
+// logEntry returns the log entry of the response currently sent in ex
+func (ex *coapExchange) logEntry(reset bool) NATLogEntry {
+	logEntry := ex.Log
+	logEntry.CoAP = &CoAPInfo{Observe: ex.Observe, Retransmissions: ex.Retransmissions, Reset: reset}
+	if ex.Observe {
+		logEntry.CoAP.Sequence = ex.Sequence
+	}
+	return logEntry
+}
+
+// nextCoAPMessageID returns the ID for the next message the server sends
+func (s *Server) nextCoAPMessageID() uint16 {
+	return uint16(atomic.AddUint32(&s.coapMessageID, 1))
+}
+
+// sendCoAP encodes m and sends it to addr
+func sendCoAP(conn net.PacketConn, addr net.Addr, m coapMessage) error {
+	buffer, err := m.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	_, err = conn.WriteTo(buffer, addr)
+	return err
+}
+
+// replyCoAP answers request right away with code, piggybacked on the acknowledgement of confirmable requests
+func (s *Server) replyCoAP(conn net.PacketConn, addr net.Addr, request coapMessage, code uint8, payload []byte) {
+	reply := coapMessage{Type: coapAcknowledgement, Code: code, MessageID: request.MessageID, Token: request.Token, Payload: payload}
+	if request.Type == coapNonConfirmable {
+		reply.Type = coapNonConfirmable
+		reply.MessageID = s.nextCoAPMessageID()
+	}
+	if len(payload) > 0 {
+		reply.Options = []coapOption{{Number: coapOptionContentFormat, Value: coapUint(coapTextPlain)}}
+	}
+	sendCoAP(conn, addr, reply)
+}
+
+func (s *Server) acceptCoAP(l *udpListener) {
+	conn := l.Conn
+	defer s.runningAcceptors.Done()
+	for {
+		buffer := make([]byte, s.config.BufferSize)
+
+		n, addr, local, err := l.ReadFrom(buffer)
+		if err != nil && s.isStopping() {
+			return
+		} else if err != nil && acceptFailed(err) {
+			s.recordAcceptorError("CoAP", conn.LocalAddr(), err)
+			return
+		} else if err != nil {
+			slog.Warn("Error reading CoAP listener", "local", conn.LocalAddr().String(), "error", err)
+			continue
+		}
+
+		var m coapMessage
+		err = m.UnmarshalBinary(buffer[:n])
+		if err != nil {
+			connLogger("CoAP", addr).Warn("Invalid CoAP message", "error", err)
+			continue
+		}
+		s.handleCoAP(conn, addr, local, m)
+	}
+}
+
+// handleCoAP handles a CoAP message from the device at addr
+func (s *Server) handleCoAP(conn net.PacketConn, addr net.Addr, local net.Addr, m coapMessage) {
+	switch {
+	case m.Type == coapAcknowledgement || m.Type == coapReset:
+		s.completeCoAPExchange(addr, m)
+	case m.Code == coapEmpty:
+		// A ping, RFC 7252 section 4.3
+		if m.Type == coapConfirmable {
+			sendCoAP(conn, addr, coapMessage{Type: coapReset, MessageID: m.MessageID})
+		}
+	case m.path() != coapPath:
+		s.replyCoAP(conn, addr, m, coapNotFound, nil)
+	default:
+		s.handleCoAPRequest(conn, addr, local, m)
+	}
+}
+
+// handleCoAPRequest starts a NAT test for a request to the resource.
+// The request is acknowledged right away and the response is sent separately once the interval has passed.
+// With Observe the device receives a new notification each time the interval has passed after it acknowledged the previous one.
+func (s *Server) handleCoAPRequest(conn net.PacketConn, addr net.Addr, local net.Addr, m coapMessage) {
+	key := coapTokenKey(addr, m.Token)
+	observe, observing := m.uintOption(coapOptionObserve)
+
+	s.coapExchanges.Mux.Lock()
+	ex, exists := s.coapExchanges.Map[key]
+	retransmitted := exists && ex.RequestID == m.MessageID
+	s.coapExchanges.Mux.Unlock()
+	if retransmitted {
+		// The device did not receive our acknowledgement
+		if m.Type == coapConfirmable {
+			sendCoAP(conn, addr, coapMessage{Type: coapAcknowledgement, MessageID: m.MessageID})
+		}
+		return
+	}
+
+	if observing && observe == coapObserveDeregister {
+		if exists {
+			s.cancelCoAPExchange(ex)
+		}
+		s.replyCoAP(conn, addr, m, coapContent, []byte("Observation canceled.\n"))
+		return
+	}
+	if m.Code != coapPOST {
+		s.replyCoAP(conn, addr, m, coapMethodNotAllowed, nil)
+		return
+	}
+
+	logEntry, err := s.parseData(m.Payload, "CoAP", addr, local)
+	if err != nil {
+		connLogger("CoAP", addr).Warn("CoAP request rejected", "error", err)
+		s.replyCoAP(conn, addr, m, coapBadRequest, s.errorMessage(err))
+		return
+	}
+	err = s.acquireHandler()
+	if err == nil {
+		err = s.acquirePendingProbe(addr.String())
+		if err != nil {
+			s.releaseHandler()
+		}
+	}
+	if err != nil {
+		s.logRejection(err, addr.String())
+		s.replyCoAP(conn, addr, m, coapServiceUnavailable, s.errorMessage(err))
+		return
+	}
+	if exists {
+		// The device starts a new test with the same token
+		s.cancelCoAPExchange(ex)
+	}
+
+	if m.Type == coapConfirmable {
+		sendCoAP(conn, addr, coapMessage{Type: coapAcknowledgement, MessageID: m.MessageID})
+	}
+	ex = &coapExchange{
+		Conn:      conn,
+		Addr:      addr,
+		Token:     m.Token,
+		Observe:   observing && observe == coapObserveRegister,
+		Log:       logEntry,
+		RequestID: m.MessageID,
+	}
+	s.coapExchanges.Mux.Lock()
+	s.coapExchanges.Map[key] = ex
+	s.scheduleCoAPResponse(ex)
+	s.coapExchanges.Mux.Unlock()
+}
+
+// scheduleCoAPResponse sends the response of ex once the interval has passed, the exchanges must be locked
+func (s *Server) scheduleCoAPResponse(ex *coapExchange) {
+	var task *scheduledTask
+	// owned returns false if the exchange has moved on in the meantime, the exchanges must be locked
+	owned := func() bool {
+		return ex.Task == task
+	}
+	task = s.scheduler.After(time.Duration(ex.Log.Message.Interval)*time.Second, func() {
+		s.sendCoAPResponse(ex, owned)
+	}, func() {
+		s.interruptCoAPExchange(ex, owned, "CoAP response")
+	})
+	ex.Task = task
+}
+
+// sendCoAPResponse sends the response of ex as confirmable message and retransmits it until it is acknowledged
+func (s *Server) sendCoAPResponse(ex *coapExchange, owned func() bool) {
+	s.coapExchanges.Mux.Lock()
+	if !owned() {
+		s.coapExchanges.Mux.Unlock()
+		return
+	}
+	if ex.Response == nil {
+		s.releasePendingProbe(ex.Addr.String())
+	}
+	response := coapMessage{
+		Type:      coapConfirmable,
+		Code:      coapContent,
+		MessageID: s.nextCoAPMessageID(),
+		Token:     ex.Token,
+		Options:   []coapOption{{Number: coapOptionContentFormat, Value: coapUint(coapTextPlain)}},
+		Payload:   s.replyData(ex.Log),
+	}
+	if ex.Observe {
+		response.Options = append(response.Options, coapOption{Number: coapOptionObserve, Value: coapUint(ex.Sequence)})
+	}
+	ex.ResponseID = response.MessageID
+	ex.Response, _ = response.MarshalBinary()
+	ex.Retransmissions = 0
+	ex.AckTimeout = s.coapAckTimeout()
+	s.coapExchanges.Pending[coapMessageIDKey(ex.Addr, ex.ResponseID)] = ex
+	s.scheduleCoAPRetransmission(ex)
+	logger := entryLogger(ex.Log)
+	s.coapExchanges.Mux.Unlock()
+
+	_, err := ex.Conn.WriteTo(ex.Response, ex.Addr)
+	if err != nil {
+		logger.Warn("CoAP write failed", "error", err)
+		return
+	}
+	logger.Debug("CoAP packet sent")
+}
+
+// coapAckTimeout returns a random initial timeout between ACK_TIMEOUT and ACK_TIMEOUT * ACK_RANDOM_FACTOR,
+// so the retransmissions to many devices are not synchronized, RFC 7252 section 4.2
+func (s *Server) coapAckTimeout() time.Duration {
+	return coapAckTimeout + time.Duration(float64(coapAckTimeout)*(coapAckRandomFactor-1)*s.config.Random())
+}
+
+// scheduleCoAPRetransmission sends the response of ex again until it is acknowledged, the exchanges must be locked.
+// The wait doubles with each retransmission, RFC 7252 section 4.2.
+func (s *Server) scheduleCoAPRetransmission(ex *coapExchange) {
+	var task *scheduledTask
+	owned := func() bool {
+		return ex.Task == task
+	}
+	task = s.scheduler.After(ex.AckTimeout<<uint(ex.Retransmissions), func() {
+		s.coapExchanges.Mux.Lock()
+		if !owned() {
+			s.coapExchanges.Mux.Unlock()
+			return
+		}
+		if ex.Retransmissions == coapMaxRetransmit {
+			logEntry := ex.logEntry(false)
+			s.removeCoAPExchange(ex)
+			s.coapExchanges.Mux.Unlock()
+			entryLogger(logEntry).Info("CoAP response was not acknowledged")
+			logEntry.Timeout = true
+			s.writeLog <- logEntry
+			s.releaseHandler()
+			return
+		}
+		ex.Retransmissions++
+		s.scheduleCoAPRetransmission(ex)
+		s.coapExchanges.Mux.Unlock()
+		ex.Conn.WriteTo(ex.Response, ex.Addr)
+	}, func() {
+		s.interruptCoAPExchange(ex, owned, "Waiting for CoAP acknowledgement")
+	})
+	ex.Task = task
+}
+
+// completeCoAPExchange handles the acknowledgement or reset of a response
+func (s *Server) completeCoAPExchange(addr net.Addr, m coapMessage) {
+	key := coapMessageIDKey(addr, m.MessageID)
+	reset := m.Type == coapReset
+	s.coapExchanges.Mux.Lock()
+	ex, ok := s.coapExchanges.Pending[key]
+	if !ok {
+		s.coapExchanges.Mux.Unlock()
+		return
+	}
+	s.scheduler.Cancel(ex.Task)
+	delete(s.coapExchanges.Pending, key)
+	logEntry := ex.logEntry(reset)
+	observing := ex.Observe && !reset
+	if observing {
+		// Notify the device again once the interval has passed
+		ex.Sequence++
+		ex.Retransmissions = 0
+		ex.Log.Timestamp = s.config.Clock.Now()
+		ex.Log.TraceID = uuid.New().String()
+		s.scheduleCoAPResponse(ex)
+	} else {
+		s.removeCoAPExchange(ex)
+	}
+	s.coapExchanges.Mux.Unlock()
+
+	if reset {
+		entryLogger(logEntry).Info("CoAP response was reset")
+	} else {
+		entryLogger(logEntry).Debug("CoAP response was acknowledged")
+	}
+	s.writeLog <- logEntry
+	if !observing {
+		s.releaseHandler()
+	}
+}
+
+// cancelCoAPExchange ends ex because the device started a new test with the same token or canceled its observation.
+// Its probe is stored like the one of a previous interval, as interrupted if the response was not sent yet.
+func (s *Server) cancelCoAPExchange(ex *coapExchange) {
+	s.coapExchanges.Mux.Lock()
+	if ex.Task == nil {
+		s.coapExchanges.Mux.Unlock()
+		return
+	}
+	s.scheduler.Cancel(ex.Task)
+	pending := ex.Response == nil
+	// The response was sent and waits for its acknowledgement, otherwise the device cut the interval short
+	sent := s.coapExchanges.Pending[coapMessageIDKey(ex.Addr, ex.ResponseID)] == ex
+	logEntry := ex.logEntry(false)
+	s.removeCoAPExchange(ex)
+	s.coapExchanges.Mux.Unlock()
+
+	if pending {
+		s.releasePendingProbe(ex.Addr.String())
+	}
+	entryLogger(logEntry).Info("CoAP exchange canceled")
+	logEntry.Interrupted = !sent
+	s.writeLog <- logEntry
+	s.releaseHandler()
+}
+
+// interruptCoAPExchange records ex as interrupted by the shutdown of the server
+func (s *Server) interruptCoAPExchange(ex *coapExchange, owned func() bool, waiting string) {
+	s.coapExchanges.Mux.Lock()
+	if !owned() {
+		s.coapExchanges.Mux.Unlock()
+		return
+	}
+	pending := ex.Response == nil
+	logEntry := ex.logEntry(false)
+	s.removeCoAPExchange(ex)
+	s.coapExchanges.Mux.Unlock()
+
+	if pending {
+		s.releasePendingProbe(ex.Addr.String())
+	}
+	entryLogger(logEntry).Info(waiting + " interrupted")
+	logEntry.Interrupted = true
+	s.writeLog <- logEntry
+	s.releaseHandler()
+}
+
+// removeCoAPExchange forgets ex, the exchanges must be locked
+func (s *Server) removeCoAPExchange(ex *coapExchange) {
+	ex.Task = nil
+	key := coapTokenKey(ex.Addr, ex.Token)
+	if s.coapExchanges.Map[key] == ex {
+		delete(s.coapExchanges.Map, key)
+	}
+	delete(s.coapExchanges.Pending, coapMessageIDKey(ex.Addr, ex.ResponseID))
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// coapListener adds a CoAP listener on a random local port
+func coapListener(t *testing.T) func(*Config) {
+	return func(config *Config) {
+		config.CoAPConns = []net.PacketConn{localUDPConn(t)}
+	}
+}
+
+// dialCoAP connects to the server's CoAP port from a new local port
+func dialCoAP(t *testing.T, server *Server) *net.UDPConn {
+	conn, err := net.DialUDP("udp", nil, server.CoAPAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("Failed to connect to the server: %s", err)
+	}
+	return conn
+}
+
+// coapRequest returns a confirmable request for the NAT test resource with message as payload
+func coapRequest(code uint8, id uint16, message []byte, options ...coapOption) coapMessage {
+	return coapMessage{
+		Type:      coapConfirmable,
+		Code:      code,
+		MessageID: id,
+		Token:     []byte{0xca, 0xfe},
+		Options:   append([]coapOption{{Number: coapOptionURIPath, Value: []byte(coapPath)}}, options...),
+		Payload:   bytes.TrimSuffix(message, []byte("\n")),
+	}
+}
+
+func writeCoAP(t *testing.T, conn net.Conn, m coapMessage) {
+	buffer, err := m.MarshalBinary()
+	if err != nil {
+		t.Fatalf("Failed to encode CoAP message: %s", err)
+	}
+	if _, err = conn.Write(buffer); err != nil {
+		t.Fatalf("Failed to write: %s", err)
+	}
+}
+
+func readCoAP(t *testing.T, conn net.Conn) coapMessage {
+	conn.SetReadDeadline(time.Now().Add(replyTimeout))
+	buffer := make([]byte, 512)
+	n, err := conn.Read(buffer)
+	if err != nil {
+		t.Fatalf("Server failed to answer: %s", err)
+	}
+	var m coapMessage
+	if err = m.UnmarshalBinary(buffer[:n]); err != nil {
+		t.Fatalf("Server sent an invalid CoAP message: %s", err)
+	}
+	return m
+}
+
+// awaitCoAPResponse advances clock by d and returns the separate response the server sends then
+func awaitCoAPResponse(t *testing.T, clock *fakeClock, conn net.Conn, d time.Duration) coapMessage {
+	if !clock.WaitForTimer(d) {
+		t.Fatalf("Server did not wait for %s", d)
+	}
+	clock.Advance(d)
+	response := readCoAP(t, conn)
+	assert.Equal(t, uint8(coapConfirmable), response.Type, "The response should be confirmable")
+	assert.Equal(t, coapContent, response.Code, "The response should be 2.05 Content")
+	assert.Equal(t, []byte{0xca, 0xfe}, response.Token, "The response should carry the token of the request")
+	return response
+}
+
+func TestCoAPMessage(t *testing.T) {
+	assert := assert.New(t)
+	m := coapMessage{
+		Type:      coapConfirmable,
+		Code:      coapPOST,
+		MessageID: 0x1234,
+		Token:     []byte{1, 2, 3, 4},
+		Options: []coapOption{
+			{Number: coapOptionURIPath, Value: []byte(coapPath)},
+			{Number: coapOptionObserve, Value: coapUint(0)},
+			{Number: 2000, Value: bytes.Repeat([]byte{'a'}, 300)},
+			{Number: 60, Value: bytes.Repeat([]byte{'b'}, 20)},
+		},
+		Payload: []byte("{}"),
+	}
+	buffer, err := m.MarshalBinary()
+	assert.NoError(err, "The message should be encoded")
+
+	var decoded coapMessage
+	if assert.NoError(decoded.UnmarshalBinary(buffer), "The message should be decoded") {
+		assert.Equal(m.MessageID, decoded.MessageID, "The message ID should be kept")
+		assert.Equal(m.Token, decoded.Token, "The token should be kept")
+		assert.Equal(m.Payload, decoded.Payload, "The payload should be kept")
+		assert.Equal([]uint16{coapOptionObserve, coapOptionURIPath, 60, 2000}, []uint16{decoded.Options[0].Number, decoded.Options[1].Number, decoded.Options[2].Number, decoded.Options[3].Number}, "The options should be sorted")
+		assert.Len(decoded.Options[3].Value, 300, "Long option values should be kept")
+		assert.Equal(coapPath, decoded.path(), "The path should be decoded")
+		observe, ok := decoded.uintOption(coapOptionObserve)
+		assert.True(ok, "The Observe option should be found")
+		assert.Equal(uint32(0), observe, "Zero should be encoded without bytes")
+	}
+
+	assert.Error(decoded.UnmarshalBinary(buffer[:3]), "Truncated headers should be rejected")
+	assert.Error(decoded.UnmarshalBinary(append([]byte{0x80}, buffer[1:]...)), "Other versions should be rejected")
+	assert.Error(decoded.UnmarshalBinary([]byte{0x40, 0x01, 0x00, 0x01, 0xff}), "Empty payloads after the marker should be rejected")
+	assert.Error(decoded.UnmarshalBinary([]byte{0x40, 0x01, 0x00, 0x01, 0xb5, 'n'}), "Truncated options should be rejected")
+}
+
+func TestCoAP(t *testing.T) {
+	assert := assert.New(t)
+	sink := &memorySink{}
+	server, clock := newFakeClockServer(t, sink, coapListener(t))
+	conn := dialCoAP(t, server)
+	defer conn.Close()
+
+	writeCoAP(t, conn, coapRequest(coapPOST, 1, NATtestCases[0]))
+	ack := readCoAP(t, conn)
+	assert.Equal(uint8(coapAcknowledgement), ack.Type, "The request should be acknowledged right away")
+	assert.Equal(coapEmpty, ack.Code, "The response should be sent separately")
+	assert.Equal(uint16(1), ack.MessageID, "The acknowledgement should match the request")
+
+	response := awaitCoAPResponse(t, clock, conn, time.Second)
+	writeCoAP(t, conn, coapMessage{Type: coapAcknowledgement, MessageID: response.MessageID})
+
+	assert.Eventually(func() bool {
+		return len(sink.natLogEntries()) == 1
+	}, replyTimeout, time.Millisecond, "The acknowledged response should be logged")
+	entries := sink.natLogEntries()
+	if assert.Len(entries, 1) && assert.NotNil(entries[0].CoAP, "The CoAP exchange should be recorded") {
+		assert.Equal("CoAP", entries[0].Protocol, "The protocol should be logged")
+		assert.Equal(replyTraceID(string(response.Payload)), entries[0].TraceID, "The TraceID of the response should be logged")
+		assert.False(entries[0].Timeout, "The acknowledged response should not time out")
+		assert.False(entries[0].CoAP.Observe, "The device did not observe the resource")
+		assert.Equal(0, entries[0].CoAP.Retransmissions, "The response should not be retransmitted")
+	}
+}
+
+// coapRandom makes the server draw r for every random timeout
+func coapRandom(r float64) func(*Config) {
+	return func(config *Config) {
+		config.Random = func() float64 { return r }
+	}
+}
+
+func TestCoAPAckTimeout(t *testing.T) {
+	assert := assert.New(t)
+	for r, timeout := range map[float64]time.Duration{0: 2 * time.Second, 0.5: 2500 * time.Millisecond, 0.999: 2999 * time.Millisecond} {
+		server, _ := newFakeClockServer(t, &memorySink{}, coapRandom(r))
+		assert.Equal(timeout, server.coapAckTimeout(), "The initial timeout should lie between ACK_TIMEOUT and ACK_TIMEOUT * ACK_RANDOM_FACTOR")
+	}
+}
+
+func TestCoAPRetransmission(t *testing.T) {
+	assert := assert.New(t)
+	sink := &memorySink{}
+	server, clock := newFakeClockServer(t, sink, coapListener(t), coapRandom(0.5))
+	ackTimeout := 2500 * time.Millisecond
+	conn := dialCoAP(t, server)
+	defer conn.Close()
+
+	writeCoAP(t, conn, coapRequest(coapPOST, 1, NATtestCases[0]))
+	readCoAP(t, conn)
+	// A retransmitted request is acknowledged again without starting a new test
+	writeCoAP(t, conn, coapRequest(coapPOST, 1, NATtestCases[0]))
+	assert.Equal(uint16(1), readCoAP(t, conn).MessageID, "The retransmitted request should be acknowledged again")
+
+	response := awaitCoAPResponse(t, clock, conn, time.Second)
+	for i := 0; i < coapMaxRetransmit; i++ {
+		retransmission := awaitCoAPResponse(t, clock, conn, ackTimeout<<uint(i))
+		assert.Equal(response.MessageID, retransmission.MessageID, "The response should be retransmitted")
+	}
+	assert.True(clock.WaitForTimer(ackTimeout<<coapMaxRetransmit), "The server should wait for the last retransmission")
+	clock.Advance(ackTimeout << coapMaxRetransmit)
+
+	assert.Eventually(func() bool {
+		return len(sink.natLogEntries()) == 1
+	}, replyTimeout, time.Millisecond, "The unacknowledged response should be logged")
+	entries := sink.natLogEntries()
+	if assert.Len(entries, 1) && assert.NotNil(entries[0].CoAP, "The CoAP exchange should be recorded") {
+		assert.True(entries[0].Timeout, "The unacknowledged response should time out")
+		assert.Equal(coapMaxRetransmit, entries[0].CoAP.Retransmissions, "All retransmissions should be recorded")
+	}
+}
+
+func TestCoAPSameToken(t *testing.T) {
+	assert := assert.New(t)
+	sink := &memorySink{}
+	server, clock := newFakeClockServer(t, sink, coapListener(t))
+	conn := dialCoAP(t, server)
+	defer conn.Close()
+
+	writeCoAP(t, conn, coapRequest(coapPOST, 1, NATtestCases[0]))
+	readCoAP(t, conn)
+	assert.True(clock.WaitForTimer(time.Second), "The server should wait for the interval")
+	// The device starts a new test with the same token before the interval has passed
+	writeCoAP(t, conn, coapRequest(coapPOST, 2, NATtestCases[1]))
+	assert.Equal(uint16(2), readCoAP(t, conn).MessageID, "The new request should be acknowledged")
+	assert.Eventually(func() bool {
+		return len(sink.natLogEntries()) == 1
+	}, replyTimeout, time.Millisecond, "The replaced probe should be logged")
+
+	// The response to the second test is sent, but not acknowledged before the device starts the third one
+	awaitCoAPResponse(t, clock, conn, 2*time.Second)
+	writeCoAP(t, conn, coapRequest(coapPOST, 3, NATtestCases[0]))
+	assert.Equal(uint16(3), readCoAP(t, conn).MessageID, "The new request should be acknowledged")
+	assert.Eventually(func() bool {
+		return len(sink.natLogEntries()) == 2
+	}, replyTimeout, time.Millisecond, "The replaced probe should be logged")
+
+	entries := sink.natLogEntries()
+	if assert.Len(entries, 2) {
+		assert.Equal(1, entries[0].Message.Interval)
+		assert.True(entries[0].Interrupted, "The probe replaced before its response should be interrupted")
+		assert.Equal(2, entries[1].Message.Interval)
+		assert.False(entries[1].Interrupted, "The probe replaced after its response was sent should be stored like a previous interval")
+		assert.False(entries[1].Timeout)
+	}
+}
+
+func TestCoAPObserve(t *testing.T) {
+	assert := assert.New(t)
+	sink := &memorySink{}
+	server, clock := newFakeClockServer(t, sink, coapListener(t))
+	conn := dialCoAP(t, server)
+	defer conn.Close()
+
+	writeCoAP(t, conn, coapRequest(coapPOST, 1, NATtestCases[0], coapOption{Number: coapOptionObserve, Value: coapUint(coapObserveRegister)}))
+	readCoAP(t, conn)
+
+	var notifications []coapMessage
+	for i := 0; i < 2; i++ {
+		notification := awaitCoAPResponse(t, clock, conn, time.Second)
+		sequence, ok := notification.uintOption(coapOptionObserve)
+		assert.True(ok, "Notifications should carry the Observe option")
+		assert.Equal(uint32(i), sequence, "Notifications should be numbered")
+		notifications = append(notifications, notification)
+		if i == 0 {
+			writeCoAP(t, conn, coapMessage{Type: coapAcknowledgement, MessageID: notification.MessageID})
+		}
+	}
+	// The device ends the observation by rejecting the notification
+	writeCoAP(t, conn, coapMessage{Type: coapReset, MessageID: notifications[1].MessageID})
+
+	assert.Eventually(func() bool {
+		return len(sink.natLogEntries()) == 2
+	}, replyTimeout, time.Millisecond, "Every notification should be logged")
+	entries := sink.natLogEntries()
+	for i, entry := range entries {
+		if !assert.NotNil(entry.CoAP, "The CoAP exchange should be recorded") {
+			continue
+		}
+		assert.Equal(replyTraceID(string(notifications[i].Payload)), entry.TraceID, "Each notification should be logged with its own TraceID")
+		assert.True(entry.CoAP.Observe, "The observation should be recorded")
+		assert.Equal(uint32(i), entry.CoAP.Sequence, "The number of the notification should be recorded")
+		assert.Equal(i == 1, entry.CoAP.Reset, "Only the last notification was reset")
+		assert.False(entry.Timeout, "Notifications which were answered should not time out")
+	}
+	assert.Equal(0, server.scheduler.Len(), "No notification should follow a reset")
+}
+
+func TestCoAPErrors(t *testing.T) {
+	assert := assert.New(t)
+	sink := &memorySink{}
+	server, _ := newFakeClockServer(t, sink, coapListener(t))
+	conn := dialCoAP(t, server)
+	defer conn.Close()
+
+	request := coapRequest(coapPOST, 1, NATtestCases[0])
+	request.Options = []coapOption{{Number: coapOptionURIPath, Value: []byte("other")}}
+	writeCoAP(t, conn, request)
+	reply := readCoAP(t, conn)
+	assert.Equal(uint8(coapAcknowledgement), reply.Type, "Errors should be piggybacked on the acknowledgement")
+	assert.Equal(coapNotFound, reply.Code, "Unknown resources should not be found")
+
+	writeCoAP(t, conn, coapRequest(coapGET, 2, NATtestCases[0]))
+	assert.Equal(coapMethodNotAllowed, readCoAP(t, conn).Code, "Only POST should be allowed")
+
+	writeCoAP(t, conn, coapRequest(coapPOST, 3, errorCases[0]))
+	reply = readCoAP(t, conn)
+	assert.Equal(coapBadRequest, reply.Code, "Invalid messages should be rejected")
+	assert.Equal(string(genericErrorMessage), string(reply.Payload), "The error should be explained")
+
+	writeCoAP(t, conn, coapMessage{Type: coapConfirmable, MessageID: 4})
+	assert.Equal(uint8(coapReset), readCoAP(t, conn).Type, "Pings should be answered with a reset")
+	assert.Empty(sink.natLogEntries(), "Rejected requests should not be logged")
+}
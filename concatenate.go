@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// concatenateCommand is the first argument which concatenates the NAT log entries instead of running the server
+const concatenateCommand = "concatenate"
+
+var errNoSimIssuerList = errors.New("Set --iin-list to enrich the entries")
+
+// concatenateNamespace derives the name of a concatenated file from its date, so every run concatenating a date
+// writes to the same file
+var concatenateNamespace = uuid.MustParse("5f6c7f1e-2c4b-4f43-9d53-5b8e0d6c2a10")
+
+// concatenation rolls the objects below Prefix, grouped by the date their key maps to, into one file per date.
+// Dates are compared as strings, like the keys.
+type concatenation struct {
+	Prefix string
+	// NotAfter is the first date which is still written to and therefore not concatenated
+	NotAfter string
+	// Date returns the date of the object of key, it returns false for keys which are not concatenated
+	Date func(key string) (string, bool)
+	// Key returns the key of the file concatenating the objects of date
+	Key func(date string, id uuid.UUID) string
+	// Transform changes the entries before they are concatenated, they are concatenated as they are if it is nil
+	Transform func(json.RawMessage) json.RawMessage
+}
+
+// collect returns the keys below c.Prefix grouped by their date, dates from c.NotAfter on are skipped
+func (c concatenation) collect(store objectStore) (map[string][]string, error) {
+	keys, err := store.List(c.Prefix)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string][]string)
+	for _, key := range keys {
+		date, ok := c.Date(key)
+		if !ok {
+			slog.Warn("Ignoring file without a date", "key", key)
+			continue
+		}
+		if date >= c.NotAfter {
+			slog.Debug("Ignoring file in the current range", "key", key, "date", date, "notAfter", c.NotAfter)
+			continue
+		}
+		files[date] = append(files[date], key)
+	}
+	return files, nil
+}
+
+// run writes the objects of every date before c.NotAfter to a single file, separated by newlines, and deletes them afterwards.
+// The entries are added to the file of an earlier run for the same date, unless it already holds them.
+func (c concatenation) run(store objectStore) error {
+	files, err := c.collect(store)
+	if err != nil {
+		return err
+	}
+	dates := make([]string, 0, len(files))
+	for date := range files {
+		dates = append(dates, date)
+	}
+	sort.Strings(dates)
+	for _, date := range dates {
+		keys := files[date]
+		key := c.Key(date, uuid.NewSHA1(concatenateNamespace, []byte(c.Prefix+date)))
+		existing, err := store.List(key)
+		if err != nil {
+			return err
+		}
+		// A run which failed to delete all of its originals left them in the file already
+		entries := concatenatedEntries{Transform: c.Transform}
+		if len(existing) > 0 && existing[0] == key {
+			err = entries.add(store, key)
+			if err != nil {
+				return err
+			}
+		}
+		for _, original := range keys {
+			err = entries.add(store, original)
+			if err != nil {
+				return err
+			}
+		}
+		err = store.Put(key, bytes.Join(entries.Lines, []byte("\n")))
+		if err != nil {
+			return err
+		}
+		err = store.Delete(keys)
+		if err != nil {
+			return err
+		}
+		slog.Info("Concatenated files", "key", key, "files", len(keys), "entries", len(entries.Lines))
+	}
+	return nil
+}
+
+// concatenatedEntries collects the entries of a concatenated file, each one once
+type concatenatedEntries struct {
+	Lines     [][]byte
+	Transform func(json.RawMessage) json.RawMessage
+	seen      map[string]bool
+}
+
+// add appends the entries of the object of key which were not added yet, transformed and compacted to a single line.
+// Entries are identified by their trace ID, so one enriched with the SIM issuer by an earlier run is not added twice
+// when its original is concatenated again, entries without one by their content.
+func (e *concatenatedEntries) add(store objectStore, key string) error {
+	body, err := store.Get(key)
+	if err != nil {
+		return err
+	}
+	return e.addBody(key, body)
+}
+
+// addBody appends the entries in body, the content of the object of key, which were not added yet
+func (e *concatenatedEntries) addBody(key string, body []byte) error {
+	if e.seen == nil {
+		e.seen = make(map[string]bool)
+	}
+	err := decodeEntries(body, func(raw json.RawMessage) error {
+		if e.Transform != nil {
+			raw = e.Transform(raw)
+		}
+		var line bytes.Buffer
+		if err := json.Compact(&line, raw); err != nil {
+			return err
+		}
+		var entry struct{ TraceID string }
+		id := line.String()
+		if err := json.Unmarshal(raw, &entry); err == nil && len(entry.TraceID) > 0 {
+			id = entry.TraceID
+		}
+		if e.seen[id] {
+			return nil
+		}
+		e.seen[id] = true
+		e.Lines = append(e.Lines, line.Bytes())
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Invalid log entry in %s: %s", key, err)
+	}
+	return nil
+}
+
+// concatenations returns the steps rolling the NAT log entries below natLogPrefix into hours/, hours into days/ and days into months/,
+// the hour, day and month of now are left alone because the server and the previous step still write to them.
+// Like the lambda, the entries are enriched with the issuer of their SIM when they are rolled into hours/, unless issuers is nil.
+func concatenations(natLogPrefix string, now time.Time, issuers *simIssuerList) []concatenation {
+	now = now.UTC()
+	var enrich func(json.RawMessage) json.RawMessage
+	if issuers != nil {
+		enrich = issuers.enrich
+	}
+	return []concatenation{
+		{
+			Prefix:    natLogPrefix,
+			Transform: enrich,
+			NotAfter:  now.Format("2006-01-02T15"),
+			Date: func(key string) (string, bool) {
+				parts := strings.Split(strings.TrimPrefix(key, natLogPrefix), "/")
+				if len(parts) < 5 {
+					return "", false
+				}
+				hour, err := time.Parse("2006/01/02/15", strings.Join(parts[:4], "/"))
+				return hour.Format("2006-01-02T15"), err == nil
+			},
+			Key: func(date string, id uuid.UUID) string {
+				return "hours/" + date + "-" + id.String() + ".txt"
+			},
+		},
+		{
+			Prefix:   "hours/",
+			NotAfter: now.Format("2006-01-02"),
+			Date:     dateOfFile("2006-01-02"),
+			Key: func(date string, id uuid.UUID) string {
+				return "days/" + date + "-" + id.String() + ".txt"
+			},
+		},
+		{
+			Prefix:   "days/",
+			NotAfter: now.Format("2006-01") + "-01",
+			Date: func(key string) (string, bool) {
+				month, ok := dateOfFile("2006-01")(key)
+				return month + "-01", ok
+			},
+			Key: func(date string, id uuid.UUID) string {
+				return "months/" + date[:len("2006-01")] + "-" + id.String() + ".txt"
+			},
+		},
+	}
+}
+
+// dateOfFile returns a function which reads the date in layout from the start of the file name of a key
+func dateOfFile(layout string) func(key string) (string, bool) {
+	return func(key string) (string, bool) {
+		name := path.Base(key)
+		if len(name) < len(layout) {
+			return "", false
+		}
+		_, err := time.Parse(layout, name[:len(layout)])
+		return name[:len(layout)], err == nil
+	}
+}
+
+// concatenateLogs rolls the NAT log entries in store up into hourly, daily and monthly files, enriching them with the issuers of their SIMs
+func concatenateLogs(store objectStore, logPrefix string, now time.Time, issuers *simIssuerList) error {
+	natLogPrefix := "NATLog/"
+	if len(logPrefix) > 0 {
+		natLogPrefix = logPrefix + "/" + natLogPrefix
+	}
+	for _, c := range concatenations(natLogPrefix, now, issuers) {
+		err := c.run(store)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// enrichLogs enriches the entries in the concatenated files with the issuers of their SIMs, like the manual enrichment
+// of the lambda after the issuer list was updated. Files whose entries do not change are not written again.
+func enrichLogs(store objectStore, issuers *simIssuerList) error {
+	for _, prefix := range []string{"hours/", "days/", "months/"} {
+		keys, err := store.List(prefix)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			body, err := store.Get(key)
+			if err != nil {
+				return err
+			}
+			entries := concatenatedEntries{Transform: issuers.enrich}
+			err = entries.addBody(key, body)
+			if err != nil {
+				return err
+			}
+			enriched := bytes.Join(entries.Lines, []byte("\n"))
+			if bytes.Equal(enriched, bytes.TrimRight(body, "\n")) {
+				continue
+			}
+			err = store.Put(key, enriched)
+			if err != nil {
+				return err
+			}
+			slog.Info("Enriched file", "key", key, "entries", len(entries.Lines))
+		}
+	}
+	return nil
+}
+
+// runConcatenate runs the concatenate subcommand with args, the bucket and the log prefix are configured like for the server
+func runConcatenate(args []string, getenv func(string) string, now time.Time) error {
+	settings, _, err := loadSettings(nil, getenv)
+	if err != nil {
+		return err
+	}
+
+	flags := flag.NewFlagSet("nat-testserver concatenate", flag.ContinueOnError)
+	dir := flags.String("dir", "", "local directory with the layout of the bucket to concatenate instead of awsBucket")
+	prefix := flags.String("prefix", settings.LogPrefix, "prefix of the keys of the log entries")
+	iinList := flags.String("iin-list", "", "JSON file with the SIM issuers to enrich the entries with, they are not enriched if it is empty")
+	enrich := flags.Bool("enrich", false, "only enrich the entries of the concatenated files with the SIM issuers of --iin-list")
+	err = flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	var issuers *simIssuerList
+	if *enrich && len(*iinList) == 0 {
+		return errNoSimIssuerList
+	}
+	if len(*iinList) > 0 {
+		issuers, err = loadSimIssuers(*iinList)
+		if err != nil {
+			return fmt.Errorf("Invalid SIM issuer list %s: %s", *iinList, err)
+		}
+	}
+
+	store, err := settings.objectStore(*dir)
+	if err != nil {
+		return err
+	}
+	if *enrich {
+		return enrichLogs(store, issuers)
+	}
+	return concatenateLogs(store, *prefix, now, issuers)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// listAll returns the keys below prefix in store, it fails the test if they cannot be listed
+func listAll(t *testing.T, store objectStore, prefix string) []string {
+	keys, err := store.List(prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+// countEntries returns the number of log entries in the object of key
+func countEntries(t *testing.T, store objectStore, key string) int {
+	body, err := store.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	if err := decodeEntries(body, func(json.RawMessage) error {
+		count++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+// failingDeleteStore deletes only the first of the keys and fails, like a run interrupted while deleting
+type failingDeleteStore struct {
+	objectStore
+}
+
+func (s failingDeleteStore) Delete(keys []string) error {
+	if err := s.objectStore.Delete(keys[:1]); err != nil {
+		return err
+	}
+	return errors.New("Delete failed")
+}
+
+func TestConcatenateLogs(t *testing.T) {
+	assert := assert.New(t)
+	store := dirStore{Dir: t.TempDir()}
+	now := time.Date(2021, 3, 2, 12, 30, 0, 0, time.UTC)
+
+	earlier := searchEntry("192.0.2.1:1000", 60, false, now.Add(-2*time.Hour))
+	sameHour := searchEntry("192.0.2.2:1000", 60, false, now.Add(-2*time.Hour))
+	yesterday := searchEntry("192.0.2.1:1000", 90, true, now.Add(-24*time.Hour))
+	current := searchEntry("192.0.2.1:1000", 120, false, now)
+	for _, e := range []NATLogEntry{earlier, sameHour, yesterday, current} {
+		writeObject(t, store.Dir, "raw/"+e.getKey(), e)
+	}
+	// The AT log is not concatenated, the days of last month were concatenated by earlier runs
+	writeObject(t, store.Dir, "raw/ATLog/2021/03/02/10/192.0.2.1:1000-100000-trace.json", ATLogEntry{})
+	writeObject(t, store.Dir, "days/2021-02-27-4c3b0e4c-6b8f-4c36-8b0a-0dd1d1b3e4a1.txt", earlier)
+	writeObject(t, store.Dir, "days/2021-02-28-8f0a1b4c-3d2e-4f5a-9b6c-7d8e9f0a1b2c.txt", sameHour)
+
+	assert.Nil(concatenateLogs(store, "raw", now, nil))
+	assert.Equal([]string{"raw/" + current.getKey()}, listAll(t, store, "raw/NATLog/"), "The current hour should be left alone")
+	assert.Len(listAll(t, store, "raw/ATLog/"), 1, "The AT log should not be concatenated")
+	hours := listAll(t, store, "hours/")
+	if assert.Len(hours, 1, "Yesterday's hour should be rolled into its day") {
+		assert.True(strings.HasPrefix(hours[0], "hours/2021-03-02T10-"))
+		body, err := store.Get(hours[0])
+		assert.Nil(err)
+		assert.Equal(2, strings.Count(string(body), "\n")+1, "The entries of the hour should be separated by a newline")
+	}
+	days := listAll(t, store, "days/")
+	if assert.Len(days, 1, "Last month's days should be rolled into its month") {
+		assert.True(strings.HasPrefix(days[0], "days/2021-03-01-"))
+	}
+	months := listAll(t, store, "months/")
+	if assert.Len(months, 1) {
+		assert.True(strings.HasPrefix(months[0], "months/2021-02-"))
+		assert.Equal(2, countEntries(t, store, months[0]))
+	}
+
+	assert.Nil(concatenateLogs(store, "raw", now, nil), "A repeated run should not change anything")
+	assert.Equal(hours, listAll(t, store, "hours/"))
+	assert.Equal(days, listAll(t, store, "days/"))
+	assert.Equal(months, listAll(t, store, "months/"))
+
+	// Entries uploaded late for a concatenated hour are added to its file
+	late := searchEntry("192.0.2.3:1000", 60, false, now.Add(-2*time.Hour))
+	writeObject(t, store.Dir, "raw/"+late.getKey(), late)
+	assert.Nil(concatenateLogs(store, "raw", now, nil))
+	assert.Equal(hours, listAll(t, store, "hours/"))
+	assert.Equal(3, countEntries(t, store, hours[0]))
+	assert.Len(listAll(t, store, "raw/NATLog/"), 1)
+
+	assert.Equal(errNoObjectStore, runConcatenate(nil, func(string) string { return "" }, now))
+}
+
+func TestConcatenateFailedDelete(t *testing.T) {
+	assert := assert.New(t)
+	store := dirStore{Dir: t.TempDir()}
+	now := time.Date(2021, 3, 2, 12, 30, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		e := searchEntry("192.0.2.1:1000", 60+i, false, now.Add(-2*time.Hour+time.Duration(i)*time.Minute))
+		writeObject(t, store.Dir, "raw/"+e.getKey(), e)
+	}
+
+	assert.NotNil(concatenateLogs(failingDeleteStore{store}, "raw", now, nil))
+	hours := listAll(t, store, "hours/")
+	assert.Len(hours, 1)
+	assert.Len(listAll(t, store, "raw/NATLog/"), 2, "Only the first original should be deleted")
+	// The manual enrichment rewrites the entries before the run is repeated
+	body, err := store.Get(hours[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(store.Put(hours[0], bytes.ReplaceAll(body, []byte(`{"Protocol"`), []byte(`{"simIssuer":"Example","Protocol"`))))
+
+	assert.Nil(concatenateLogs(store, "raw", now, nil), "The run should be repeated")
+	assert.Equal(hours, listAll(t, store, "hours/"), "The repeated run should write to the same file")
+	assert.Equal(3, countEntries(t, store, hours[0]), "Every entry should be concatenated once")
+	body, err = store.Get(hours[0])
+	assert.Nil(err)
+	assert.Equal(3, strings.Count(string(body), `"simIssuer":"Example"`), "The enriched entries should be kept")
+	assert.Empty(listAll(t, store, "raw/NATLog/"))
+}
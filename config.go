@@ -0,0 +1,533 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pion/dtls/v3"
+	"gopkg.in/yaml.v2"
+)
+
+// Settings are all values the server can be configured with.
+// They are read from a YAML configuration file, the environment and command-line flags, in increasing order of precedence.
+type Settings struct {
+	UDPPorts             []int
+	TCPPorts             []int
+	TLSPorts             []int
+	DTLSPorts            []int
+	CoAPPorts            []int
+	MQTTPorts            []int
+	HTTPPorts            []int
+	QUICPorts            []int
+	ATPort               int
+	IPMode               string
+	BufferSize           int
+	UDPTimeout           int
+	UploadTimeout        int
+	ShutdownTimeout      int
+	NATSchemaFile        string
+	ATSchemaFile         string
+	MaxInterval          int
+	MaxPendingPerAddress int
+	MaxHandlers          int
+	MaxLogBacklog        int
+	MQTTKeepAlivePercent int
+	SearchIdleTimeout    int
+	MonitoringAddr       string
+	AdminToken           string
+	LogFormat            string
+	LogLevel             string
+	AWSBucket            string
+	AWSRegion            string
+	AWSAccessKeyID       string
+	AWSSecretAccessKey   string
+	LogPrefix            string
+	SessionStateFile     string
+	SessionStateKey      string
+	TLSCertFile          string
+	TLSKeyFile           string
+	TLSClientCAFile      string
+	DTLSPSKIdentity      string
+	DTLSPSK              string
+	DTLSConnectionID     bool
+}
+
+// setting describes how a single value of the Settings is named in the configuration file, the environment and on the command line
+type setting struct {
+	Key      string
+	Env      string
+	Flag     string
+	Usage    string
+	Required bool
+	Secret   bool
+	Value    flag.Value
+}
+
+// intValue, stringValue, boolValue and portsValue let the settings be set from text
+type intValue struct{ p *int }
+type stringValue struct{ p *string }
+type boolValue struct{ p *bool }
+
+// portsValue is a list of ports and port ranges separated by commas, e.g. "3050, 5683, 40000-40010"
+type portsValue struct{ p *[]int }
+
+func (v intValue) String() string {
+	if v.p == nil {
+		return "0"
+	}
+	return strconv.Itoa(*v.p)
+}
+
+func (v intValue) Set(s string) error {
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		return errors.New("Not an integer")
+	}
+	*v.p = i
+	return nil
+}
+
+func (v stringValue) String() string {
+	if v.p == nil {
+		return ""
+	}
+	return *v.p
+}
+
+func (v stringValue) Set(s string) error {
+	*v.p = s
+	return nil
+}
+
+func (v boolValue) String() string {
+	if v.p == nil {
+		return "false"
+	}
+	return strconv.FormatBool(*v.p)
+}
+
+func (v boolValue) Set(s string) error {
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return errors.New("Not a boolean")
+	}
+	*v.p = b
+	return nil
+}
+
+func (v portsValue) String() string {
+	if v.p == nil {
+		return ""
+	}
+	ports := *v.p
+	var parts []string
+	for i := 0; i < len(ports); i++ {
+		// Collapse consecutive ports into a range
+		j := i
+		for j+1 < len(ports) && ports[j+1] == ports[j]+1 {
+			j++
+		}
+		if j > i {
+			parts = append(parts, fmt.Sprintf("%d-%d", ports[i], ports[j]))
+		} else {
+			parts = append(parts, strconv.Itoa(ports[i]))
+		}
+		i = j
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (v portsValue) Set(s string) error {
+	var ports []int
+	if len(strings.TrimSpace(s)) == 0 {
+		*v.p = ports
+		return nil
+	}
+	seen := make(map[int]bool)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		bounds := strings.SplitN(part, "-", 2)
+		first, err := strconv.Atoi(strings.TrimSpace(bounds[0]))
+		if err != nil {
+			return fmt.Errorf("Not a port or port range: %q", part)
+		}
+		last := first
+		if len(bounds) == 2 {
+			last, err = strconv.Atoi(strings.TrimSpace(bounds[1]))
+			if err != nil || last < first {
+				return fmt.Errorf("Not a port or port range: %q", part)
+			}
+		}
+		for port := first; port <= last; port++ {
+			if port < 1 || port > 65535 {
+				return fmt.Errorf("Port %d must be between 1 and 65535", port)
+			}
+			if seen[port] {
+				return fmt.Errorf("Port %d is listed twice", port)
+			}
+			seen[port] = true
+			ports = append(ports, port)
+		}
+	}
+	*v.p = ports
+	return nil
+}
+
+const redacted = "********"
+
+const configFileFlag = "config"
+const configFileEnv = "CONFIG_FILE"
+const printConfigFlag = "print-config"
+
+// fields returns the settings which can be configured, in the order they are printed
+func (s *Settings) fields() []setting {
+	return []setting{
+		{Key: "udpPorts", Env: "UDP_PORTS", Flag: "udp-ports", Usage: "ports and port ranges for UDP NAT tests", Value: portsValue{&s.UDPPorts}},
+		{Key: "tcpPorts", Env: "TCP_PORTS", Flag: "tcp-ports", Usage: "ports and port ranges for TCP NAT tests", Value: portsValue{&s.TCPPorts}},
+		{Key: "tlsPorts", Env: "TLS_PORTS", Flag: "tls-ports", Usage: "ports and port ranges for TCP NAT tests over TLS", Value: portsValue{&s.TLSPorts}},
+		{Key: "dtlsPorts", Env: "DTLS_PORTS", Flag: "dtls-ports", Usage: "ports and port ranges for UDP NAT tests over DTLS", Value: portsValue{&s.DTLSPorts}},
+		{Key: "coapPorts", Env: "COAP_PORTS", Flag: "coap-ports", Usage: "ports and port ranges for NAT tests over CoAP", Value: portsValue{&s.CoAPPorts}},
+		{Key: "mqttPorts", Env: "MQTT_PORTS", Flag: "mqtt-ports", Usage: "ports and port ranges for MQTT keep alive tests", Value: portsValue{&s.MQTTPorts}},
+		{Key: "httpPorts", Env: "HTTP_PORTS", Flag: "http-ports", Usage: "ports and port ranges for HTTP long-poll and WebSocket NAT tests", Value: portsValue{&s.HTTPPorts}},
+		{Key: "quicPorts", Env: "QUIC_PORTS", Flag: "quic-ports", Usage: "ports and port ranges for NAT tests and connection migration checks over QUIC", Value: portsValue{&s.QUICPorts}},
+		{Key: "atPort", Env: "AT_PORT", Flag: "at-port", Usage: "port for AT command messages", Value: intValue{&s.ATPort}},
+		{Key: "ipMode", Env: "IP_MODE", Flag: "ip-mode", Usage: "address families to listen on: system, ipv4, ipv6 or dual", Value: stringValue{&s.IPMode}},
+		{Key: "bufferSize", Env: "BUFFER_SIZE", Flag: "buffer-size", Usage: "maximum size of a message in bytes", Value: intValue{&s.BufferSize}},
+		{Key: "udpTimeout", Env: "UDP_TIMEOUT", Flag: "udp-timeout", Usage: "seconds to wait for the next UDP message before a probe times out", Value: intValue{&s.UDPTimeout}},
+		{Key: "uploadTimeout", Env: "UPLOAD_TIMEOUT", Flag: "upload-timeout", Usage: "seconds an upload of a log entry may take", Value: intValue{&s.UploadTimeout}},
+		{Key: "shutdownTimeout", Env: "SHUTDOWN_TIMEOUT", Flag: "shutdown-timeout", Usage: "seconds to wait for log entries to be saved when shutting down", Value: intValue{&s.ShutdownTimeout}},
+		{Key: "natSchemaFile", Env: "NAT_SCHEMA_FILE", Flag: "nat-schema-file", Usage: "JSON schema of NAT test messages", Required: true, Value: stringValue{&s.NATSchemaFile}},
+		{Key: "atSchemaFile", Env: "AT_SCHEMA_FILE", Flag: "at-schema-file", Usage: "JSON schema of AT command messages", Required: true, Value: stringValue{&s.ATSchemaFile}},
+		{Key: "maxInterval", Env: "MAX_INTERVAL", Flag: "max-interval", Usage: "largest interval in seconds a client may request", Value: intValue{&s.MaxInterval}},
+		{Key: "maxPendingPerAddress", Env: "MAX_PENDING_PER_ADDRESS", Flag: "max-pending-per-address", Usage: "probes a single IP address may have waiting for their response, on any port", Value: intValue{&s.MaxPendingPerAddress}},
+		{Key: "maxHandlers", Env: "MAX_HANDLERS", Flag: "max-handlers", Usage: "connections and UDP probes handled at the same time", Value: intValue{&s.MaxHandlers}},
+		{Key: "maxLogBacklog", Env: "MAX_LOG_BACKLOG", Flag: "max-log-backlog", Usage: "unsaved log entries from which on the server reports it is not ready", Value: intValue{&s.MaxLogBacklog}},
+		{Key: "mqttKeepAlivePercent", Env: "MQTT_KEEP_ALIVE_PERCENT", Flag: "mqtt-keep-alive-percent", Usage: "percent of their keep alive interval MQTT clients may stay silent, above 150 stretches it", Value: intValue{&s.MQTTKeepAlivePercent}},
+		{Key: "searchIdleTimeout", Env: "SEARCH_IDLE_TIMEOUT", Flag: "search-idle-timeout", Usage: "seconds without a probe after which the summary of a device's search is saved", Value: intValue{&s.SearchIdleTimeout}},
+		{Key: "monitoringAddr", Env: "MONITORING_ADDR", Flag: "monitoring-addr", Usage: "address like :9090 to serve the Prometheus metrics and health checks on, they are not served if empty", Value: stringValue{&s.MonitoringAddr}},
+		{Key: "adminToken", Env: "ADMIN_TOKEN", Flag: "admin-token", Usage: "bearer token of the admin API on monitoringAddr, the API is not served if empty", Secret: true, Value: stringValue{&s.AdminToken}},
+		{Key: "logFormat", Env: "LOG_FORMAT", Flag: "log-format", Usage: "format of the operational logs: text (logfmt) or json", Value: stringValue{&s.LogFormat}},
+		{Key: "logLevel", Env: "LOG_LEVEL", Flag: "log-level", Usage: "lowest level of the operational logs: debug, info, warn or error, per-packet lines are debug", Value: stringValue{&s.LogLevel}},
+		{Key: "awsBucket", Env: "AWS_BUCKET", Flag: "aws-bucket", Usage: "S3 bucket the log entries are uploaded to", Required: true, Value: stringValue{&s.AWSBucket}},
+		{Key: "awsRegion", Env: "AWS_REGION", Flag: "aws-region", Usage: "AWS region of the bucket", Required: true, Value: stringValue{&s.AWSRegion}},
+		{Key: "awsAccessKeyId", Env: "AWS_ACCESS_KEY_ID", Flag: "aws-access-key-id", Usage: "AWS access key ID", Required: true, Value: stringValue{&s.AWSAccessKeyID}},
+		{Key: "awsSecretAccessKey", Env: "AWS_SECRET_ACCESS_KEY", Flag: "aws-secret-access-key", Usage: "AWS secret access key", Required: true, Secret: true, Value: stringValue{&s.AWSSecretAccessKey}},
+		{Key: "logPrefix", Env: "LOG_PREFIX", Flag: "log-prefix", Usage: "prefix of the keys of the log entries in the bucket", Value: stringValue{&s.LogPrefix}},
+		{Key: "sessionStateFile", Env: "SESSION_STATE_FILE", Flag: "session-state-file", Usage: "local file to keep pending UDP sessions in across restarts", Value: stringValue{&s.SessionStateFile}},
+		{Key: "sessionStateKey", Env: "SESSION_STATE_KEY", Flag: "session-state-key", Usage: "key of an S3 object in the bucket to keep pending UDP sessions in across restarts", Value: stringValue{&s.SessionStateKey}},
+		{Key: "tlsCertFile", Env: "TLS_CERT_FILE", Flag: "tls-cert-file", Usage: "PEM certificate chain of the TLS listeners", Value: stringValue{&s.TLSCertFile}},
+		{Key: "tlsKeyFile", Env: "TLS_KEY_FILE", Flag: "tls-key-file", Usage: "PEM private key of the TLS certificate", Value: stringValue{&s.TLSKeyFile}},
+		{Key: "tlsClientCAFile", Env: "TLS_CLIENT_CA_FILE", Flag: "tls-client-ca-file", Usage: "PEM certificate authorities clients must authenticate with, enables mutual TLS", Value: stringValue{&s.TLSClientCAFile}},
+		{Key: "dtlsPskIdentity", Env: "DTLS_PSK_IDENTITY", Flag: "dtls-psk-identity", Usage: "identity DTLS clients must use, any identity is accepted if empty", Value: stringValue{&s.DTLSPSKIdentity}},
+		{Key: "dtlsPsk", Env: "DTLS_PSK", Flag: "dtls-psk", Usage: "hex encoded pre-shared key of the DTLS listeners", Secret: true, Value: stringValue{&s.DTLSPSK}},
+		{Key: "dtlsConnectionId", Env: "DTLS_CONNECTION_ID", Flag: "dtls-connection-id", Usage: "ask DTLS clients to send a connection ID, so sessions survive a change of address", Value: boolValue{&s.DTLSConnectionID}},
+	}
+}
+
+// defaultSettings returns the settings used for everything which is not configured
+func defaultSettings() Settings {
+	return Settings{
+		UDPPorts:             []int{defaultUDPPort},
+		TCPPorts:             []int{defaultTCPPort},
+		ATPort:               defaultATPort,
+		IPMode:               ipModeSystem,
+		BufferSize:           maxBufferSize,
+		UDPTimeout:           newUDPMessageTimeoutInSeconds,
+		UploadTimeout:        uploadTimeoutInSeconds,
+		ShutdownTimeout:      defaultShutdownTimeoutInSeconds,
+		NATSchemaFile:        natSchemaFile,
+		ATSchemaFile:         atSchemaFile,
+		MaxInterval:          defaultMaxInterval,
+		MaxPendingPerAddress: defaultMaxPendingPerAddress,
+		MaxHandlers:          defaultMaxHandlers,
+		MaxLogBacklog:        defaultMaxLogBacklog,
+		MQTTKeepAlivePercent: defaultMQTTKeepAlivePercent,
+		SearchIdleTimeout:    defaultSearchIdleTimeoutInSeconds,
+		LogFormat:            logFormatText,
+		LogLevel:             defaultLogLevel,
+		DTLSConnectionID:     true,
+	}
+}
+
+// loadSettings reads the settings from the configuration file, the environment and the command-line args.
+// Values from the environment override the file, flags override both.
+// printConfig is true if the effective settings should be printed instead of starting the server.
+func loadSettings(args []string, getenv func(string) string) (settings Settings, printConfig bool, err error) {
+	settings = defaultSettings()
+	fields := settings.fields()
+
+	flags := flag.NewFlagSet("nat-testserver", flag.ContinueOnError)
+	configFile := flags.String(configFileFlag, getenv(configFileEnv), fmt.Sprintf("YAML configuration file (%s)", configFileEnv))
+	flags.BoolVar(&printConfig, printConfigFlag, false, "print the effective configuration with secrets redacted and exit")
+	values := make(map[string]*string)
+	for _, f := range fields {
+		values[f.Flag] = flags.String(f.Flag, "", fmt.Sprintf("%s (%s, default %q)", f.Usage, f.Env, f.Value.String()))
+	}
+	err = flags.Parse(args)
+	if err != nil {
+		return settings, false, err
+	}
+
+	if len(*configFile) > 0 {
+		err = settings.loadFile(*configFile)
+		if err != nil {
+			return settings, false, err
+		}
+	}
+
+	for _, f := range fields {
+		if value := getenv(f.Env); len(value) > 0 {
+			err = f.Value.Set(value)
+			if err != nil {
+				return settings, false, fmt.Errorf("Invalid value %q for %s: %s", value, f.Env, err)
+			}
+		}
+	}
+
+	flags.Visit(func(fl *flag.Flag) {
+		for _, f := range fields {
+			if fl.Name == f.Flag && err == nil {
+				err = f.Value.Set(*values[f.Flag])
+				if err != nil {
+					err = fmt.Errorf("Invalid value %q for --%s: %s", *values[f.Flag], f.Flag, err)
+				}
+			}
+		}
+	})
+	return settings, printConfig, err
+}
+
+// loadFile sets the values found in the YAML configuration file at path
+func (s *Settings) loadFile(path string) error {
+	buffer, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var values map[string]interface{}
+	err = yaml.Unmarshal(buffer, &values)
+	if err != nil {
+		return fmt.Errorf("Invalid configuration file %s: %s", path, err)
+	}
+
+	fields := s.fields()
+	for key, value := range values {
+		found := false
+		for _, f := range fields {
+			if f.Key == key {
+				found = true
+				err = f.Value.Set(yamlText(value))
+				if err != nil {
+					return fmt.Errorf("Invalid value %q for %s in %s: %s", yamlText(value), key, path, err)
+				}
+			}
+		}
+		if !found {
+			return fmt.Errorf("Unknown setting %s in %s", key, path)
+		}
+	}
+	return nil
+}
+
+// yamlText returns a value from the configuration file as text, lists are separated by commas
+func yamlText(value interface{}) string {
+	if list, ok := value.([]interface{}); ok {
+		parts := make([]string, 0, len(list))
+		for _, item := range list {
+			parts = append(parts, fmt.Sprint(item))
+		}
+		return strings.Join(parts, ", ")
+	}
+	return fmt.Sprint(value)
+}
+
+// validate returns an error describing the first invalid setting
+func (s Settings) validate() error {
+	if s.ATPort < 1 || s.ATPort > 65535 {
+		return fmt.Errorf("atPort must be between 1 and 65535, got %d", s.ATPort)
+	}
+	if _, err := listenAddrs("udp", s.IPMode); err != nil {
+		return err
+	}
+	if len(s.UDPPorts) == 0 || len(s.TCPPorts) == 0 {
+		return errors.New("At least one UDP and one TCP port must be configured")
+	}
+	for _, port := range s.TCPPorts {
+		if port == s.ATPort {
+			return fmt.Errorf("Port %d is configured for both TCP NAT tests and AT commands", port)
+		}
+	}
+	for _, port := range s.TLSPorts {
+		if port == s.ATPort || containsPort(s.TCPPorts, port) {
+			return fmt.Errorf("Port %d is configured for TLS NAT tests and another listener", port)
+		}
+	}
+	if len(s.TLSPorts) > 0 && (len(s.TLSCertFile) == 0 || len(s.TLSKeyFile) == 0) {
+		return errors.New("tlsCertFile and tlsKeyFile must be set to listen on tlsPorts")
+	}
+	for _, port := range s.DTLSPorts {
+		if containsPort(s.UDPPorts, port) {
+			return fmt.Errorf("Port %d is configured for both UDP and DTLS NAT tests", port)
+		}
+	}
+	for _, port := range s.MQTTPorts {
+		if port == s.ATPort || containsPort(s.TCPPorts, port) || containsPort(s.TLSPorts, port) {
+			return fmt.Errorf("Port %d is configured for MQTT tests and another listener", port)
+		}
+	}
+	for _, port := range s.HTTPPorts {
+		if port == s.ATPort || containsPort(s.TCPPorts, port) || containsPort(s.TLSPorts, port) || containsPort(s.MQTTPorts, port) {
+			return fmt.Errorf("Port %d is configured for HTTP NAT tests and another listener", port)
+		}
+	}
+	for _, port := range s.CoAPPorts {
+		if containsPort(s.UDPPorts, port) || containsPort(s.DTLSPorts, port) {
+			return fmt.Errorf("Port %d is configured for CoAP NAT tests and another UDP listener", port)
+		}
+	}
+	for _, port := range s.QUICPorts {
+		if containsPort(s.UDPPorts, port) || containsPort(s.DTLSPorts, port) || containsPort(s.CoAPPorts, port) {
+			return fmt.Errorf("Port %d is configured for QUIC NAT tests and another UDP listener", port)
+		}
+	}
+	if _, err := hex.DecodeString(s.DTLSPSK); err != nil {
+		return errors.New("dtlsPsk must be hex encoded")
+	}
+	if len(s.DTLSPorts) > 0 && len(s.DTLSPSK) == 0 {
+		return errors.New("dtlsPsk must be set to listen on dtlsPorts")
+	}
+	for _, f := range s.fields() {
+		if v, ok := f.Value.(intValue); ok && *v.p < 1 {
+			return fmt.Errorf("%s must be a positive integer, got %d", f.Key, *v.p)
+		} else if f.Required && len(f.Value.String()) == 0 {
+			return fmt.Errorf("%s not defined, set %s or --%s", f.Key, f.Env, f.Flag)
+		}
+	}
+	if len(s.SessionStateFile) > 0 && len(s.SessionStateKey) > 0 {
+		return errors.New("Only one of sessionStateFile and sessionStateKey may be set")
+	}
+	if len(s.AdminToken) > 0 && len(s.MonitoringAddr) == 0 {
+		return errors.New("monitoringAddr must be set to serve the admin API")
+	}
+	if _, err := newLogger(io.Discard, s.LogFormat, s.LogLevel); err != nil {
+		return err
+	}
+	return nil
+}
+
+// print writes the settings to w in the format of the configuration file, with secrets redacted
+func (s Settings) print(w io.Writer) {
+	for _, f := range s.fields() {
+		value := f.Value.String()
+		if f.Secret && len(value) > 0 {
+			value = redacted
+		}
+		if _, ok := f.Value.(stringValue); ok {
+			value = strconv.Quote(value)
+		} else if _, ok := f.Value.(portsValue); ok && len(value) == 0 {
+			value = "[]"
+		}
+		fmt.Fprintf(w, "%s: %s\n", f.Key, value)
+	}
+}
+
+// serverConfig returns the configuration of the server for these settings, without a sink
+func (s Settings) serverConfig() Config {
+	config := defaultConfig()
+	config.UDPPorts = s.UDPPorts
+	config.TCPPorts = s.TCPPorts
+	config.TLSPorts = s.TLSPorts
+	config.DTLSPorts = s.DTLSPorts
+	config.CoAPPorts = s.CoAPPorts
+	config.MQTTPorts = s.MQTTPorts
+	config.HTTPPorts = s.HTTPPorts
+	config.QUICPorts = s.QUICPorts
+	config.ATPort = s.ATPort
+	config.IPMode = s.IPMode
+	config.BufferSize = s.BufferSize
+	config.UDPTimeout = time.Duration(s.UDPTimeout) * time.Second
+	config.UploadTimeout = time.Duration(s.UploadTimeout) * time.Second
+	config.NATSchemaFile = s.NATSchemaFile
+	config.ATSchemaFile = s.ATSchemaFile
+	config.MaxInterval = s.MaxInterval
+	config.MaxPendingPerAddress = s.MaxPendingPerAddress
+	config.MaxHandlers = s.MaxHandlers
+	config.MaxLogBacklog = s.MaxLogBacklog
+	config.MQTTKeepAlivePercent = s.MQTTKeepAlivePercent
+	config.SearchIdleTimeout = time.Duration(s.SearchIdleTimeout) * time.Second
+	config.MonitoringAddr = s.MonitoringAddr
+	config.AdminToken = s.AdminToken
+	return config
+}
+
+// tlsConfig returns the configuration of the TLS listeners, or nil if there are none
+func (s Settings) tlsConfig() (*tls.Config, error) {
+	if len(s.TLSPorts) == 0 {
+		return nil, nil
+	}
+	return newTLSConfig(s.TLSCertFile, s.TLSKeyFile, s.TLSClientCAFile)
+}
+
+// quicTLSConfig returns the certificate of the QUIC listeners, which is the TLS certificate if there is one.
+// Without it the server generates a self-signed certificate.
+func (s Settings) quicTLSConfig() (*tls.Config, error) {
+	if len(s.QUICPorts) == 0 || len(s.TLSCertFile) == 0 || len(s.TLSKeyFile) == 0 {
+		return nil, nil
+	}
+	return newTLSConfig(s.TLSCertFile, s.TLSKeyFile, "")
+}
+
+// dtlsConfig returns the configuration of the DTLS listeners, or nil if there are none
+func (s Settings) dtlsConfig() (*dtls.Config, error) {
+	if len(s.DTLSPorts) == 0 {
+		return nil, nil
+	}
+	key, err := hex.DecodeString(s.DTLSPSK)
+	if err != nil {
+		return nil, err
+	}
+	return newDTLSConfig(s.DTLSPSKIdentity, key, s.DTLSConnectionID), nil
+}
+
+// containsPort returns whether port is one of ports
+func containsPort(ports []int, port int) bool {
+	for _, p := range ports {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
+
+// s3Client returns a client for the configured AWS account
+func (s Settings) s3Client() (*s3.S3, error) {
+	sess, err := session.NewSession(&aws.Config{
+		Region:      aws.String(s.AWSRegion),
+		Credentials: credentials.NewStaticCredentials(s.AWSAccessKeyID, s.AWSSecretAccessKey, ""),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s3.New(sess), nil
+}
+
+// sessionStore returns the configured store for pending sessions, or nil if they are not kept
+func (s Settings) sessionStore(svc *s3.S3) SessionStore {
+	if len(s.SessionStateFile) > 0 {
+		return fileSessionStore{Path: s.SessionStateFile}
+	} else if len(s.SessionStateKey) > 0 {
+		return s3SessionStore{svc: svc, Bucket: s.AWSBucket, Key: s.SessionStateKey}
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testEnv returns a getenv function which looks up env instead of the process environment
+func testEnv(env map[string]string) func(string) string {
+	return func(name string) string {
+		return env[name]
+	}
+}
+
+func TestLoadSettings(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "config")
+	assert.NoError(err, "A temporary directory should be created")
+	defer os.RemoveAll(dir)
+
+	configFile := filepath.Join(dir, "config.yaml")
+	assert.NoError(ioutil.WriteFile(configFile, []byte("udpPorts: [4000, 5683, 40000-40002]\ntcpPorts: 4001\natPort: 4002\nlogPrefix: file\n"), 0600), "The configuration file should be written")
+
+	env := map[string]string{"CONFIG_FILE": configFile, "TCP_PORTS": "5001", "AT_PORT": "5002"}
+	settings, printConfig, err := loadSettings([]string{"--at-port", "6002"}, testEnv(env))
+	assert.NoError(err, "The settings should be loaded")
+	assert.False(printConfig, "The configuration should not be printed")
+	assert.Equal([]int{4000, 5683, 40000, 40001, 40002}, settings.UDPPorts, "The configuration file should override the default")
+	assert.Equal([]int{5001}, settings.TCPPorts, "The environment should override the configuration file")
+	assert.Equal(6002, settings.ATPort, "Flags should override the environment")
+	assert.Equal("file", settings.LogPrefix, "Strings should be read from the configuration file")
+	assert.Equal(defaultMaxInterval, settings.MaxInterval, "Settings which are not configured should keep their default")
+
+	settings, _, err = loadSettings([]string{"--dtls-connection-id=false"}, testEnv(nil))
+	assert.NoError(err, "The settings should be loaded")
+	assert.False(settings.DTLSConnectionID, "Booleans should be read from flags")
+
+	_, _, err = loadSettings([]string{"--at-port", "at"}, testEnv(nil))
+	assert.Error(err, "Invalid flag values should be rejected")
+
+	assert.NoError(ioutil.WriteFile(configFile, []byte("udpPort: 4000\n"), 0600), "The configuration file should be written")
+	_, _, err = loadSettings(nil, testEnv(env))
+	assert.Error(err, "Unknown settings in the configuration file should be rejected")
+}
+
+func TestValidateSettings(t *testing.T) {
+	assert := assert.New(t)
+	env := map[string]string{"AWS_BUCKET": "bucket", "AWS_REGION": "eu-central-1", "AWS_ACCESS_KEY_ID": "id", "AWS_SECRET_ACCESS_KEY": "secret"}
+
+	settings, _, err := loadSettings(nil, testEnv(env))
+	assert.NoError(err, "The settings should be loaded")
+	assert.NoError(settings.validate(), "The default settings should be valid")
+
+	settings.ATPort = 70000
+	assert.Error(settings.validate(), "Ports above 65535 should be rejected")
+
+	settings.ATPort = defaultTCPPort
+	assert.Error(settings.validate(), "The AT port should not be used for TCP NAT tests")
+
+	settings, _, err = loadSettings([]string{"--tls-ports", "3052"}, testEnv(env))
+	assert.NoError(err, "The settings should be loaded")
+	assert.Error(settings.validate(), "TLS listeners need a certificate")
+	settings.TLSCertFile = "cert.pem"
+	settings.TLSKeyFile = "key.pem"
+	assert.NoError(settings.validate(), "TLS listeners with a certificate should be valid")
+	settings.TLSPorts = []int{defaultTCPPort}
+	assert.Error(settings.validate(), "The TLS ports should not be used for TCP NAT tests")
+
+	settings, _, err = loadSettings([]string{"--dtls-ports", "3053"}, testEnv(env))
+	assert.NoError(err, "The settings should be loaded")
+	assert.Error(settings.validate(), "DTLS listeners need a pre-shared key")
+	settings.DTLSPSK = "not hex"
+	assert.Error(settings.validate(), "The pre-shared key must be hex encoded")
+	settings.DTLSPSK = "0123456789abcdef"
+	assert.NoError(settings.validate(), "DTLS listeners with a pre-shared key should be valid")
+	settings.DTLSPorts = []int{defaultUDPPort}
+	assert.Error(settings.validate(), "The DTLS ports should not be used for UDP NAT tests")
+
+	settings, _, err = loadSettings([]string{"--coap-ports", "5683"}, testEnv(env))
+	assert.NoError(err, "The settings should be loaded")
+	assert.NoError(settings.validate(), "CoAP listeners should be valid")
+	settings.CoAPPorts = []int{defaultUDPPort}
+	assert.Error(settings.validate(), "The CoAP ports should not be used for UDP NAT tests")
+
+	settings, _, err = loadSettings([]string{"--quic-ports", "443"}, testEnv(env))
+	assert.NoError(err, "The settings should be loaded")
+	assert.NoError(settings.validate(), "QUIC listeners should be valid")
+	settings.QUICPorts = []int{defaultUDPPort}
+	assert.Error(settings.validate(), "The QUIC ports should not be used for UDP NAT tests")
+
+	settings, _, err = loadSettings([]string{"--mqtt-ports", "1883"}, testEnv(env))
+	assert.NoError(err, "The settings should be loaded")
+	assert.NoError(settings.validate(), "MQTT listeners should be valid")
+	settings.MQTTPorts = []int{defaultTCPPort}
+	assert.Error(settings.validate(), "The MQTT ports should not be used for TCP NAT tests")
+
+	settings, _, err = loadSettings([]string{"--http-ports", "8080"}, testEnv(env))
+	assert.NoError(err, "The settings should be loaded")
+	assert.NoError(settings.validate(), "HTTP listeners should be valid")
+	settings.MQTTPorts = []int{8080}
+	assert.Error(settings.validate(), "The HTTP ports should not be used for MQTT tests")
+
+	settings, _, err = loadSettings([]string{"--ip-mode", "ipv5"}, testEnv(env))
+	assert.NoError(err, "The settings should be loaded")
+	assert.Error(settings.validate(), "Unknown listener modes should be rejected")
+
+	settings, _, err = loadSettings([]string{"--admin-token", "token"}, testEnv(env))
+	assert.NoError(err, "The settings should be loaded")
+	assert.Error(settings.validate(), "The admin API needs a monitoring address")
+	settings.MonitoringAddr = ":9090"
+	assert.NoError(settings.validate(), "The admin API with a monitoring address should be valid")
+
+	settings, _, err = loadSettings([]string{"--log-format", "json", "--log-level", "debug"}, testEnv(env))
+	assert.NoError(err, "The settings should be loaded")
+	assert.NoError(settings.validate(), "JSON logs at debug level should be valid")
+	settings.LogLevel = "verbose"
+	assert.Error(settings.validate(), "Unknown log levels should be rejected")
+	settings.LogLevel = defaultLogLevel
+	settings.LogFormat = "xml"
+	assert.Error(settings.validate(), "Unknown log formats should be rejected")
+
+	settings, _, err = loadSettings([]string{"--max-handlers", "0"}, testEnv(env))
+	assert.NoError(err, "The settings should be loaded")
+	assert.Error(settings.validate(), "Limits must be positive")
+
+	settings, _, err = loadSettings(nil, testEnv(nil))
+	assert.NoError(err, "The settings should be loaded")
+	assert.Error(settings.validate(), "The AWS settings are required")
+}
+
+func TestPrintConfig(t *testing.T) {
+	assert := assert.New(t)
+	env := map[string]string{"AWS_ACCESS_KEY_ID": "id", "AWS_SECRET_ACCESS_KEY": "very-secret"}
+
+	settings, printConfig, err := loadSettings([]string{"--print-config"}, testEnv(env))
+	assert.NoError(err, "The settings should be loaded")
+	assert.True(printConfig, "The configuration should be printed")
+
+	var out bytes.Buffer
+	settings.print(&out)
+	assert.Contains(out.String(), "udpPorts: 3050\n", "The effective values should be printed")
+	assert.Contains(out.String(), "tlsPorts: []\n", "Empty port lists should be printed as YAML lists")
+	assert.Contains(out.String(), "awsAccessKeyId: \"id\"\n", "Values which are not secret should be printed")
+	assert.Contains(out.String(), "awsSecretAccessKey: \""+redacted+"\"\n", "Secrets should be redacted")
+	assert.NotContains(out.String(), "very-secret", "Secrets should not be printed")
+}
+
+func TestPortsValue(t *testing.T) {
+	assert := assert.New(t)
+	var ports []int
+	v := portsValue{&ports}
+
+	assert.NoError(v.Set("3050, 5683,40000-40003"), "Ports and ranges should be parsed")
+	assert.Equal([]int{3050, 5683, 40000, 40001, 40002, 40003}, ports, "Ranges should include both ends")
+	assert.Equal("3050, 5683, 40000-40003", v.String(), "Consecutive ports should be printed as a range")
+
+	assert.Error(v.Set("3050-3049"), "Reversed ranges should be rejected")
+	assert.Error(v.Set("70000"), "Ports above 65535 should be rejected")
+	assert.Error(v.Set("3050, 3050"), "Duplicate ports should be rejected")
+	assert.Error(v.Set("udp"), "Text should be rejected")
+
+	assert.NoError(v.Set(""), "An empty list should be accepted")
+	assert.Empty(ports, "An empty list should remove all ports")
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pion/dtls/v3"
+)
+
+// dtlsConnectionIDLength is the length of the connection IDs clients are asked to send
+const dtlsConnectionIDLength = 8
+
+// dtlsCipherSuites are the PSK cipher suites the server accepts, CCM_8 is the one CoAP and LwM2M devices must support
+var dtlsCipherSuites = []dtls.CipherSuiteID{
+	dtls.TLS_PSK_WITH_AES_128_CCM_8,
+	dtls.TLS_PSK_WITH_AES_128_CCM,
+	dtls.TLS_PSK_WITH_AES_128_GCM_SHA256,
+	dtls.TLS_PSK_WITH_AES_128_CBC_SHA256,
+}
+
+// DTLSInfo describes the DTLS session a NAT test message was received in
+type DTLSInfo struct {
+	// HandshakeDuration is the time the handshake took in nanoseconds
+	HandshakeDuration time.Duration
+	CipherSuite       string
+	PSKIdentity       string
+	// Rebound is true if the follow-up message arrived in the same session, but from a different address
+	Rebound bool `json:",omitempty"`
+	// SessionLost is true if the device started a new session instead of following up in this one
+	SessionLost bool `json:",omitempty"`
+}
+
+// dtlsSession is a DTLS session of a device, lost is closed once the device starts a new session
+type dtlsSession struct {
+	lost chan struct{}
+}
+
+// dtlsSessionMap stores the current DTLS session of each device by IMEI
+type dtlsSessionMap struct {
+	Map map[string]*dtlsSession
+	Mux sync.Mutex
+}
+
+// connRead is the result of reading a message from a DTLS session or QUIC stream
+type connRead struct {
+	buffer []byte
+	err    error
+}
+
+// newDTLSConfig returns the configuration of DTLS listeners which accept key for identity, or for any identity if it is empty
+func newDTLSConfig(identity string, key []byte, connectionID bool) *dtls.Config {
+	config := &dtls.Config{
+		PSK: func(hint []byte) ([]byte, error) {
+			if len(identity) > 0 && string(hint) != identity {
+				return nil, fmt.Errorf("Unknown PSK identity %q", hint)
+			}
+			return key, nil
+		},
+		CipherSuites: dtlsCipherSuites,
+	}
+	if connectionID {
+		config.ConnectionIDGenerator = dtls.RandomCIDGenerator(dtlsConnectionIDLength)
+	}
+	return config
+}
+
+// dtlsHandshake completes the DTLS handshake of conn and returns the negotiated session parameters
+func (s *Server) dtlsHandshake(conn *dtls.Conn) (*DTLSInfo, error) {
+	start := s.config.Clock.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), handshakeTimeout)
+	defer cancel()
+	err := conn.HandshakeContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	state, ok := conn.ConnectionState()
+	if !ok {
+		return nil, errors.New("DTLS session state is not available")
+	}
+	return &DTLSInfo{
+		HandshakeDuration: s.config.Clock.Now().Sub(start),
+		CipherSuite:       dtls.CipherSuiteName(state.CipherSuiteID),
+		PSKIdentity:       string(state.IdentityHint),
+	}, nil
+}
+
+// claimDTLSSession makes session the current session of the device with imei, its previous session is lost
+func (s *Server) claimDTLSSession(imei string, session *dtlsSession) {
+	s.dtlsSessions.Mux.Lock()
+	defer s.dtlsSessions.Mux.Unlock()
+	if previous, ok := s.dtlsSessions.Map[imei]; ok && previous != session {
+		close(previous.lost)
+	}
+	s.dtlsSessions.Map[imei] = session
+}
+
+// releaseDTLSSession forgets session if it is still the current session of the device with imei
+func (s *Server) releaseDTLSSession(imei string, session *dtlsSession) {
+	s.dtlsSessions.Mux.Lock()
+	defer s.dtlsSessions.Mux.Unlock()
+	if s.dtlsSessions.Map[imei] == session {
+		delete(s.dtlsSessions.Map, imei)
+	}
+}
+
+// readMessages hands the messages read from conn to reads until reading fails or done is closed
+func readMessages(conn net.Conn, bufferSize int, reads chan<- connRead, done <-chan struct{}) {
+	for {
+		buffer := make([]byte, bufferSize)
+		n, err := conn.Read(buffer)
+		select {
+		case reads <- connRead{buffer: bytes.TrimSuffix(buffer[:n], []byte("\n")), err: err}:
+		case <-done:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// handleDTLS runs the UDP NAT test inside a DTLS session.
+// Like for UDP, a probe times out if the device does not follow up within the UDP timeout or with a lower interval.
+// If the device starts a new session instead, the NAT has rebound it and the session was lost.
+func (s *Server) handleDTLS(conn net.Conn) {
+	defer conn.Close()
+	dtlsConn, ok := conn.(*dtls.Conn)
+	if !ok {
+		return
+	}
+	info, err := s.dtlsHandshake(dtlsConn)
+	if err != nil {
+		connLogger("DTLS", conn.RemoteAddr()).Warn("DTLS handshake failed", "error", err)
+		return
+	}
+	connLogger("DTLS", conn.RemoteAddr()).Debug("DTLS handshake completed", "duration", info.HandshakeDuration, "cipher", info.CipherSuite, "pskIdentity", info.PSKIdentity)
+
+	reads := make(chan connRead)
+	done := make(chan struct{})
+	defer close(done)
+	go readMessages(conn, s.config.BufferSize, reads, done)
+
+	session := &dtlsSession{lost: make(chan struct{})}
+	var imei string
+	defer func() {
+		s.releaseDTLSSession(imei, session)
+	}()
+
+	var logEntry NATLogEntry
+	var followUp Timer
+	var timeout <-chan time.Time
+	for {
+		var r connRead
+		select {
+		case r = <-reads:
+		case <-timeout:
+			entryLogger(logEntry).Info("No DTLS message within the UDP timeout", "timeout", s.config.UDPTimeout)
+			logEntry.Timeout = true
+			s.writeLog <- logEntry
+			return
+		case <-session.lost:
+			entryLogger(logEntry).Info("DTLS session was replaced by a new session")
+			logEntry.Timeout = true
+			logEntry.DTLS.SessionLost = true
+			s.writeLog <- logEntry
+			return
+		}
+		if followUp != nil {
+			followUp.Stop()
+		}
+
+		if r.err != nil {
+			if logEntry.Protocol != "" && s.connectionInterrupted(conn) {
+				entryLogger(logEntry).Info("Waiting for DTLS message interrupted")
+				logEntry.Interrupted = true
+				s.writeLog <- logEntry
+			} else if logEntry.Protocol != "" {
+				entryLogger(logEntry).Info("Error reading DTLS session", "error", r.err)
+				logEntry.Timeout = true
+				s.writeLog <- logEntry
+			} else {
+				connLogger("DTLS", conn.RemoteAddr()).Warn("Error reading DTLS session", "error", r.err)
+			}
+			return
+		}
+		if logEntry.Protocol != "" {
+			// With a connection ID the session continues from the new address the NAT assigned
+			logEntry.DTLS.Rebound = conn.RemoteAddr().String() != logEntry.IP
+			var next deviceMessage
+			if json.Unmarshal(r.buffer, &next) == nil && next.Interval <= logEntry.Message.Interval {
+				// The device did not receive our response and now starts with the binary search
+				logEntry.Timeout = true
+			}
+			// Store log from previous interval
+			s.writeLog <- logEntry
+		}
+
+		var retBuffer []byte
+		retBuffer, logEntry, err = s.HandleData(r.buffer, "DTLS", conn.RemoteAddr(), conn.LocalAddr())
+		if err == errInterrupted {
+			entryLogger(logEntry).Info("DTLS response interrupted")
+			s.writeLog <- logEntry
+			return
+		} else if err != nil {
+			connLogger("DTLS", conn.RemoteAddr()).Warn("DTLS session terminated", "error", err)
+			conn.Write(s.errorMessage(err))
+			return
+		}
+		sessionInfo := *info
+		logEntry.DTLS = &sessionInfo
+		if imei != logEntry.Message.IMEI {
+			s.releaseDTLSSession(imei, session)
+			imei = logEntry.Message.IMEI
+			s.claimDTLSSession(imei, session)
+		}
+
+		_, err = conn.Write(retBuffer)
+		if err != nil {
+			entryLogger(logEntry).Warn("DTLS write failed, session terminated", "error", err)
+			logEntry.Timeout = true
+			s.writeLog <- logEntry
+			return
+		}
+		entryLogger(logEntry).Debug("DTLS packet sent")
+		followUp = s.config.Clock.NewTimer(s.config.UDPTimeout)
+		timeout = followUp.C()
+	}
+}
+
+func (s *Server) acceptDTLS(l net.Listener) {
+	s.acceptConnections(l, "DTLS", s.handleDTLS)
+}
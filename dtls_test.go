@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/dtls/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+const testPSKIdentity = "nat-test"
+
+var testPSK = []byte{0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef}
+
+// rebindingConn is a client socket which can move to a new local port like a NAT assigning a new binding
+type rebindingConn struct {
+	net.PacketConn
+	Mux sync.Mutex
+}
+
+func newRebindingConn(t *testing.T) *rebindingConn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	return &rebindingConn{PacketConn: conn}
+}
+
+func (c *rebindingConn) current() net.PacketConn {
+	c.Mux.Lock()
+	defer c.Mux.Unlock()
+	return c.PacketConn
+}
+
+// rebind moves the socket to a new port, messages sent to the old port are lost
+func (c *rebindingConn) rebind(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	c.Mux.Lock()
+	previous := c.PacketConn
+	c.PacketConn = conn
+	c.Mux.Unlock()
+	previous.Close()
+}
+
+func (c *rebindingConn) ReadFrom(buffer []byte) (int, net.Addr, error) {
+	for {
+		conn := c.current()
+		n, addr, err := conn.ReadFrom(buffer)
+		if err != nil && conn != c.current() {
+			// The socket was closed by rebind, continue on the new one
+			continue
+		}
+		return n, addr, err
+	}
+}
+
+func (c *rebindingConn) WriteTo(buffer []byte, addr net.Addr) (int, error) {
+	return c.current().WriteTo(buffer, addr)
+}
+
+func (c *rebindingConn) LocalAddr() net.Addr {
+	return c.current().LocalAddr()
+}
+
+func (c *rebindingConn) Close() error {
+	return c.current().Close()
+}
+
+// dtlsListener adds a DTLS listener with the test pre-shared key on a random port
+func dtlsListener(config *Config) {
+	config.DTLSPorts = []int{0}
+	config.DTLSConfig = newDTLSConfig(testPSKIdentity, testPSK, true)
+}
+
+// dialDTLS starts a DTLS session with the server over conn, the client sends a connection ID if connectionID is true
+func dialDTLS(t *testing.T, server *Server, conn net.PacketConn, connectionID bool) *dtls.Conn {
+	config := &dtls.Config{
+		PSK: func([]byte) ([]byte, error) {
+			return testPSK, nil
+		},
+		PSKIdentityHint: []byte(testPSKIdentity),
+		CipherSuites:    []dtls.CipherSuiteID{dtls.TLS_PSK_WITH_AES_128_CCM_8},
+	}
+	if connectionID {
+		config.ConnectionIDGenerator = dtls.OnlySendCIDGenerator()
+	}
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: localPort(server.DTLSAddr())}
+	client, err := dtls.Client(conn, addr, config)
+	if err != nil {
+		t.Fatalf("Failed to create DTLS client: %s", err)
+	}
+	return client
+}
+
+func TestDTLSConnectionID(t *testing.T) {
+	assert := assert.New(t)
+	sink := &memorySink{}
+	server, clock := newFakeClockServer(t, sink, dtlsListener)
+
+	conn := newRebindingConn(t)
+	client := dialDTLS(t, server, conn, true)
+	defer client.Close()
+	first := conn.LocalAddr().String()
+	replies := []string{probe(t, clock, client, NATtestCases[0])}
+	// The connection ID keeps the session alive although the follow-up arrives from a new address
+	conn.rebind(t)
+	replies = append(replies, probe(t, clock, client, NATtestCases[1]))
+
+	assert.True(clock.WaitForTimer(server.config.UDPTimeout), "The server should wait for the next message")
+	clock.Advance(server.config.UDPTimeout)
+
+	assert.Eventually(func() bool {
+		return len(sink.natLogEntries()) == len(replies)
+	}, replyTimeout, time.Millisecond, "All DTLS probes should be logged")
+	entries := sink.natLogEntries()
+	assertNATLogEntries(t, entries, "DTLS", replies)
+	for _, entry := range entries {
+		if !assert.NotNil(entry.DTLS, "The DTLS session should be recorded") {
+			continue
+		}
+		assert.Equal(testPSKIdentity, entry.DTLS.PSKIdentity, "The PSK identity should be recorded")
+		assert.NotEmpty(entry.DTLS.CipherSuite, "The cipher should be recorded")
+		assert.False(entry.DTLS.SessionLost, "The session should not be lost")
+		if entry.Message.Interval == 1 {
+			assert.Equal(first, entry.IP, "The first probe should be logged for the first address")
+			assert.True(entry.DTLS.Rebound, "The probe followed up from a new address should be marked as rebound")
+		} else {
+			assert.Equal(conn.LocalAddr().String(), entry.IP, "The second probe should be logged for the new address")
+			assert.False(entry.DTLS.Rebound, "The last probe had no follow-up")
+		}
+	}
+}
+
+func TestDTLSSessionLost(t *testing.T) {
+	assert := assert.New(t)
+	sink := &memorySink{}
+	server, clock := newFakeClockServer(t, sink, dtlsListener)
+
+	conn := newRebindingConn(t)
+	client := dialDTLS(t, server, conn, false)
+	defer client.Close()
+	probe(t, clock, client, NATtestCases[0])
+
+	// Without a connection ID the device has to start a new session after the NAT rebound it
+	conn.rebind(t)
+	rebound := dialDTLS(t, server, newRebindingConn(t), false)
+	defer rebound.Close()
+	probe(t, clock, rebound, NATtestCases[1])
+
+	assert.Eventually(func() bool {
+		return len(sink.natLogEntries()) == 1
+	}, replyTimeout, time.Millisecond, "The probe of the lost session should be logged")
+	entries := sink.natLogEntries()
+	if assert.Len(entries, 1) && assert.NotNil(entries[0].DTLS, "The DTLS session should be recorded") {
+		assert.Equal(1, entries[0].Message.Interval, "The probe of the lost session should be logged")
+		assert.True(entries[0].Timeout, "The probe of the lost session should time out")
+		assert.True(entries[0].DTLS.SessionLost, "The session should be marked as lost")
+	}
+}
+
+func TestDTLSWrongKey(t *testing.T) {
+	sink := &memorySink{}
+	server, _ := newFakeClockServer(t, sink, dtlsListener)
+
+	config := &dtls.Config{
+		PSK: func([]byte) ([]byte, error) {
+			return []byte{0xff}, nil
+		},
+		PSKIdentityHint: []byte(testPSKIdentity),
+		CipherSuites:    []dtls.CipherSuiteID{dtls.TLS_PSK_WITH_AES_128_CCM_8},
+	}
+	conn := newRebindingConn(t)
+	client, err := dtls.Client(conn, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: localPort(server.DTLSAddr())}, config)
+	if err != nil {
+		t.Fatalf("Failed to create DTLS client: %s", err)
+	}
+	defer client.Close()
+	// Records which fail to decrypt are dropped, so the client never completes the handshake
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.Error(t, client.HandshakeContext(ctx), "Clients with the wrong key should be rejected")
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// estimatesPath answers with the NAT timeout estimates on the monitoring listener, next to the admin API
+const estimatesPath = "/admin/estimates"
+
+// timeoutKey groups the probes of one operator, protocol and radio access technology
+type timeoutKey struct {
+	Operator  string
+	Protocol  string
+	LTEMode   int
+	NBIoTMode int
+}
+
+// timeoutStats counts the probes of a timeoutKey which survived or timed out, by interval
+type timeoutStats struct {
+	Successes map[int]int
+	Timeouts  map[int]int
+}
+
+// timeoutIndex keeps the timeoutStats of all NAT log entries the server has recorded since it started,
+// and of the ones in Config.History recorded before
+type timeoutIndex struct {
+	Map map[timeoutKey]*timeoutStats
+	Mux sync.Mutex
+}
+
+// TimeoutEstimate brackets the NAT timeout of an operator, protocol and radio access technology:
+// the binding survived LargestSuccess seconds, but not SmallestTimeout seconds
+type TimeoutEstimate struct {
+	Operator        string
+	Protocol        string
+	LTEMode         int
+	NBIoTMode       int
+	LargestSuccess  int `json:",omitempty"`
+	SmallestTimeout int `json:",omitempty"`
+	Probes          int
+	Timeouts        int
+	// Confidence is the share of probes agreeing with the bracket, it is 0 unless both bounds are known
+	Confidence float64
+	// Inconsistent is true if a probe timed out at or below the largest interval which survived, e.g. because the NAT
+	// changed between the tests. The bracket is then the one most probes agree with.
+	Inconsistent bool `json:",omitempty"`
+}
+
+func newTimeoutIndex() *timeoutIndex {
+	return &timeoutIndex{Map: make(map[timeoutKey]*timeoutStats)}
+}
+
+// add counts entry if it is a NAT log entry which was not interrupted
+func (x *timeoutIndex) add(entry logEntry) {
+	e, ok := entry.(NATLogEntry)
+	if !ok || e.Interrupted {
+		return
+	}
+	key := timeoutKey{Operator: e.Message.Operator, Protocol: e.Protocol, LTEMode: e.Message.LTEMode, NBIoTMode: e.Message.NBIotMode}
+	x.Mux.Lock()
+	defer x.Mux.Unlock()
+	stats, ok := x.Map[key]
+	if !ok {
+		stats = &timeoutStats{Successes: make(map[int]int), Timeouts: make(map[int]int)}
+		x.Map[key] = stats
+	}
+	if e.Timeout {
+		stats.Timeouts[e.Message.Interval]++
+	} else {
+		stats.Successes[e.Message.Interval]++
+	}
+}
+
+// estimate returns the bracket of the NAT timeout of key which most probes agree with.
+// A success at or above the smallest timeout, and a timeout at or below the largest success, disagree with the bracket.
+func (stats *timeoutStats) estimate(key timeoutKey) TimeoutEstimate {
+	e := TimeoutEstimate{Operator: key.Operator, Protocol: key.Protocol, LTEMode: key.LTEMode, NBIoTMode: key.NBIoTMode}
+	// The bracket splits the intervals after one of them, or before all of them
+	cuts := []int{0}
+	largestSuccess, smallestTimeout := 0, 0
+	for interval, n := range stats.Successes {
+		e.Probes += n
+		cuts = append(cuts, interval)
+		if interval > largestSuccess {
+			largestSuccess = interval
+		}
+	}
+	for interval, n := range stats.Timeouts {
+		e.Probes += n
+		e.Timeouts += n
+		cuts = append(cuts, interval)
+		if smallestTimeout == 0 || interval < smallestTimeout {
+			smallestTimeout = interval
+		}
+	}
+	e.Inconsistent = largestSuccess > 0 && smallestTimeout > 0 && smallestTimeout <= largestSuccess
+	sort.Ints(cuts)
+
+	best := -1
+	for _, cut := range cuts {
+		agreeing, success, timeout := 0, 0, 0
+		for interval, n := range stats.Successes {
+			if interval <= cut {
+				agreeing += n
+				if interval > success {
+					success = interval
+				}
+			}
+		}
+		for interval, n := range stats.Timeouts {
+			if interval > cut {
+				agreeing += n
+				if timeout == 0 || interval < timeout {
+					timeout = interval
+				}
+			}
+		}
+		if agreeing > best {
+			best = agreeing
+			e.LargestSuccess = success
+			e.SmallestTimeout = timeout
+		}
+	}
+	if e.LargestSuccess > 0 && e.SmallestTimeout > 0 {
+		e.Confidence = float64(best) / float64(e.Probes)
+	}
+	return e
+}
+
+// estimates returns the estimates of the operator and protocol, empty values match all of them
+func (x *timeoutIndex) estimates(operator string, protocol string) []TimeoutEstimate {
+	estimates := []TimeoutEstimate{}
+	x.Mux.Lock()
+	for key, stats := range x.Map {
+		if (len(operator) == 0 || key.Operator == operator) && (len(protocol) == 0 || strings.EqualFold(key.Protocol, protocol)) {
+			estimates = append(estimates, stats.estimate(key))
+		}
+	}
+	x.Mux.Unlock()
+
+	sort.Slice(estimates, func(i, j int) bool {
+		a, b := estimates[i], estimates[j]
+		if a.Operator != b.Operator {
+			return a.Operator < b.Operator
+		} else if a.Protocol != b.Protocol {
+			return a.Protocol < b.Protocol
+		} else if a.LTEMode != b.LTEMode {
+			return a.LTEMode < b.LTEMode
+		}
+		return a.NBIoTMode < b.NBIoTMode
+	})
+	return estimates
+}
+
+// handleEstimates answers with the estimates matching the op and protocol query parameters
+func (s *Server) handleEstimates(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	writeJSON(w, s.timeoutIndex.estimates(query.Get("op"), query.Get("protocol")))
+}
+
+// seedTimeoutIndex counts the NAT log entries in the history which were recorded before started,
+// the later ones are counted as the server hands them to the sink
+func (s *Server) seedTimeoutIndex(started time.Time) {
+	natLogPrefix := "NATLog/"
+	if len(s.config.HistoryPrefix) > 0 {
+		natLogPrefix = s.config.HistoryPrefix + "/" + natLogPrefix
+	}
+	before := exportFilter{To: started}
+	entries := 0
+	err := readLog(s.config.History, logSources(natLogPrefix, "nat"), func(start time.Time, end time.Time) bool {
+		return !before.mayMatchSpan(start, end)
+	}, func(raw json.RawMessage) error {
+		var e NATLogEntry
+		if err := json.Unmarshal(raw, &e); err != nil {
+			return err
+		}
+		if !e.Timestamp.Before(started) {
+			return nil
+		}
+		s.timeoutIndex.add(e)
+		entries++
+		return nil
+	})
+	if err != nil {
+		slog.Error("Failed to seed the timeout estimates", "error", err, "entries", entries)
+		return
+	}
+	slog.Info("Seeded the timeout estimates", "entries", entries)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// estimateEntry returns a NAT log entry of a probe on operator 24201 over LTE-M
+func estimateEntry(protocol string, interval int, timeout bool) NATLogEntry {
+	e := NATLogEntry{Protocol: protocol, Timeout: timeout}
+	e.Message.Operator = "24201"
+	e.Message.LTEMode = 1
+	e.Message.Interval = interval
+	return e
+}
+
+func TestTimeoutIndex(t *testing.T) {
+	assert := assert.New(t)
+	x := newTimeoutIndex()
+	for _, e := range []NATLogEntry{
+		estimateEntry("UDP", 30, false),
+		estimateEntry("UDP", 60, false),
+		estimateEntry("UDP", 120, true),
+		estimateEntry("UDP", 90, true),
+		estimateEntry("TCP", 600, false),
+	} {
+		x.add(e)
+	}
+	interrupted := estimateEntry("UDP", 10, true)
+	interrupted.Interrupted = true
+	x.add(interrupted)
+	x.add(ATLogEntry{})
+
+	estimates := x.estimates("24201", "udp")
+	if assert.Len(estimates, 1) {
+		assert.Equal(TimeoutEstimate{Operator: "24201", Protocol: "UDP", LTEMode: 1, LargestSuccess: 60, SmallestTimeout: 90, Probes: 4, Timeouts: 2, Confidence: 1}, estimates[0],
+			"The timeout lies between the largest success and the smallest timeout, interrupted probes do not count")
+	}
+	estimates = x.estimates("", "TCP")
+	if assert.Len(estimates, 1) {
+		assert.Equal(600, estimates[0].LargestSuccess)
+		assert.Zero(estimates[0].Confidence, "Without a timeout there is no bracket")
+	}
+	assert.Empty(x.estimates("24202", ""), "Other operators have no estimates")
+
+	// A later success beyond the smallest timeout contradicts the bracket
+	x.add(estimateEntry("UDP", 120, false))
+	estimates = x.estimates("24201", "UDP")
+	if assert.Len(estimates, 1) {
+		assert.True(estimates[0].Inconsistent, "The contradiction should be reported")
+		assert.Equal(60, estimates[0].LargestSuccess, "The bracket most probes agree with should be kept")
+		assert.Equal(90, estimates[0].SmallestTimeout)
+		assert.InDelta(0.8, estimates[0].Confidence, 0.001, "Only the success at 120 seconds disagrees")
+	}
+}
+
+func TestTimeoutIndexOutOfOrder(t *testing.T) {
+	assert := assert.New(t)
+	x := newTimeoutIndex()
+	// The NAT timeout dropped after the first probe
+	for _, e := range []NATLogEntry{
+		estimateEntry("UDP", 120, false),
+		estimateEntry("UDP", 60, true),
+		estimateEntry("UDP", 90, true),
+		estimateEntry("UDP", 30, false),
+	} {
+		x.add(e)
+	}
+
+	estimates := x.estimates("", "")
+	if assert.Len(estimates, 1) {
+		assert.True(estimates[0].Inconsistent, "The timeout below the largest success should be reported")
+		assert.Less(estimates[0].LargestSuccess, estimates[0].SmallestTimeout, "The bracket should not be inverted")
+		assert.Equal(30, estimates[0].LargestSuccess)
+		assert.Equal(60, estimates[0].SmallestTimeout)
+		assert.Equal(4, estimates[0].Probes)
+		assert.InDelta(0.75, estimates[0].Confidence, 0.001, "Only the success at 120 seconds disagrees")
+	}
+
+	x = newTimeoutIndex()
+	x.add(estimateEntry("UDP", 60, true))
+	x.add(estimateEntry("UDP", 90, true))
+	estimates = x.estimates("", "")
+	if assert.Len(estimates, 1) {
+		assert.False(estimates[0].Inconsistent)
+		assert.Zero(estimates[0].LargestSuccess)
+		assert.Equal(60, estimates[0].SmallestTimeout, "Without a success every timeout bounds the bracket")
+	}
+}
+
+func TestEstimatesAPI(t *testing.T) {
+	assert := assert.New(t)
+	config := defaultConfig()
+	config.Sink = &memorySink{}
+	config.AdminToken = testAdminToken
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	config.MonitoringListener = l
+	server, err := newTestServer(config)
+	if err != nil {
+		t.Fatalf("Failed to start server: %s", err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		assert.NoError(server.Shutdown(ctx), "The server should shut down")
+	})
+
+	server.writeLog <- estimateEntry("UDP", 60, false)
+	server.writeLog <- estimateEntry("UDP", 120, true)
+	var estimates []TimeoutEstimate
+	assert.Eventually(func() bool {
+		estimates = nil
+		adminRequest(t, server, http.MethodGet, estimatesPath+"?op=24201&protocol=UDP", testAdminToken, &estimates)
+		return len(estimates) == 1 && estimates[0].Probes == 2
+	}, replyTimeout, time.Millisecond, "The recorded probes should be estimated")
+	if assert.Len(estimates, 1) {
+		assert.Equal(60, estimates[0].LargestSuccess)
+		assert.Equal(120, estimates[0].SmallestTimeout)
+	}
+	assert.Equal(http.StatusUnauthorized, adminRequest(t, server, http.MethodGet, estimatesPath, "", nil), "The estimates require the admin token")
+}
+
+func TestSeedTimeoutIndex(t *testing.T) {
+	assert := assert.New(t)
+	store := dirStore{Dir: t.TempDir()}
+	started := newFakeClock().Now()
+	history := func(interval int, timeout bool, timestamp time.Time) NATLogEntry {
+		e := estimateEntry("UDP", interval, timeout)
+		e.IP = "192.0.2.1:1000"
+		e.Timestamp = timestamp
+		return e
+	}
+
+	// Last month was concatenated, the last probe before the restart was not
+	for _, e := range []NATLogEntry{history(60, false, started.AddDate(0, 0, -20)), history(90, true, started.Add(-time.Hour))} {
+		writeObject(t, store.Dir, "test/"+e.getKey(), e)
+	}
+	assert.Nil(concatenateLogs(store, "test", started, nil))
+	assert.Len(listAll(t, store, "months/"), 1)
+	last := history(120, true, started.Add(-time.Minute))
+	writeObject(t, store.Dir, "test/"+last.getKey(), last)
+	// The server counts the entries it records itself
+	recorded := history(600, false, started)
+	writeObject(t, store.Dir, "test/"+recorded.getKey(), recorded)
+
+	server, _ := newFakeClockServer(t, &memorySink{}, func(config *Config) {
+		config.History = store
+		config.HistoryPrefix = "test"
+	})
+	assert.Eventually(func() bool {
+		estimates := server.timeoutIndex.estimates("", "")
+		return len(estimates) == 1 && estimates[0].Probes == 3
+	}, replyTimeout, time.Millisecond, "The estimates should be seeded from the history")
+	estimates := server.timeoutIndex.estimates("", "")
+	if assert.Len(estimates, 1) {
+		assert.Equal(60, estimates[0].LargestSuccess)
+		assert.Equal(90, estimates[0].SmallestTimeout)
+		assert.Equal(2, estimates[0].Timeouts)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// eventsPath streams the log entries as Server-Sent Events on the monitoring listener, next to the admin API
+const eventsPath = "/admin/events"
+
+// eventBufferSize is the number of log entries buffered per subscriber, one which falls further behind misses entries
+const eventBufferSize = 64
+
+// eventFilter selects the log entries streamed to a subscriber, empty fields match every entry
+type eventFilter struct {
+	IMEI     string
+	ICCID    string
+	Operator string
+	Protocol string
+}
+
+// eventSubscriberMap stores the filter of every subscriber to the live stream of log entries
+type eventSubscriberMap struct {
+	Map map[chan logEntry]eventFilter
+	Mux sync.Mutex
+}
+
+// matches returns true if entry passes all fields of f, AT command entries have the protocol AT
+func (f eventFilter) matches(entry logEntry) bool {
+	var imei, iccid, operator, protocol string
+	switch e := entry.(type) {
+	case NATLogEntry:
+		imei, iccid, operator, protocol = e.Message.IMEI, e.Message.ICCID, e.Message.Operator, e.Protocol
+	case ATLogEntry:
+		imei, iccid, operator, protocol = e.Message.IMEI, e.Message.ICCID, e.Message.Operator, "AT"
+	case NATSearchSummary:
+		imei, iccid, operator, protocol = e.IMEI, e.ICCID, e.Operator, e.Protocol
+	}
+	return (len(f.IMEI) == 0 || f.IMEI == imei) &&
+		(len(f.ICCID) == 0 || f.ICCID == iccid) &&
+		(len(f.Operator) == 0 || f.Operator == operator) &&
+		(len(f.Protocol) == 0 || strings.EqualFold(f.Protocol, protocol))
+}
+
+// eventType returns the name of the event entry is streamed as, it matches the prefix of its key
+func eventType(entry logEntry) string {
+	switch entry.(type) {
+	case ATLogEntry:
+		return "ATLog"
+	case NATSearchSummary:
+		return "NATSummary"
+	}
+	return "NATLog"
+}
+
+func (s *Server) subscribe(filter eventFilter) chan logEntry {
+	c := make(chan logEntry, eventBufferSize)
+	s.eventSubscribers.Mux.Lock()
+	s.eventSubscribers.Map[c] = filter
+	s.eventSubscribers.Mux.Unlock()
+	return c
+}
+
+func (s *Server) unsubscribe(c chan logEntry) {
+	s.eventSubscribers.Mux.Lock()
+	delete(s.eventSubscribers.Map, c)
+	s.eventSubscribers.Mux.Unlock()
+}
+
+// publish hands entry to every subscriber whose filter it matches, without waiting for slow subscribers
+func (s *Server) publish(entry logEntry) {
+	s.eventSubscribers.Mux.Lock()
+	defer s.eventSubscribers.Mux.Unlock()
+	for c, filter := range s.eventSubscribers.Map {
+		if !filter.matches(entry) {
+			continue
+		}
+		select {
+		case c <- entry:
+		default:
+		}
+	}
+}
+
+// handleEvents streams every log entry matching the imei, iccid, op and protocol query parameters
+// until the client disconnects or the monitoring endpoints are closed
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	query := r.URL.Query()
+	c := s.subscribe(eventFilter{
+		IMEI:     query.Get("imei"),
+		ICCID:    query.Get("iccid"),
+		Operator: query.Get("op"),
+		Protocol: query.Get("protocol"),
+	})
+	defer s.unsubscribe(c)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		select {
+		case entry := <-c:
+			data, err := json.Marshal(entry)
+			if err != nil {
+				continue
+			}
+			_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", eventType(entry), data)
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
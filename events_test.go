@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// readEvent returns the type and data of the next event on stream
+func readEvent(t *testing.T, stream *bufio.Reader) (string, string) {
+	var event, data string
+	for {
+		line, err := stream.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Failed to read event: %s", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case len(line) == 0:
+			return event, data
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+func TestEvents(t *testing.T) {
+	assert := assert.New(t)
+	sink := &memorySink{}
+	clock := newFakeClock()
+	config := defaultConfig()
+	config.Sink = sink
+	config.Clock = clock
+	config.AdminToken = testAdminToken
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	config.MonitoringListener = l
+	server, err := newTestServer(config)
+	if err != nil {
+		t.Fatalf("Failed to start server: %s", err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		assert.NoError(server.Shutdown(ctx), "The server should shut down")
+	})
+
+	url := "http://" + server.MonitoringAddr().String() + eventsPath
+	response, err := http.Get(url + "?protocol=tcp")
+	if err != nil {
+		t.Fatalf("Failed to get %s: %s", eventsPath, err)
+	}
+	response.Body.Close()
+	assert.Equal(http.StatusUnauthorized, response.StatusCode, "The stream requires the admin token")
+
+	ctx, cancel := context.WithTimeout(context.Background(), replyTimeout)
+	defer cancel()
+	tcpEvents, err := http.NewRequestWithContext(ctx, http.MethodGet, url+"?protocol=tcp&imei=352656100367872&token="+testAdminToken, nil)
+	if err != nil {
+		t.Fatalf("Failed to create request: %s", err)
+	}
+	tcpResponse, err := http.DefaultClient.Do(tcpEvents)
+	if err != nil {
+		t.Fatalf("Failed to get %s: %s", eventsPath, err)
+	}
+	defer tcpResponse.Body.Close()
+	assert.Equal("text/event-stream", tcpResponse.Header.Get("Content-Type"))
+	atEvents, err := http.NewRequestWithContext(ctx, http.MethodGet, url+"?op=24201", nil)
+	if err != nil {
+		t.Fatalf("Failed to create request: %s", err)
+	}
+	atEvents.Header.Set("Authorization", "Bearer "+testAdminToken)
+	atResponse, err := http.DefaultClient.Do(atEvents)
+	if err != nil {
+		t.Fatalf("Failed to get %s: %s", eventsPath, err)
+	}
+	defer atResponse.Body.Close()
+
+	// The AT command is filtered from the TCP stream, so the first event there is the TCP probe
+	atConn, err := net.Dial("tcp", server.ATAddr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect to the server: %s", err)
+	}
+	defer atConn.Close()
+	_, err = atConn.Write(ATTestCase)
+	assert.NoError(err, "The AT command should be sent")
+	tcpConn, err := net.Dial("tcp", server.TCPAddr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect to the server: %s", err)
+	}
+	reply := probe(t, clock, tcpConn, NATtestCases[0])
+	tcpConn.Close()
+
+	event, data := readEvent(t, bufio.NewReader(atResponse.Body))
+	assert.Equal("ATLog", event)
+	var atEntry ATLogEntry
+	assert.NoError(json.Unmarshal([]byte(data), &atEntry), "The event should hold the log entry")
+	assert.Equal(testCmd, atEntry.Message.Cmd)
+
+	event, data = readEvent(t, bufio.NewReader(tcpResponse.Body))
+	assert.Equal("NATLog", event)
+	var natEntry NATLogEntry
+	assert.NoError(json.Unmarshal([]byte(data), &natEntry), "The event should hold the log entry")
+	assert.Equal("TCP", natEntry.Protocol)
+	assert.Equal(replyTraceID(reply), natEntry.TraceID)
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// exportCommand is the first argument which runs the export instead of the server
+const exportCommand = "export"
+
+// Formats of the export
+const (
+	exportFormatCSV    = "csv"
+	exportFormatNDJSON = "ndjson"
+)
+
+// Logs which can be exported, they are saved below their key prefix
+var exportLogs = map[string]string{
+	"nat": "NATLog/",
+	"at":  "ATLog/",
+}
+
+var errUnknownExportFormat = errors.New("Unknown export format, use csv or ndjson")
+var errUnknownExportLog = errors.New("Unknown log, use nat or at")
+
+// exportDateFormat is accepted by --from and --to next to RFC 3339
+const exportDateFormat = "2006-01-02"
+
+// exportFilter selects the exported log entries, empty fields and zero times match every entry
+type exportFilter struct {
+	// From is the first timestamp exported, To the first timestamp not exported anymore
+	From     time.Time
+	To       time.Time
+	Operator string
+	IMEI     string
+	Protocol string
+}
+
+// natExportRow is a NAT log entry with the fields of its message flattened, the TLS, DTLS, CoAP, MQTT, HTTP and QUIC details are not exported
+type natExportRow struct {
+	Timestamp     time.Time `json:"timestamp"`
+	Protocol      string    `json:"protocol"`
+	IP            string    `json:"ip"`
+	AddressFamily string    `json:"address_family"`
+	LocalAddr     string    `json:"local_addr"`
+	LocalPort     int       `json:"local_port"`
+	Timeout       bool      `json:"timeout"`
+	Interrupted   bool      `json:"interrupted"`
+	ServerVersion string    `json:"server_version"`
+	TraceID       string    `json:"trace_id"`
+	Operator      string    `json:"op"`
+	DeviceIP      string    `json:"device_ip"`
+	CellID        int       `json:"cell_id"`
+	UEMode        int       `json:"ue_mode"`
+	LTEMode       int       `json:"lte_mode"`
+	NBIotMode     int       `json:"nbiot_mode"`
+	ICCID         string    `json:"iccid"`
+	IMEI          string    `json:"imei"`
+	Interval      int       `json:"interval"`
+}
+
+var natExportHeader = []string{"timestamp", "protocol", "ip", "address_family", "local_addr", "local_port", "timeout", "interrupted", "server_version", "trace_id",
+	"op", "device_ip", "cell_id", "ue_mode", "lte_mode", "nbiot_mode", "iccid", "imei", "interval"}
+
+// atExportRow is an AT log entry with the fields of its message flattened
+type atExportRow struct {
+	Timestamp     time.Time `json:"timestamp"`
+	IP            string    `json:"ip"`
+	ServerVersion string    `json:"server_version"`
+	TraceID       string    `json:"trace_id"`
+	Operator      string    `json:"op"`
+	ICCID         string    `json:"iccid"`
+	IMEI          string    `json:"imei"`
+	Cmd           string    `json:"cmd"`
+	Result        string    `json:"result"`
+}
+
+var atExportHeader = []string{"timestamp", "ip", "server_version", "trace_id", "op", "iccid", "imei", "cmd", "result"}
+
+func newNATExportRow(e NATLogEntry) natExportRow {
+	return natExportRow{
+		Timestamp:     e.Timestamp,
+		Protocol:      e.Protocol,
+		IP:            e.IP,
+		AddressFamily: e.AddressFamily,
+		LocalAddr:     e.LocalAddr,
+		LocalPort:     e.LocalPort,
+		Timeout:       e.Timeout,
+		Interrupted:   e.Interrupted,
+		ServerVersion: e.ServerVersion,
+		TraceID:       e.TraceID,
+		Operator:      e.Message.Operator,
+		// The device may report several addresses
+		DeviceIP:  strings.Join(e.Message.IP, " "),
+		CellID:    e.Message.CellID,
+		UEMode:    e.Message.UEMode,
+		LTEMode:   e.Message.LTEMode,
+		NBIotMode: e.Message.NBIotMode,
+		ICCID:     e.Message.ICCID,
+		IMEI:      e.Message.IMEI,
+		Interval:  e.Message.Interval,
+	}
+}
+
+func (r natExportRow) record() []string {
+	return []string{r.Timestamp.Format(time.RFC3339Nano), r.Protocol, r.IP, r.AddressFamily, r.LocalAddr, strconv.Itoa(r.LocalPort),
+		strconv.FormatBool(r.Timeout), strconv.FormatBool(r.Interrupted), r.ServerVersion, r.TraceID,
+		r.Operator, r.DeviceIP, strconv.Itoa(r.CellID), strconv.Itoa(r.UEMode), strconv.Itoa(r.LTEMode), strconv.Itoa(r.NBIotMode), r.ICCID, r.IMEI, strconv.Itoa(r.Interval)}
+}
+
+func newATExportRow(e ATLogEntry) atExportRow {
+	return atExportRow{
+		Timestamp:     e.Timestamp,
+		IP:            e.IP,
+		ServerVersion: e.ServerVersion,
+		TraceID:       e.TraceID,
+		Operator:      e.Message.Operator,
+		ICCID:         e.Message.ICCID,
+		IMEI:          e.Message.IMEI,
+		Cmd:           e.Message.Cmd,
+		Result:        e.Message.Result,
+	}
+}
+
+func (r atExportRow) record() []string {
+	return []string{r.Timestamp.Format(time.RFC3339Nano), r.IP, r.ServerVersion, r.TraceID, r.Operator, r.ICCID, r.IMEI, r.Cmd, r.Result}
+}
+
+// matches returns true if an entry of the protocol, timestamp, operator and IMEI passes f
+func (f exportFilter) matches(protocol string, timestamp time.Time, operator string, imei string) bool {
+	return (f.From.IsZero() || !timestamp.Before(f.From)) &&
+		(f.To.IsZero() || timestamp.Before(f.To)) &&
+		(len(f.Operator) == 0 || f.Operator == operator) &&
+		(len(f.IMEI) == 0 || f.IMEI == imei) &&
+		(len(f.Protocol) == 0 || strings.EqualFold(f.Protocol, protocol))
+}
+
+// mayMatchKey returns false if the hour in the path of key is a day or more outside the time range of f
+func (f exportFilter) mayMatchKey(key string, logPrefix string) bool {
+	start, end, ok := hourOfKey(logPrefix)(key)
+	return !ok || f.mayMatchSpan(start, end)
+}
+
+// mayMatchSpan returns false if the entries saved from start until end are a day or more outside the time range of f,
+// the day of margin covers the time zone of the server which saved the entry
+func (f exportFilter) mayMatchSpan(start time.Time, end time.Time) bool {
+	const margin = 24 * time.Hour
+	return (f.From.IsZero() || end.Add(margin).After(f.From)) &&
+		(f.To.IsZero() || start.Add(-margin).Before(f.To))
+}
+
+// logSource is a set of objects holding log entries, Span returns the time range of the entries in the object of key,
+// it returns false if the key does not tell
+type logSource struct {
+	Prefix string
+	Span   func(key string) (time.Time, time.Time, bool)
+}
+
+// hourOfKey returns a function which reads the hour from the path of the keys below logPrefix the sink saves entries to
+func hourOfKey(logPrefix string) func(key string) (time.Time, time.Time, bool) {
+	return func(key string) (time.Time, time.Time, bool) {
+		parts := strings.Split(strings.TrimPrefix(key, logPrefix), "/")
+		if len(parts) < 5 {
+			return time.Time{}, time.Time{}, false
+		}
+		hour, err := time.Parse("2006/01/02/15", strings.Join(parts[:4], "/"))
+		return hour, hour.Add(time.Hour), err == nil
+	}
+}
+
+// spanOfFile returns a function which reads the start of the time range in layout from the file name of a key,
+// the range ends at the start passed to next
+func spanOfFile(layout string, next func(time.Time) time.Time) func(key string) (time.Time, time.Time, bool) {
+	return func(key string) (time.Time, time.Time, bool) {
+		date, ok := dateOfFile(layout)(key)
+		if !ok {
+			return time.Time{}, time.Time{}, false
+		}
+		start, _ := time.Parse(layout, date)
+		return start, next(start), true
+	}
+}
+
+// logSources returns where the entries of log are saved: below logPrefix, and for the NAT log also in the files the
+// concatenate command rolled them into
+func logSources(logPrefix string, log string) []logSource {
+	sources := []logSource{{Prefix: logPrefix, Span: hourOfKey(logPrefix)}}
+	if log != "nat" {
+		return sources
+	}
+	return append(sources,
+		logSource{Prefix: "hours/", Span: spanOfFile("2006-01-02T15", func(t time.Time) time.Time { return t.Add(time.Hour) })},
+		logSource{Prefix: "days/", Span: spanOfFile("2006-01-02", func(t time.Time) time.Time { return t.AddDate(0, 0, 1) })},
+		logSource{Prefix: "months/", Span: spanOfFile("2006-01", func(t time.Time) time.Time { return t.AddDate(0, 1, 0) })},
+	)
+}
+
+// readLog calls fn with every entry in the objects of sources, objects for which skip returns true are not read
+func readLog(store objectStore, sources []logSource, skip func(start time.Time, end time.Time) bool, fn func(json.RawMessage) error) error {
+	for _, source := range sources {
+		keys, err := store.List(source.Prefix)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if start, end, ok := source.Span(key); ok && skip(start, end) {
+				continue
+			}
+			body, err := store.Get(key)
+			if err != nil {
+				return err
+			}
+			err = decodeEntries(body, fn)
+			if err != nil {
+				return fmt.Errorf("Invalid log entry in %s: %s", key, err)
+			}
+		}
+	}
+	return nil
+}
+
+// parseExportTime parses a time given as RFC 3339 or as date in UTC, an empty value is the zero time
+func parseExportTime(value string) (time.Time, error) {
+	if len(value) == 0 {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Parse(exportDateFormat, value)
+}
+
+// decodeEntries calls fn with every JSON value in body, an object holds a single log entry or several separated by newlines
+func decodeEntries(body []byte, fn func(json.RawMessage) error) error {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	for {
+		var raw json.RawMessage
+		err := decoder.Decode(&raw)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := fn(raw); err != nil {
+			return err
+		}
+	}
+}
+
+// exportWriter writes the exported rows in one of the export formats
+type exportWriter struct {
+	csv    *csv.Writer
+	ndjson *json.Encoder
+}
+
+func newExportWriter(w io.Writer, format string, header []string) (*exportWriter, error) {
+	switch strings.ToLower(format) {
+	case exportFormatCSV:
+		c := csv.NewWriter(w)
+		return &exportWriter{csv: c}, c.Write(header)
+	case exportFormatNDJSON:
+		return &exportWriter{ndjson: json.NewEncoder(w)}, nil
+	}
+	return nil, errUnknownExportFormat
+}
+
+func (w *exportWriter) write(row interface{ record() []string }) error {
+	if w.csv != nil {
+		return w.csv.Write(row.record())
+	}
+	return w.ndjson.Encode(row)
+}
+
+func (w *exportWriter) flush() error {
+	if w.csv != nil {
+		w.csv.Flush()
+		return w.csv.Error()
+	}
+	return nil
+}
+
+// exportLog writes the entries of log which pass filter to w, they are read below logPrefix in store and,
+// for the NAT log, from the concatenated files
+func exportLog(store objectStore, logPrefix string, log string, filter exportFilter, w *exportWriter) error {
+	skip := func(start time.Time, end time.Time) bool {
+		return !filter.mayMatchSpan(start, end)
+	}
+	err := readLog(store, logSources(logPrefix, log), skip, func(raw json.RawMessage) error {
+		if log == "at" {
+			var e ATLogEntry
+			if err := json.Unmarshal(raw, &e); err != nil {
+				return err
+			}
+			if !filter.matches("AT", e.Timestamp, e.Message.Operator, e.Message.IMEI) {
+				return nil
+			}
+			return w.write(newATExportRow(e))
+		}
+		var e NATLogEntry
+		if err := json.Unmarshal(raw, &e); err != nil {
+			return err
+		}
+		if !filter.matches(e.Protocol, e.Timestamp, e.Message.Operator, e.Message.IMEI) {
+			return nil
+		}
+		return w.write(newNATExportRow(e))
+	})
+	if err != nil {
+		return err
+	}
+	return w.flush()
+}
+
+// runExport runs the export subcommand with args, it writes to stdout unless --out is given.
+// The bucket and the log prefix are configured like for the server.
+func runExport(args []string, getenv func(string) string, stdout io.Writer) error {
+	settings, _, err := loadSettings(nil, getenv)
+	if err != nil {
+		return err
+	}
+
+	flags := flag.NewFlagSet("nat-testserver export", flag.ContinueOnError)
+	dir := flags.String("dir", "", "local directory with the layout of the bucket to export from instead of awsBucket")
+	prefix := flags.String("prefix", settings.LogPrefix, "prefix of the keys of the log entries")
+	log := flags.String("log", "nat", "log to export: nat or at")
+	format := flags.String("format", exportFormatCSV, "format of the export: csv or ndjson")
+	from := flags.String("from", "", "export the entries from this time on, RFC 3339 or YYYY-MM-DD")
+	to := flags.String("to", "", "export the entries before this time, RFC 3339 or YYYY-MM-DD")
+	operator := flags.String("op", "", "export the entries of this operator only")
+	imei := flags.String("imei", "", "export the entries of this device only")
+	protocol := flags.String("protocol", "", "export the NAT log entries of this protocol only")
+	out := flags.String("out", "", "file to export to instead of the standard output")
+	err = flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	logPrefix, ok := exportLogs[strings.ToLower(*log)]
+	if !ok {
+		return errUnknownExportLog
+	}
+	if len(*prefix) > 0 {
+		logPrefix = *prefix + "/" + logPrefix
+	}
+	filter := exportFilter{Operator: *operator, IMEI: *imei, Protocol: *protocol}
+	filter.From, err = parseExportTime(*from)
+	if err != nil {
+		return fmt.Errorf("Invalid value %q for --from: %s", *from, err)
+	}
+	filter.To, err = parseExportTime(*to)
+	if err != nil {
+		return fmt.Errorf("Invalid value %q for --to: %s", *to, err)
+	}
+
+	store, err := settings.objectStore(*dir)
+	if err != nil {
+		return err
+	}
+
+	header := natExportHeader
+	if strings.ToLower(*log) == "at" {
+		header = atExportHeader
+	}
+	w := stdout
+	if len(*out) > 0 {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	writer, err := newExportWriter(w, *format, header)
+	if err != nil {
+		return err
+	}
+	return exportLog(store, logPrefix, strings.ToLower(*log), filter, writer)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeObject saves entries as the object of key below dir, like the sink would save them to the bucket
+func writeObject(t *testing.T, dir string, key string, entries ...logEntry) {
+	var body []byte
+	for _, entry := range entries {
+		buffer, err := json.Marshal(entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body = append(append(body, buffer...), '\n')
+	}
+	path := filepath.Join(dir, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, body, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExport(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	start := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	udp := searchEntry("192.0.2.1:1000", 60, false, start)
+	udp.Message.IP = []string{"10.0.0.1", "2001:db8::1"}
+	tcp := searchEntry("192.0.2.1:1001", 120, true, start.Add(time.Hour))
+	tcp.Protocol = "TCP"
+	late := searchEntry("192.0.2.1:1002", 90, false, start.Add(48*time.Hour))
+	other := searchEntry("192.0.2.2:1000", 30, false, start)
+	other.Message.IMEI = "352656100367873"
+	other.Message.Operator = "24202"
+	for _, e := range []NATLogEntry{udp, tcp, late, other} {
+		writeObject(t, dir, "test/"+e.getKey(), e)
+	}
+	at := ATLogEntry{IP: "192.0.2.1:1000", Timestamp: start, TraceID: "trace"}
+	at.Message = atMessage{Operator: "24201", IMEI: "352656100367872", Cmd: "AT+CSQ", Result: "+CSQ: 20,99"}
+	// Concatenated objects hold several entries
+	writeObject(t, dir, "test/"+at.getKey(), at, at)
+	getenv := func(string) string { return "" }
+
+	var out bytes.Buffer
+	err := runExport([]string{"--dir", dir, "--prefix", "test", "--imei", "352656100367872", "--from", "2021-03-01", "--to", "2021-03-02"}, getenv, &out)
+	assert.Nil(err)
+	records, err := csv.NewReader(&out).ReadAll()
+	assert.Nil(err)
+	if assert.Len(records, 3, "The header and the UDP and TCP entries of the day should be exported") {
+		assert.Equal(natExportHeader, records[0])
+		assert.Len(records[1], len(natExportHeader))
+		assert.Equal("UDP", records[1][1])
+		assert.Equal("10.0.0.1 2001:db8::1", records[1][11])
+		assert.Equal("60", records[1][18])
+		assert.Equal("TCP", records[2][1])
+		assert.Equal("true", records[2][6])
+	}
+
+	out.Reset()
+	err = runExport([]string{"--dir", dir, "--prefix", "test", "--op", "24201", "--protocol", "tcp", "--format", "ndjson"}, getenv, &out)
+	assert.Nil(err)
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if assert.Len(lines, 1) {
+		var row map[string]interface{}
+		assert.Nil(json.Unmarshal([]byte(lines[0]), &row))
+		assert.Equal("TCP", row["protocol"])
+		assert.Equal(120.0, row["interval"])
+		assert.Equal("24201", row["op"])
+	}
+
+	out.Reset()
+	err = runExport([]string{"--dir", dir, "--prefix", "test", "--log", "at"}, getenv, &out)
+	assert.Nil(err)
+	records, err = csv.NewReader(&out).ReadAll()
+	assert.Nil(err)
+	if assert.Len(records, 3) {
+		assert.Equal(atExportHeader, records[0])
+		assert.Equal([]string{"2021-03-01T12:00:00Z", "192.0.2.1:1000", "", "trace", "24201", "", "352656100367872", "AT+CSQ", "+CSQ: 20,99"}, records[1])
+	}
+
+	assert.Equal(errUnknownExportFormat, runExport([]string{"--dir", dir, "--format", "xlsx"}, getenv, &out))
+	assert.Equal(errUnknownExportLog, runExport([]string{"--dir", dir, "--log", "quic"}, getenv, &out))
+	assert.Equal(errNoObjectStore, runExport(nil, getenv, &out))
+	assert.NotNil(runExport([]string{"--dir", dir, "--from", "yesterday"}, getenv, &out))
+}
+
+func TestExportFilterKey(t *testing.T) {
+	assert := assert.New(t)
+	filter := exportFilter{From: time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC), To: time.Date(2021, 3, 2, 0, 0, 0, 0, time.UTC)}
+	assert.True(filter.mayMatchKey("NATLog/2021/03/01/12/a.json", "NATLog/"))
+	assert.True(filter.mayMatchKey("NATLog/2021/02/28/12/a.json", "NATLog/"), "Entries in other time zones may be saved below the previous day")
+	assert.False(filter.mayMatchKey("NATLog/2021/02/27/12/a.json", "NATLog/"))
+	assert.False(filter.mayMatchKey("NATLog/2021/03/03/12/a.json", "NATLog/"))
+	assert.True(filter.mayMatchKey("NATLog/unknown.json", "NATLog/"))
+}
+
+func TestExportConcatenated(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	store := dirStore{Dir: dir}
+	now := time.Date(2021, 3, 2, 12, 30, 0, 0, time.UTC)
+
+	morning := searchEntry("192.0.2.1:1000", 60, false, time.Date(2021, 3, 1, 9, 0, 0, 0, time.UTC))
+	evening := searchEntry("192.0.2.1:1000", 90, true, time.Date(2021, 3, 1, 20, 0, 0, 0, time.UTC))
+	january := searchEntry("192.0.2.1:1000", 30, false, time.Date(2021, 1, 15, 9, 0, 0, 0, time.UTC))
+	current := searchEntry("192.0.2.1:1000", 120, false, now)
+	for _, e := range []NATLogEntry{morning, evening, january, current} {
+		writeObject(t, dir, "test/"+e.getKey(), e)
+	}
+	assert.Nil(concatenateLogs(store, "test", now, nil))
+	assert.Len(listAll(t, store, "days/"), 1)
+	assert.Len(listAll(t, store, "months/"), 1)
+	// Files outside the time range are not read
+	if err := os.WriteFile(filepath.Join(dir, "months", "2020-11-broken.txt"), []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	getenv := func(string) string { return "" }
+
+	var out bytes.Buffer
+	err := runExport([]string{"--dir", dir, "--prefix", "test", "--from", "2021-03-01", "--to", "2021-03-03"}, getenv, &out)
+	assert.Nil(err)
+	records, err := csv.NewReader(&out).ReadAll()
+	assert.Nil(err)
+	if assert.Len(records, 4, "The header and the entries of the concatenated day and the current hour should be exported") {
+		var intervals []string
+		for _, record := range records[1:] {
+			intervals = append(intervals, record[18])
+		}
+		assert.ElementsMatch([]string{"60", "90", "120"}, intervals)
+	}
+
+	out.Reset()
+	err = runExport([]string{"--dir", dir, "--prefix", "test", "--from", "2021-01-01", "--to", "2021-02-01", "--format", "ndjson"}, getenv, &out)
+	assert.Nil(err)
+	assert.Equal(1, strings.Count(out.String(), "\n"), "The entry of the concatenated month should be exported")
+
+	assert.NotNil(runExport([]string{"--dir", dir, "--prefix", "test"}, getenv, &out), "Without a time range every file is read")
+}
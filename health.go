@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// healthPath reports whether the server is alive, readyPath whether it can take traffic
+const healthPath = "/healthz"
+const readyPath = "/readyz"
+
+const defaultMaxLogBacklog = 1000
+
+// uploadState is the result of the last upload of a log entry
+type uploadState struct {
+	Time  time.Time
+	Error error
+	Mux   sync.Mutex
+}
+
+// acceptorErrorMap stores why the goroutine accepting on a listener ended while the server was running,
+// keyed by the protocol and the address of the listener
+type acceptorErrorMap struct {
+	Map map[string]error
+	Mux sync.Mutex
+}
+
+// HealthReport describes the state of the listeners and the sink for operators
+type HealthReport struct {
+	// Healthy is true while the UDP, TCP and AT listeners are bound and no listener has failed
+	Healthy bool
+	// Ready is true if the server is healthy, the log backlog is below MaxLogBacklog and the last upload succeeded
+	Ready    bool
+	Stopping bool
+	// Listeners are the addresses of the working listeners by protocol
+	Listeners map[string][]string
+	// ListenerErrors maps the protocol and address of every failed listener to its error
+	ListenerErrors map[string]string `json:",omitempty"`
+	// LogBacklog is the number of log entries handed to the sink which are not saved yet
+	LogBacklog      int64
+	MaxLogBacklog   int
+	LastUploadTime  *time.Time `json:",omitempty"`
+	LastUploadError string     `json:",omitempty"`
+}
+
+// recordUpload remembers the result of the upload which just finished
+func (s *Server) recordUpload(err error) {
+	s.lastUpload.Mux.Lock()
+	defer s.lastUpload.Mux.Unlock()
+	s.lastUpload.Time = s.config.Clock.Now()
+	s.lastUpload.Error = err
+}
+
+// acceptorKey identifies the listener of protocol on addr in acceptorErrors
+func acceptorKey(protocol string, addr net.Addr) string {
+	return protocol + " " + addr.String()
+}
+
+// acceptFailed returns true if err ends an accept or read loop, temporary errors like running out of file descriptors do not
+func acceptFailed(err error) bool {
+	var temporary interface{ Temporary() bool }
+	return !errors.As(err, &temporary) || !temporary.Temporary()
+}
+
+// recordAcceptorError remembers that the listener of protocol on addr stopped accepting because of err
+func (s *Server) recordAcceptorError(protocol string, addr net.Addr, err error) {
+	slog.Error("Listener failed", "protocol", protocol, "local", addr.String(), "error", err)
+	s.acceptorErrors.Mux.Lock()
+	defer s.acceptorErrors.Mux.Unlock()
+	s.acceptorErrors.Map[acceptorKey(protocol, addr)] = err
+}
+
+// healthReport returns the current state of the server
+func (s *Server) healthReport() HealthReport {
+	report := HealthReport{
+		Stopping:       s.isStopping(),
+		Listeners:      map[string][]string{"UDP": nil, "TCP": nil, "AT": nil},
+		ListenerErrors: make(map[string]string),
+		LogBacklog:     atomic.LoadInt64(&s.logBacklog),
+		MaxLogBacklog:  s.config.MaxLogBacklog,
+	}
+	listeners := []struct {
+		protocol string
+		addrs    []net.Addr
+	}{
+		{"UDP", s.UDPAddrs()},
+		{"TCP", s.TCPAddrs()},
+		{"TLS", s.TLSAddrs()},
+		{"DTLS", s.DTLSAddrs()},
+		{"CoAP", s.CoAPAddrs()},
+		{"MQTT", s.MQTTAddrs()},
+		{"HTTP", s.HTTPAddrs()},
+		{"QUIC", s.QUICAddrs()},
+		{"AT", s.ATAddrs()},
+	}
+	s.acceptorErrors.Mux.Lock()
+	for _, l := range listeners {
+		for _, addr := range l.addrs {
+			if err, ok := s.acceptorErrors.Map[acceptorKey(l.protocol, addr)]; ok {
+				report.ListenerErrors[acceptorKey(l.protocol, addr)] = err.Error()
+			} else {
+				report.Listeners[l.protocol] = append(report.Listeners[l.protocol], addr.String())
+			}
+		}
+	}
+	s.acceptorErrors.Mux.Unlock()
+	report.Healthy = !report.Stopping && len(report.ListenerErrors) == 0
+	for _, protocol := range []string{"UDP", "TCP", "AT"} {
+		report.Healthy = report.Healthy && len(report.Listeners[protocol]) > 0
+	}
+
+	s.lastUpload.Mux.Lock()
+	if !s.lastUpload.Time.IsZero() {
+		t := s.lastUpload.Time
+		report.LastUploadTime = &t
+	}
+	if s.lastUpload.Error != nil {
+		report.LastUploadError = s.lastUpload.Error.Error()
+	}
+	s.lastUpload.Mux.Unlock()
+
+	report.Ready = report.Healthy && report.LogBacklog < int64(report.MaxLogBacklog) && len(report.LastUploadError) == 0
+	return report
+}
+
+// handleHealth answers with the health report, and with 503 unless the server is healthy
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	report := s.healthReport()
+	writeHealthReport(w, report, report.Healthy)
+}
+
+// handleReady answers with the health report, and with 503 unless the server is ready
+func (s *Server) handleReady(w http.ResponseWriter, r *http.Request) {
+	report := s.healthReport()
+	writeHealthReport(w, report, report.Ready)
+}
+
+func writeHealthReport(w http.ResponseWriter, report HealthReport, ok bool) {
+	w.Header().Set("Content-Type", "application/json")
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
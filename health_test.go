@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// gatedSink holds every log entry until release is closed, then fails to save it with err
+type gatedSink struct {
+	release chan struct{}
+	err     error
+}
+
+func (s *gatedSink) Save(ctx context.Context, entry logEntry) error {
+	select {
+	case <-s.release:
+		return s.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// getHealth returns the status code and the report the server answers on path with
+func getHealth(t *testing.T, server *Server, path string) (int, HealthReport) {
+	response, err := http.Get("http://" + server.MonitoringAddr().String() + path)
+	if err != nil {
+		t.Fatalf("Failed to get %s: %s", path, err)
+	}
+	defer response.Body.Close()
+	var report HealthReport
+	if err := json.NewDecoder(response.Body).Decode(&report); err != nil {
+		t.Fatalf("Failed to decode the health report: %s", err)
+	}
+	return response.StatusCode, report
+}
+
+func TestHealth(t *testing.T) {
+	assert := assert.New(t)
+	sink := &gatedSink{release: make(chan struct{}), err: errors.New("Upload failed")}
+	clock := newFakeClock()
+	config := defaultConfig()
+	config.Sink = sink
+	config.Clock = clock
+	config.MaxLogBacklog = 1
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	config.MonitoringListener = l
+	server, err := newTestServer(config)
+	if err != nil {
+		t.Fatalf("Failed to start server: %s", err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		assert.NoError(server.Shutdown(ctx), "The server should shut down")
+	}()
+
+	status, report := getHealth(t, server, healthPath)
+	assert.Equal(http.StatusOK, status, "The server should be healthy")
+	assert.Equal([]string{server.UDPAddr().String()}, report.Listeners["UDP"], "The UDP listener should be reported")
+	assert.Len(report.Listeners["AT"], 1, "The AT listener should be reported")
+	status, report = getHealth(t, server, readyPath)
+	assert.Equal(http.StatusOK, status, "The server should be ready")
+	assert.True(report.Ready, "The server should be ready")
+	assert.Nil(report.LastUploadTime, "Nothing has been uploaded yet")
+
+	// The log entry of the timed out probe waits for the sink
+	conn := dialUDP(t, server)
+	defer conn.Close()
+	probe(t, clock, conn, NATtestCases[0])
+	assert.True(clock.WaitForTimer(server.config.UDPTimeout), "The server should wait for the next message")
+	clock.Advance(server.config.UDPTimeout)
+	assert.Eventually(func() bool {
+		status, _ := getHealth(t, server, readyPath)
+		return status == http.StatusServiceUnavailable
+	}, replyTimeout, time.Millisecond, "The server should not be ready with a full backlog")
+	status, report = getHealth(t, server, healthPath)
+	assert.Equal(http.StatusOK, status, "A full backlog should not make the server unhealthy")
+	assert.Equal(int64(1), report.LogBacklog, "The unsaved log entry should be reported")
+
+	close(sink.release)
+	assert.Eventually(func() bool {
+		_, report := getHealth(t, server, readyPath)
+		return report.LogBacklog == 0
+	}, replyTimeout, time.Millisecond, "The backlog should be empty once the upload failed")
+	status, report = getHealth(t, server, readyPath)
+	assert.Equal(http.StatusServiceUnavailable, status, "The server should not be ready after a failed upload")
+	assert.Equal("Upload failed", report.LastUploadError, "The failed upload should be reported")
+	assert.NotNil(report.LastUploadTime, "The time of the upload should be reported")
+}
+
+func TestListenerFailure(t *testing.T) {
+	assert := assert.New(t)
+	server, _ := newFakeClockServer(t, &memorySink{}, mqttListener(t), func(config *Config) {
+		config.MonitoringListener = localTCPListener(t)
+	})
+	status, report := getHealth(t, server, healthPath)
+	assert.Equal(http.StatusOK, status, "The server should be healthy")
+	assert.Equal([]string{server.MQTTAddr().String()}, report.Listeners["MQTT"], "The MQTT listener should be reported")
+	assert.Empty(report.ListenerErrors)
+
+	server.mqttListeners[0].Close()
+	assert.Eventually(func() bool {
+		status, _ := getHealth(t, server, healthPath)
+		return status == http.StatusServiceUnavailable
+	}, replyTimeout, time.Millisecond, "The server should be unhealthy once a listener failed")
+	_, report = getHealth(t, server, healthPath)
+	assert.Contains(report.ListenerErrors, "MQTT "+server.MQTTAddr().String(), "The failed listener should be reported")
+	assert.Empty(report.Listeners["MQTT"])
+
+	server.udpListeners[0].Conn.Close()
+	assert.Eventually(func() bool {
+		_, report := getHealth(t, server, healthPath)
+		return len(report.ListenerErrors) == 2
+	}, replyTimeout, time.Millisecond, "A UDP listener which fails to read should be reported")
+	_, report = getHealth(t, server, healthPath)
+	assert.Contains(report.ListenerErrors, "UDP "+server.UDPAddr().String())
+	assert.Empty(report.Listeners["UDP"])
+}
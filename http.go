@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// httpProbePath accepts NAT test messages as long-poll requests, httpWebSocketPath as WebSocket messages
+const httpProbePath = "/nat"
+const httpWebSocketPath = "/ws"
+
+// HTTPInfo describes the HTTP request a NAT test message was received in, the headers show which proxies it passed
+type HTTPInfo struct {
+	Via          string `json:",omitempty"`
+	ForwardedFor string `json:",omitempty"`
+	UserAgent    string `json:",omitempty"`
+}
+
+// httpConnKey stores the connection of a request in its context
+type httpConnKey struct{}
+
+var upgrader = websocket.Upgrader{
+	HandshakeTimeout: handshakeTimeout,
+	// Devices do not send an Origin, and browsers are not expected
+	CheckOrigin: func(r *http.Request) bool {
+		return true
+	},
+}
+
+// newHTTPServer returns the server for the long-poll and WebSocket endpoints
+func (s *Server) newHTTPServer() *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc(httpProbePath, s.handleHTTP)
+	mux.HandleFunc(httpWebSocketPath, s.handleWebSocket)
+	return &http.Server{
+		Handler:           s.limitHandlers(mux),
+		ReadHeaderTimeout: handshakeTimeout,
+		ConnContext: func(ctx context.Context, conn net.Conn) context.Context {
+			return context.WithValue(ctx, httpConnKey{}, conn)
+		},
+		ErrorLog: log.New(ioutil.Discard, "", 0),
+	}
+}
+
+// limitHandlers takes a handler slot for every request and rejects requests if there is none
+func (s *Server) limitHandlers(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := s.acquireHandler()
+		if err != nil {
+			s.logRejection(err, r.RemoteAddr)
+			http.Error(w, string(s.errorMessage(err)), http.StatusServiceUnavailable)
+			return
+		}
+		defer s.releaseHandler()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// httpInfo returns the proxy headers of r
+func httpInfo(r *http.Request) *HTTPInfo {
+	return &HTTPInfo{
+		Via:          r.Header.Get("Via"),
+		ForwardedFor: r.Header.Get("X-Forwarded-For"),
+		UserAgent:    r.UserAgent(),
+	}
+}
+
+// httpStatus returns the status code of a request rejected with err
+func httpStatus(err error) int {
+	switch err {
+	case errTooManyPending:
+		return http.StatusTooManyRequests
+	case errServerBusy, errInterrupted:
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusBadRequest
+}
+
+// handleHTTP handles a long-poll request: the request is held for the interval of the NAT test message in its body, then answered.
+// The probe times out if the client or a proxy closes the connection before that.
+func (s *Server) handleHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, int64(s.config.BufferSize)+1))
+	if err != nil {
+		return
+	} else if len(body) > s.config.BufferSize {
+		http.Error(w, string(genericErrorMessage), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	conn := r.Context().Value(httpConnKey{}).(net.Conn)
+	logEntry, err := s.parseData(bytes.TrimSpace(body), "HTTP", conn.RemoteAddr(), conn.LocalAddr())
+	if err == nil {
+		err = s.acquirePendingProbe(logEntry.IP)
+	}
+	if err != nil {
+		connLogger("HTTP", conn.RemoteAddr()).Warn("HTTP request rejected", "error", err)
+		http.Error(w, string(s.errorMessage(err)), httpStatus(err))
+		return
+	}
+	logEntry.HTTP = httpInfo(r)
+
+	timer := s.config.Clock.NewTimer(time.Duration(logEntry.Message.Interval) * time.Second)
+	select {
+	case <-timer.C():
+		s.releasePendingProbe(logEntry.IP)
+	case <-s.stopping:
+		timer.Stop()
+		s.releasePendingProbe(logEntry.IP)
+		entryLogger(logEntry).Info("HTTP response interrupted")
+		logEntry.Interrupted = true
+		s.writeLog <- logEntry
+		http.Error(w, string(s.errorMessage(errInterrupted)), http.StatusServiceUnavailable)
+		return
+	case <-r.Context().Done():
+		timer.Stop()
+		s.releasePendingProbe(logEntry.IP)
+		entryLogger(logEntry).Info("HTTP request closed before the response")
+		logEntry.Timeout = true
+		s.writeLog <- logEntry
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, err = w.Write(s.replyData(logEntry))
+	if err != nil {
+		entryLogger(logEntry).Warn("HTTP write failed", "error", err)
+		logEntry.Timeout = true
+	} else {
+		entryLogger(logEntry).Debug("HTTP packet sent")
+	}
+	s.writeLog <- logEntry
+}
+
+// handleWebSocket handles the messages of a WebSocket like those of a TCP connection:
+// the socket idles for the interval of each NAT test message before it is answered,
+// and the probe times out unless the client sends its next message.
+func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	s.trackConnection(conn.UnderlyingConn(), "WS")
+	defer s.untrackConnection(conn.UnderlyingConn())
+	defer conn.Close()
+	info := httpInfo(r)
+
+	var logEntry NATLogEntry
+	for {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			if logEntry.Protocol != "" && s.connectionInterrupted(conn.UnderlyingConn()) {
+				entryLogger(logEntry).Info("Waiting for WS message interrupted")
+				logEntry.Interrupted = true
+				s.writeLog <- logEntry
+			} else if logEntry.Protocol != "" {
+				entryLogger(logEntry).Info("Error reading WS connection", "error", err)
+				logEntry.Timeout = true
+				s.writeLog <- logEntry
+			} else {
+				connLogger("WS", conn.RemoteAddr()).Warn("Error reading WS connection", "error", err)
+			}
+			return
+		}
+		if logEntry.Protocol != "" {
+			// Store log from previous interval
+			s.writeLog <- logEntry
+		}
+
+		var retBuffer []byte
+		retBuffer, logEntry, err = s.HandleData(bytes.TrimSpace(message), "WS", conn.RemoteAddr(), conn.LocalAddr())
+		logEntry.HTTP = info
+		if err == errInterrupted {
+			entryLogger(logEntry).Info("WS response interrupted")
+			s.writeLog <- logEntry
+			return
+		} else if err != nil {
+			connLogger("WS", conn.RemoteAddr()).Warn("WS connection terminated", "error", err)
+			conn.WriteMessage(websocket.TextMessage, s.errorMessage(err))
+			return
+		}
+
+		err = conn.WriteMessage(websocket.TextMessage, retBuffer)
+		if err != nil {
+			entryLogger(logEntry).Warn("WS write failed, connection terminated", "error", err)
+			logEntry.Timeout = true
+			s.writeLog <- logEntry
+			return
+		}
+		entryLogger(logEntry).Debug("WS packet sent")
+	}
+}
+
+func (s *Server) acceptHTTP(l net.Listener) {
+	defer s.runningAcceptors.Done()
+	err := s.httpServer.Serve(l)
+	if !s.isStopping() {
+		s.recordAcceptorError("HTTP", l.Addr(), err)
+	}
+}
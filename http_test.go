@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+// httpListener adds an HTTP listener on a random local port
+func httpListener(t *testing.T) func(*Config) {
+	return func(config *Config) {
+		config.HTTPListeners = []net.Listener{localTCPListener(t)}
+	}
+}
+
+// httpResult is the response to a long-poll request
+type httpResult struct {
+	Status int
+	Body   string
+	Err    error
+}
+
+// postProbe sends message as long-poll request in the background
+func postProbe(ctx context.Context, server *Server, message []byte) <-chan httpResult {
+	results := make(chan httpResult, 1)
+	go func() {
+		request, _ := http.NewRequestWithContext(ctx, http.MethodPost, "http://"+server.HTTPAddr().String()+httpProbePath, bytes.NewReader(message))
+		request.Header.Set("Via", "1.1 proxy.example.com")
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			results <- httpResult{Err: err}
+			return
+		}
+		defer response.Body.Close()
+		body, err := ioutil.ReadAll(response.Body)
+		results <- httpResult{Status: response.StatusCode, Body: string(body), Err: err}
+	}()
+	return results
+}
+
+func TestHTTPLongPoll(t *testing.T) {
+	assert := assert.New(t)
+	sink := &memorySink{}
+	server, clock := newFakeClockServer(t, sink, httpListener(t))
+
+	results := postProbe(context.Background(), server, NATtestCases[0])
+	assert.True(clock.WaitForTimer(time.Second), "The server should hold the request for the interval")
+	clock.Advance(time.Second)
+	var result httpResult
+	select {
+	case result = <-results:
+	case <-time.After(replyTimeout):
+		t.Fatal("The server should answer once the interval has passed")
+	}
+	assert.NoError(result.Err, "The request should succeed")
+	assert.Equal(http.StatusOK, result.Status, "The request should succeed")
+
+	assert.Eventually(func() bool {
+		return len(sink.natLogEntries()) == 1
+	}, replyTimeout, time.Millisecond, "The probe should be logged")
+	entries := sink.natLogEntries()
+	if assert.Len(entries, 1) && assert.NotNil(entries[0].HTTP, "The HTTP request should be recorded") {
+		assert.Equal("HTTP", entries[0].Protocol, "The protocol should be logged")
+		assert.Equal(replyTraceID(result.Body), entries[0].TraceID, "The TraceID of the response should be logged")
+		assert.False(entries[0].Timeout, "The answered request should not time out")
+		assert.Equal("1.1 proxy.example.com", entries[0].HTTP.Via, "The proxy should be recorded")
+	}
+}
+
+func TestHTTPLongPollClosed(t *testing.T) {
+	assert := assert.New(t)
+	sink := &memorySink{}
+	server, clock := newFakeClockServer(t, sink, httpListener(t))
+
+	// A proxy which closes idle connections ends the request before the interval has passed
+	ctx, cancel := context.WithCancel(context.Background())
+	results := postProbe(ctx, server, NATtestCases[1])
+	assert.True(clock.WaitForTimer(2*time.Second), "The server should hold the request for the interval")
+	cancel()
+	assert.Error((<-results).Err, "The request should be canceled")
+
+	assert.Eventually(func() bool {
+		return len(sink.natLogEntries()) == 1
+	}, replyTimeout, time.Millisecond, "The probe should be logged")
+	entries := sink.natLogEntries()
+	if assert.Len(entries, 1) {
+		assert.True(entries[0].Timeout, "The closed request should time out")
+		assert.Equal(2, entries[0].Message.Interval, "The probe should be logged")
+	}
+}
+
+func TestHTTPErrors(t *testing.T) {
+	assert := assert.New(t)
+	sink := &memorySink{}
+	server, _ := newFakeClockServer(t, sink, httpListener(t))
+	url := "http://" + server.HTTPAddr().String() + httpProbePath
+
+	response, err := http.Get(url)
+	if assert.NoError(err, "The request should be answered") {
+		response.Body.Close()
+		assert.Equal(http.StatusMethodNotAllowed, response.StatusCode, "Only POST should be allowed")
+	}
+	response, err = http.Post(url, "application/json", bytes.NewReader(errorCases[0]))
+	if assert.NoError(err, "The request should be answered") {
+		body, _ := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		assert.Equal(http.StatusBadRequest, response.StatusCode, "Invalid messages should be rejected")
+		assert.Equal(string(genericErrorMessage), strings.TrimSuffix(string(body), "\n"), "The error should be explained")
+	}
+	assert.Empty(sink.natLogEntries(), "Rejected requests should not be logged")
+}
+
+func TestWebSocket(t *testing.T) {
+	assert := assert.New(t)
+	sink := &memorySink{}
+	server, clock := newFakeClockServer(t, sink, httpListener(t))
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+server.HTTPAddr().String()+httpWebSocketPath, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect to the server: %s", err)
+	}
+	var replies []string
+	for _, message := range NATtestCases[:2] {
+		assert.NoError(conn.WriteMessage(websocket.TextMessage, message), "The message should be sent")
+		interval := time.Duration(len(replies)+1) * time.Second
+		if !clock.WaitForTimer(interval) {
+			t.Fatalf("Server did not wait for the interval of %s", interval)
+		}
+		clock.Advance(interval)
+		conn.SetReadDeadline(time.Now().Add(replyTimeout))
+		_, reply, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("Server failed to answer: %s", err)
+		}
+		replies = append(replies, string(reply))
+	}
+	conn.Close()
+
+	assert.Eventually(func() bool {
+		return len(sink.natLogEntries()) == len(replies)
+	}, replyTimeout, time.Millisecond, "All WebSocket probes should be logged")
+	entries := sink.natLogEntries()
+	assertNATLogEntries(t, entries, "WS", replies)
+	for _, entry := range entries {
+		assert.NotNil(entry.HTTP, "The HTTP request should be recorded")
+	}
+}
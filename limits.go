@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// pendingProbeMap counts the probes per remote IP address which are waiting for their delayed response
+type pendingProbeMap struct {
+	Map map[string]int
+	Mux sync.Mutex
+}
+
+// rejectionCounters counts the messages and connections turned away because a limit was hit
+type rejectionCounters struct {
+	IntervalTooLarge int64
+	TooManyPending   int64
+	ServerBusy       int64
+}
+
+const defaultMaxInterval = 3 * 60 * 60
+const defaultMaxPendingPerAddress = 4
+const defaultMaxHandlers = 10000
+
+var errIntervalTooLarge = errors.New("Requested interval exceeds the maximum")
+var errTooManyPending = errors.New("Too many pending probes for this address")
+var errServerBusy = errors.New("Server busy")
+
+// checkInterval rejects intervals above the configured maximum
+func (s *Server) checkInterval(interval int) error {
+	if interval > s.config.MaxInterval {
+		atomic.AddInt64(&s.rejections.IntervalTooLarge, 1)
+		return errIntervalTooLarge
+	}
+	return nil
+}
+
+// pendingProbeKey returns the IP address of addr, the limit of pending probes applies to it regardless of the port,
+// because a device behind a NAT gets a new port for each probe
+func pendingProbeKey(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// acquirePendingProbe registers a probe from the IP address of addr, which must be released with releasePendingProbe once the response has been sent
+func (s *Server) acquirePendingProbe(addr string) error {
+	key := pendingProbeKey(addr)
+	s.pendingProbes.Mux.Lock()
+	defer s.pendingProbes.Mux.Unlock()
+	if s.pendingProbes.Map[key] >= s.config.MaxPendingPerAddress {
+		atomic.AddInt64(&s.rejections.TooManyPending, 1)
+		return errTooManyPending
+	}
+	s.pendingProbes.Map[key]++
+	return nil
+}
+
+func (s *Server) releasePendingProbe(addr string) {
+	key := pendingProbeKey(addr)
+	s.pendingProbes.Mux.Lock()
+	defer s.pendingProbes.Mux.Unlock()
+	s.pendingProbes.Map[key]--
+	if s.pendingProbes.Map[key] <= 0 {
+		delete(s.pendingProbes.Map, key)
+	}
+}
+
+// acquireHandler reserves a slot for a new handler without blocking, it returns errServerBusy if all slots are taken
+func (s *Server) acquireHandler() error {
+	select {
+	case s.handlerSlots <- struct{}{}:
+		s.runningHandlers.Add(1)
+		return nil
+	default:
+		atomic.AddInt64(&s.rejections.ServerBusy, 1)
+		return errServerBusy
+	}
+}
+
+func (s *Server) releaseHandler() {
+	<-s.handlerSlots
+	s.runningHandlers.Done()
+}
+
+// errorMessage returns the message sent to a client whose request failed with err
+func (s *Server) errorMessage(err error) []byte {
+	switch err {
+	case errIntervalTooLarge:
+		return []byte(fmt.Sprintf("%s of %d seconds.\nConnection closed.\nVersion: %s\n", err.Error(), s.config.MaxInterval, version))
+	case errTooManyPending, errServerBusy:
+		return []byte(fmt.Sprintf("%s.\nConnection closed.\nVersion: %s\n", err.Error(), version))
+	}
+	return genericErrorMessage
+}
+
+// logRejection logs why a client was rejected together with the current rejection counters
+func (s *Server) logRejection(err error, addr string) {
+	slog.Warn("Client rejected", "remote", addr, "error", err,
+		"intervalRejections", atomic.LoadInt64(&s.rejections.IntervalTooLarge),
+		"pendingRejections", atomic.LoadInt64(&s.rejections.TooManyPending),
+		"busyRejections", atomic.LoadInt64(&s.rejections.ServerBusy),
+	)
+}
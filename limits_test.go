@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIntervalTooLarge(t *testing.T) {
+	assert := assert.New(t)
+
+	message := []byte(fmt.Sprintf("{\"op\":\"24201\",\"ip\":[\"%s\"],\"cell_id\":21229824,\"ue_mode\":2,\"lte_mode\":1,\"nbiot_mode\":1,\"iccid\":\"8931089318104314834F\",\"imei\":\"352656100367872\",\"interval\":%d}", testIPv4, testServer.config.MaxInterval+1))
+	_, _, err := testServer.HandleData(message, "UDP", testRemoteAddr, testLocalAddr)
+	assert.Equal(errIntervalTooLarge, err, "An interval above the maximum should be rejected")
+	assert.NotEqual(genericErrorMessage, testServer.errorMessage(err), "The client should be told why it was rejected")
+}
+
+func TestPendingProbeLimit(t *testing.T) {
+	assert := assert.New(t)
+	addr := "192.0.2.1:1234"
+
+	for i := 0; i < testServer.config.MaxPendingPerAddress; i++ {
+		assert.NoError(testServer.acquirePendingProbe(addr), "Probes up to the limit should be accepted")
+	}
+	assert.Equal(errTooManyPending, testServer.acquirePendingProbe(addr), "Probes above the limit should be rejected")
+	assert.Equal(errTooManyPending, testServer.acquirePendingProbe("192.0.2.1:1235"), "A new port behind the same NAT should not evade the limit")
+	assert.NoError(testServer.acquirePendingProbe("192.0.2.2:1234"), "Other addresses should not be affected")
+	assert.NoError(testServer.acquirePendingProbe("[2001:db8::1]:1234"), "IPv6 addresses should be limited by their address too")
+
+	testServer.releasePendingProbe("192.0.2.1:1235")
+	assert.NoError(testServer.acquirePendingProbe(addr), "A released probe should free a slot of the address")
+
+	for i := 0; i < testServer.config.MaxPendingPerAddress; i++ {
+		testServer.releasePendingProbe(addr)
+	}
+	testServer.releasePendingProbe("192.0.2.2:1234")
+	testServer.releasePendingProbe("[2001:db8::1]:1234")
+	assert.Empty(testServer.pendingProbes.Map, "Addresses without pending probes should be removed")
+}
+
+func TestEmptyUDPDatagram(t *testing.T) {
+	assert := assert.New(t)
+	server, clock := newFakeClockServer(t, &memorySink{})
+	conn := dialUDP(t, server)
+	defer conn.Close()
+
+	_, err := conn.Write([]byte{})
+	assert.NoError(err, "The empty datagram should be sent")
+	assert.NotEmpty(replyTraceID(probe(t, clock, conn, NATtestCases[0])), "The server should still answer probes")
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/pion/dtls/v3"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Listener modes, they decide which address families the server listens on
+const (
+	// ipModeSystem listens on ":port" and leaves the address families to the host's defaults
+	ipModeSystem = "system"
+	ipModeIPv4   = "ipv4"
+	ipModeIPv6   = "ipv6"
+	// ipModeDual opens separate IPv4 and IPv6 sockets, so it does not depend on the host's IPv4-mapped address defaults
+	ipModeDual = "dual"
+)
+
+const familyIPv4 = "IPv4"
+const familyIPv6 = "IPv6"
+
+var errUnknownIPMode = errors.New("Unknown listener mode, use system, ipv4, ipv6 or dual")
+
+// listenAddr is a network and wildcard host to listen on
+type listenAddr struct {
+	Network string
+	Host    string
+}
+
+// listenAddrs returns where to listen for protocol "udp" or "tcp" in mode
+func listenAddrs(protocol string, mode string) ([]listenAddr, error) {
+	switch mode {
+	case ipModeSystem:
+		return []listenAddr{{protocol, ""}}, nil
+	case ipModeIPv4:
+		return []listenAddr{{protocol + "4", "0.0.0.0"}}, nil
+	case ipModeIPv6:
+		return []listenAddr{{protocol + "6", "::"}}, nil
+	case ipModeDual:
+		return []listenAddr{{protocol + "4", "0.0.0.0"}, {protocol + "6", "::"}}, nil
+	}
+	return nil, errUnknownIPMode
+}
+
+// udpListener receives UDP messages together with the local address each one was sent to,
+// which is not known from the socket alone if it is bound to a wildcard address.
+type udpListener struct {
+	Conn net.PacketConn
+	pc4  *ipv4.PacketConn
+	pc6  *ipv6.PacketConn
+}
+
+func newUDPListener(conn net.PacketConn) *udpListener {
+	l := &udpListener{Conn: conn}
+	addr, ok := conn.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		return l
+	}
+	// Without control messages the address of the socket is logged instead
+	if addr.IP.To4() != nil {
+		pc := ipv4.NewPacketConn(conn)
+		if pc.SetControlMessage(ipv4.FlagDst, true) == nil {
+			l.pc4 = pc
+		}
+	} else {
+		pc := ipv6.NewPacketConn(conn)
+		if pc.SetControlMessage(ipv6.FlagDst, true) == nil {
+			l.pc6 = pc
+		}
+	}
+	return l
+}
+
+// ReadFrom reads a message into buffer and returns the addresses it was sent from and to
+func (l *udpListener) ReadFrom(buffer []byte) (n int, remote net.Addr, local net.Addr, err error) {
+	local = l.Conn.LocalAddr()
+	var dst net.IP
+	switch {
+	case l.pc4 != nil:
+		var cm *ipv4.ControlMessage
+		n, cm, remote, err = l.pc4.ReadFrom(buffer)
+		if cm != nil {
+			dst = cm.Dst
+		}
+	case l.pc6 != nil:
+		var cm *ipv6.ControlMessage
+		n, cm, remote, err = l.pc6.ReadFrom(buffer)
+		if cm != nil {
+			dst = cm.Dst
+		}
+	default:
+		n, remote, err = l.Conn.ReadFrom(buffer)
+	}
+	if dst != nil {
+		local = &net.UDPAddr{IP: dst, Port: localPort(local)}
+	}
+	return n, remote, local, err
+}
+
+// listen opens the listeners which have not been handed in through the config
+func (s *Server) listen() error {
+	udpAddrs, err := listenAddrs("udp", s.config.IPMode)
+	if err != nil {
+		return err
+	}
+	tcpAddrs, err := listenAddrs("tcp", s.config.IPMode)
+	if err != nil {
+		return err
+	}
+
+	s.udpListeners, err = listenUDP(udpAddrs, s.config.UDPPorts, s.config.UDPConns)
+	if err != nil {
+		return err
+	}
+
+	s.tcpListeners = s.config.TCPListeners
+	if len(s.tcpListeners) == 0 {
+		s.tcpListeners, err = listenTCP(tcpAddrs, s.config.TCPPorts)
+		if err != nil {
+			return err
+		}
+	}
+
+	s.tlsListeners = s.config.TLSListeners
+	if len(s.tlsListeners) == 0 {
+		s.tlsListeners, err = listenTCP(tcpAddrs, s.config.TLSPorts)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, port := range s.config.DTLSPorts {
+		for _, a := range udpAddrs {
+			l, err := dtls.Listen(a.Network, &net.UDPAddr{IP: net.ParseIP(a.Host), Port: port}, s.config.DTLSConfig)
+			if err != nil {
+				return err
+			}
+			s.dtlsListeners = append(s.dtlsListeners, l)
+		}
+	}
+
+	s.mqttListeners = s.config.MQTTListeners
+	if len(s.mqttListeners) == 0 {
+		s.mqttListeners, err = listenTCP(tcpAddrs, s.config.MQTTPorts)
+		if err != nil {
+			return err
+		}
+	}
+
+	s.httpListeners = s.config.HTTPListeners
+	if len(s.httpListeners) == 0 {
+		s.httpListeners, err = listenTCP(tcpAddrs, s.config.HTTPPorts)
+		if err != nil {
+			return err
+		}
+	}
+
+	s.coapListeners, err = listenUDP(udpAddrs, s.config.CoAPPorts, s.config.CoAPConns)
+	if err != nil {
+		return err
+	}
+
+	quicConns, err := listenPackets(udpAddrs, s.config.QUICPorts, s.config.QUICConns)
+	if err != nil {
+		return err
+	}
+	s.quicListeners, err = s.listenQUIC(quicConns)
+	if err != nil {
+		return err
+	}
+
+	if s.config.MonitoringListener != nil {
+		s.monitoringListeners = []net.Listener{s.config.MonitoringListener}
+	} else if len(s.config.MonitoringAddr) > 0 {
+		l, err := net.Listen("tcp", s.config.MonitoringAddr)
+		if err != nil {
+			return err
+		}
+		s.monitoringListeners = []net.Listener{l}
+	}
+
+	if s.config.ATListener != nil {
+		s.atListeners = []net.Listener{s.config.ATListener}
+	} else {
+		s.atListeners, err = listenTCP(tcpAddrs, []int{s.config.ATPort})
+	}
+	return err
+}
+
+// listenUDP opens a listener for every port on each of addrs, unless conns are handed in
+func listenUDP(addrs []listenAddr, ports []int, conns []net.PacketConn) ([]*udpListener, error) {
+	conns, err := listenPackets(addrs, ports, conns)
+	if err != nil {
+		return nil, err
+	}
+	var listeners []*udpListener
+	for _, conn := range conns {
+		listeners = append(listeners, newUDPListener(conn))
+	}
+	return listeners, nil
+}
+
+// listenPackets opens a UDP socket for every port on each of addrs, unless conns are handed in
+func listenPackets(addrs []listenAddr, ports []int, conns []net.PacketConn) ([]net.PacketConn, error) {
+	if len(conns) > 0 {
+		return conns, nil
+	}
+	for _, port := range ports {
+		for _, a := range addrs {
+			conn, err := net.ListenPacket(a.Network, net.JoinHostPort(a.Host, strconv.Itoa(port)))
+			if err != nil {
+				for _, c := range conns {
+					c.Close()
+				}
+				return nil, err
+			}
+			conns = append(conns, conn)
+		}
+	}
+	return conns, nil
+}
+
+// listenTCP opens a listener for every port on each of addrs
+func listenTCP(addrs []listenAddr, ports []int) ([]net.Listener, error) {
+	var listeners []net.Listener
+	for _, port := range ports {
+		for _, a := range addrs {
+			l, err := net.Listen(a.Network, net.JoinHostPort(a.Host, strconv.Itoa(port)))
+			if err != nil {
+				closeAll(listeners)
+				return nil, err
+			}
+			listeners = append(listeners, l)
+		}
+	}
+	return listeners, nil
+}
+
+func closeAll(listeners []net.Listener) {
+	for _, l := range listeners {
+		l.Close()
+	}
+}
+
+func closeUDP(listeners []*udpListener) {
+	for _, l := range listeners {
+		l.Conn.Close()
+	}
+}
+
+// closeListeners closes all listeners, so no new messages are received
+func (s *Server) closeListeners() {
+	closeUDP(s.udpListeners)
+	closeUDP(s.coapListeners)
+	closeAll(s.tcpListeners)
+	closeAll(s.tlsListeners)
+	closeAll(s.dtlsListeners)
+	closeAll(s.mqttListeners)
+	closeAll(s.httpListeners)
+	closeAll(s.quicListeners)
+	closeAll(s.atListeners)
+}
+
+// UDPAddrs returns the addresses the server receives UDP NAT test messages on
+func (s *Server) UDPAddrs() []net.Addr {
+	return udpListenerAddrs(s.udpListeners)
+}
+
+// TCPAddrs returns the addresses the server receives TCP NAT test messages on
+func (s *Server) TCPAddrs() []net.Addr {
+	return listenerAddrs(s.tcpListeners)
+}
+
+// TLSAddrs returns the addresses the server receives TLS NAT test messages on
+func (s *Server) TLSAddrs() []net.Addr {
+	return listenerAddrs(s.tlsListeners)
+}
+
+// DTLSAddrs returns the addresses the server receives DTLS NAT test messages on
+func (s *Server) DTLSAddrs() []net.Addr {
+	return listenerAddrs(s.dtlsListeners)
+}
+
+// CoAPAddrs returns the addresses the server receives CoAP NAT test messages on
+func (s *Server) CoAPAddrs() []net.Addr {
+	return udpListenerAddrs(s.coapListeners)
+}
+
+// MQTTAddrs returns the addresses the server receives MQTT connections on
+func (s *Server) MQTTAddrs() []net.Addr {
+	return listenerAddrs(s.mqttListeners)
+}
+
+// HTTPAddrs returns the addresses the server receives long-poll and WebSocket NAT test messages on
+func (s *Server) HTTPAddrs() []net.Addr {
+	return listenerAddrs(s.httpListeners)
+}
+
+// QUICAddrs returns the addresses the server receives QUIC NAT test messages on
+func (s *Server) QUICAddrs() []net.Addr {
+	return listenerAddrs(s.quicListeners)
+}
+
+// ATAddrs returns the addresses the server receives AT command messages on
+func (s *Server) ATAddrs() []net.Addr {
+	return listenerAddrs(s.atListeners)
+}
+
+// MonitoringAddr returns the address the metrics are served on
+func (s *Server) MonitoringAddr() net.Addr {
+	return s.monitoringListeners[0].Addr()
+}
+
+// UDPAddr returns the address of the first UDP listener
+func (s *Server) UDPAddr() net.Addr {
+	return s.udpListeners[0].Conn.LocalAddr()
+}
+
+// TCPAddr returns the address of the first TCP listener
+func (s *Server) TCPAddr() net.Addr {
+	return s.tcpListeners[0].Addr()
+}
+
+// TLSAddr returns the address of the first TLS listener
+func (s *Server) TLSAddr() net.Addr {
+	return s.tlsListeners[0].Addr()
+}
+
+// DTLSAddr returns the address of the first DTLS listener
+func (s *Server) DTLSAddr() net.Addr {
+	return s.dtlsListeners[0].Addr()
+}
+
+// CoAPAddr returns the address of the first CoAP listener
+func (s *Server) CoAPAddr() net.Addr {
+	return s.coapListeners[0].Conn.LocalAddr()
+}
+
+// MQTTAddr returns the address of the first MQTT listener
+func (s *Server) MQTTAddr() net.Addr {
+	return s.mqttListeners[0].Addr()
+}
+
+// HTTPAddr returns the address of the first HTTP listener
+func (s *Server) HTTPAddr() net.Addr {
+	return s.httpListeners[0].Addr()
+}
+
+// QUICAddr returns the address of the first QUIC listener
+func (s *Server) QUICAddr() net.Addr {
+	return s.quicListeners[0].Addr()
+}
+
+// ATAddr returns the address of the first AT command listener
+func (s *Server) ATAddr() net.Addr {
+	return s.atListeners[0].Addr()
+}
+
+func udpListenerAddrs(listeners []*udpListener) []net.Addr {
+	addrs := make([]net.Addr, 0, len(listeners))
+	for _, l := range listeners {
+		addrs = append(addrs, l.Conn.LocalAddr())
+	}
+	return addrs
+}
+
+func listenerAddrs(listeners []net.Listener) []net.Addr {
+	addrs := make([]net.Addr, 0, len(listeners))
+	for _, l := range listeners {
+		addrs = append(addrs, l.Addr())
+	}
+	return addrs
+}
+
+// localPort returns the port of a UDP or TCP address, or 0 for other addresses
+func localPort(addr net.Addr) int {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.Port
+	case *net.TCPAddr:
+		return a.Port
+	}
+	return 0
+}
+
+// addressFamily returns whether addr is an IPv4 or IPv6 address, IPv4-mapped IPv6 addresses count as IPv4
+func addressFamily(addr net.Addr) string {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		ip = a.IP
+	case *net.TCPAddr:
+		ip = a.IP
+	}
+	if ip.To4() != nil {
+		return familyIPv4
+	} else if ip != nil {
+		return familyIPv6
+	}
+	return ""
+}
+
+// joinAddrs returns the addresses separated by commas
+func joinAddrs(addrs []net.Addr) string {
+	return strings.Join(addrStrings(addrs), ", ")
+}
+
+// addrStrings returns the addresses as strings
+func addrStrings(addrs []net.Addr) []string {
+	s := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		s = append(s, addr.String())
+	}
+	return s
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// ipv6Available returns whether the host can send messages over IPv6 loopback
+func ipv6Available() bool {
+	conn, err := net.ListenPacket("udp6", "[::1]:0")
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// ipMode makes the server open its own listeners in mode on random ports
+func ipMode(mode string) func(*Config) {
+	return func(config *Config) {
+		config.IPMode = mode
+		config.UDPPorts = []int{0}
+		config.TCPPorts = []int{0}
+		config.ATPort = 0
+	}
+}
+
+// assertUDPAddressFamily probes the server's UDP listener of family through host and checks the recorded addresses
+func assertUDPAddressFamily(t *testing.T, mode string, family string, host string) {
+	assert := assert.New(t)
+	sink := &memorySink{}
+	server, clock := newFakeClockServer(t, sink, ipMode(mode))
+
+	var port int
+	for _, addr := range server.UDPAddrs() {
+		if addressFamily(addr) == family {
+			port = localPort(addr)
+		}
+	}
+	if !assert.NotZero(port, "The server should listen on %s", family) {
+		return
+	}
+	local := net.JoinHostPort(host, strconv.Itoa(port))
+	conn, err := net.Dial("udp", local)
+	if err != nil {
+		t.Fatalf("Failed to connect to the server: %s", err)
+	}
+	defer conn.Close()
+
+	probe(t, clock, conn, NATtestCases[1])
+	// The lower interval makes the server record the first probe
+	probe(t, clock, conn, NATtestCases[0])
+
+	assert.Eventually(func() bool {
+		return len(sink.natLogEntries()) == 1
+	}, replyTimeout, time.Millisecond, "The first probe should be logged")
+	entries := sink.natLogEntries()
+	if assert.Len(entries, 1) {
+		assert.Equal(family, entries[0].AddressFamily, "The address family should be recorded")
+		assert.Equal(local, entries[0].LocalAddr, "The address the message was sent to should be recorded")
+		assert.Equal(conn.LocalAddr().String(), entries[0].IP, "The client address should be recorded")
+		assert.Equal(port, entries[0].LocalPort, "The local port should be recorded")
+	}
+}
+
+func TestListenAddrs(t *testing.T) {
+	assert := assert.New(t)
+
+	addrs, err := listenAddrs("udp", ipModeSystem)
+	assert.NoError(err)
+	assert.Equal([]listenAddr{{"udp", ""}}, addrs, "The system mode should listen on all addresses of the host's default families")
+
+	addrs, err = listenAddrs("tcp", ipModeIPv4)
+	assert.NoError(err)
+	assert.Equal([]listenAddr{{"tcp4", "0.0.0.0"}}, addrs, "The IPv4 mode should only listen on IPv4")
+
+	addrs, err = listenAddrs("udp", ipModeIPv6)
+	assert.NoError(err)
+	assert.Equal([]listenAddr{{"udp6", "::"}}, addrs, "The IPv6 mode should only listen on IPv6")
+
+	addrs, err = listenAddrs("tcp", ipModeDual)
+	assert.NoError(err)
+	assert.Equal([]listenAddr{{"tcp4", "0.0.0.0"}, {"tcp6", "::"}}, addrs, "The dual mode should open a socket per family")
+
+	_, err = listenAddrs("udp", "ipv5")
+	assert.Equal(errUnknownIPMode, err, "Unknown modes should be rejected")
+}
+
+func TestAddressFamily(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal(familyIPv4, addressFamily(&net.UDPAddr{IP: net.ParseIP("192.0.2.1")}))
+	assert.Equal(familyIPv4, addressFamily(&net.TCPAddr{IP: net.ParseIP("::ffff:192.0.2.1")}), "IPv4-mapped addresses should count as IPv4")
+	assert.Equal(familyIPv6, addressFamily(&net.UDPAddr{IP: net.ParseIP("2001:db8::1")}))
+	assert.Equal("", addressFamily(&net.UnixAddr{Name: "socket"}), "Other addresses have no IP address family")
+}
+
+func TestIPv4Mode(t *testing.T) {
+	assertUDPAddressFamily(t, ipModeIPv4, familyIPv4, "127.0.0.1")
+}
+
+func TestIPv6Mode(t *testing.T) {
+	if !ipv6Available() {
+		t.Skip("IPv6 is not available")
+	}
+	assertUDPAddressFamily(t, ipModeIPv6, familyIPv6, "::1")
+}
+
+func TestDualMode(t *testing.T) {
+	if !ipv6Available() {
+		t.Skip("IPv6 is not available")
+	}
+	assertUDPAddressFamily(t, ipModeDual, familyIPv4, "127.0.0.1")
+	assertUDPAddressFamily(t, ipModeDual, familyIPv6, "::1")
+
+	server, _ := newFakeClockServer(t, &memorySink{}, ipMode(ipModeDual))
+	assert.Len(t, server.TCPAddrs(), 2, "The dual mode should open a TCP listener per family")
+	assert.Len(t, server.ATAddrs(), 2, "The dual mode should open an AT command listener per family")
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+)
+
+// Formats of the operational logs, text writes logfmt
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+const defaultLogLevel = "info"
+
+var errUnknownLogFormat = errors.New("Unknown log format, use text or json")
+var errUnknownLogLevel = errors.New("Unknown log level, use debug, info, warn or error")
+
+// newLogger returns a logger which writes the lines of at least level to w in format.
+// Per-packet lines are logged at debug level.
+func newLogger(w io.Writer, format string, level string) (*slog.Logger, error) {
+	var l slog.Level
+	if l.UnmarshalText([]byte(level)) != nil {
+		return nil, errUnknownLogLevel
+	}
+	options := &slog.HandlerOptions{
+		Level: l,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			// Do not prefix with date, this is handled by the operating system
+			if len(groups) == 0 && a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	}
+	switch strings.ToLower(format) {
+	case logFormatText:
+		return slog.New(slog.NewTextHandler(w, options)), nil
+	case logFormatJSON:
+		return slog.New(slog.NewJSONHandler(w, options)), nil
+	}
+	return nil, errUnknownLogFormat
+}
+
+// entryLogger returns the logger for lines about the message of e,
+// they carry its trace ID, protocol, remote address, IMEI and interval
+func entryLogger(e NATLogEntry) *slog.Logger {
+	return slog.With("traceID", e.TraceID, "protocol", e.Protocol, "remote", e.IP, "imei", e.Message.IMEI, "interval", e.Message.Interval)
+}
+
+// connLogger returns the logger for lines about a connection or packet from remote before its message is known
+func connLogger(protocol string, remote net.Addr) *slog.Logger {
+	return slog.With("protocol", protocol, "remote", remote.String())
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewLogger(t *testing.T) {
+	assert := assert.New(t)
+
+	var buffer bytes.Buffer
+	logger, err := newLogger(&buffer, logFormatText, defaultLogLevel)
+	if err != nil {
+		t.Fatalf("Failed to create logger: %s", err)
+	}
+	logger.Debug("UDP packet sent")
+	assert.Empty(buffer.String(), "Debug lines should be dropped at info level")
+	logger.Info("Probe timed out", "protocol", "UDP")
+	assert.Equal("level=INFO msg=\"Probe timed out\" protocol=UDP\n", buffer.String(), "Text lines should be logfmt without a date")
+
+	buffer.Reset()
+	logger, err = newLogger(&buffer, "JSON", "debug")
+	if err != nil {
+		t.Fatalf("Failed to create logger: %s", err)
+	}
+	logger.Debug("UDP packet sent")
+	var line map[string]interface{}
+	assert.NoError(json.Unmarshal(buffer.Bytes(), &line), "JSON lines should be valid JSON")
+	assert.Equal("DEBUG", line["level"], "Debug lines should be written at debug level")
+	assert.NotContains(line, slog.TimeKey, "Lines should not contain a date")
+
+	_, err = newLogger(&buffer, "xml", defaultLogLevel)
+	assert.Equal(errUnknownLogFormat, err, "Unknown formats should be rejected")
+	_, err = newLogger(&buffer, logFormatText, "verbose")
+	assert.Equal(errUnknownLogLevel, err, "Unknown levels should be rejected")
+}
+
+func TestEntryLogger(t *testing.T) {
+	assert := assert.New(t)
+	var buffer bytes.Buffer
+	logger, _ := newLogger(&buffer, logFormatJSON, "debug")
+	defaultLogger := slog.Default()
+	slog.SetDefault(logger)
+	defer slog.SetDefault(defaultLogger)
+
+	entry := NATLogEntry{TraceID: "trace", Protocol: "UDP", IP: "192.0.2.1:3050"}
+	entry.Message.IMEI = "352656100367872"
+	entry.Message.Interval = 60
+	entryLogger(entry).Info("No UDP message within the UDP timeout")
+	connLogger("TCP", &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 1234}).Warn("Error reading TCP connection")
+
+	lines := strings.Split(strings.TrimSpace(buffer.String()), "\n")
+	if !assert.Len(lines, 2) {
+		return
+	}
+	var line map[string]interface{}
+	assert.NoError(json.Unmarshal([]byte(lines[0]), &line))
+	assert.Equal("trace", line["traceID"])
+	assert.Equal("UDP", line["protocol"])
+	assert.Equal("192.0.2.1:3050", line["remote"])
+	assert.Equal("352656100367872", line["imei"])
+	assert.Equal(float64(60), line["interval"])
+
+	line = nil
+	assert.NoError(json.Unmarshal([]byte(lines[1]), &line))
+	assert.Equal("TCP", line["protocol"])
+	assert.Equal("192.0.2.2:1234", line["remote"])
+}
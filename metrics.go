@@ -0,0 +1,128 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metricsPath serves the Prometheus metrics on the monitoring listener, next to the health checks
+const metricsPath = "/metrics"
+
+// intervalBuckets are the histogram buckets of the requested intervals in seconds, from seconds up to the default maximum of three hours
+var intervalBuckets = []float64{1, 5, 10, 30, 60, 120, 300, 600, 1200, 1800, 3600, 7200, 10800}
+
+// metrics are the Prometheus collectors of a server, every server has its own registry
+type metrics struct {
+	registry          *prometheus.Registry
+	messagesReceived  *prometheus.CounterVec
+	schemaFailures    *prometheus.CounterVec
+	timeouts          *prometheus.CounterVec
+	intervals         prometheus.Histogram
+	logQueueLength    prometheus.GaugeFunc
+	uploadDuration    prometheus.Histogram
+	uploadFailures    prometheus.CounterFunc
+	pendingUDPClients prometheus.GaugeFunc
+}
+
+// newMetrics creates and registers the collectors of s
+func newMetrics(s *Server) *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		messagesReceived: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "nat_messages_received_total",
+			Help: "Messages received per protocol, AT command messages have the protocol AT.",
+		}, []string{"protocol"}),
+		schemaFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "nat_schema_validation_failures_total",
+			Help: "Messages which failed the validation against the NAT or AT JSON schema.",
+		}, []string{"schema"}),
+		timeouts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "nat_timeouts_total",
+			Help: "Probes recorded as timed out per protocol.",
+		}, []string{"protocol"}),
+		intervals: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "nat_requested_interval_seconds",
+			Help:    "Intervals requested by valid NAT test messages.",
+			Buckets: intervalBuckets,
+		}),
+		logQueueLength: prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "nat_log_queue_length",
+			Help: "Log entries handed to the sink which are not saved yet.",
+		}, func() float64 {
+			return float64(atomic.LoadInt64(&s.logBacklog))
+		}),
+		uploadDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "nat_upload_duration_seconds",
+			Help:    "Time the sink took to save a log entry.",
+			Buckets: prometheus.DefBuckets,
+		}),
+		uploadFailures: prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "nat_upload_failures_total",
+			Help: "Log entries the sink failed to save.",
+		}, func() float64 {
+			return float64(atomic.LoadInt64(&s.uploadFailures))
+		}),
+		pendingUDPClients: prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "nat_pending_udp_sessions",
+			Help: "UDP clients which received their response and are expected to follow up.",
+		}, func() float64 {
+			s.updClientTimeouts.Mux.Lock()
+			defer s.updClientTimeouts.Mux.Unlock()
+			return float64(len(s.updClientTimeouts.Map))
+		}),
+	}
+	m.registry.MustRegister(m.messagesReceived, m.schemaFailures, m.timeouts, m.intervals,
+		m.logQueueLength, m.uploadDuration, m.uploadFailures, m.pendingUDPClients)
+	return m
+}
+
+// observeQueued records a log entry handed to the sink
+func (m *metrics) observeQueued(entry logEntry) {
+	if e, ok := entry.(NATLogEntry); ok && e.Timeout {
+		m.timeouts.WithLabelValues(e.Protocol).Inc()
+	}
+}
+
+// observeSaved records a log entry the sink took d to save, or failed to save
+func (m *metrics) observeSaved(d time.Duration) {
+	m.uploadDuration.Observe(d.Seconds())
+}
+
+// newMonitoringServer returns the server for the monitoring endpoints
+func (s *Server) newMonitoringServer() *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle(metricsPath, promhttp.HandlerFor(s.metrics.registry, promhttp.HandlerOpts{}))
+	mux.HandleFunc(healthPath, s.handleHealth)
+	mux.HandleFunc(readyPath, s.handleReady)
+	if len(s.config.AdminToken) > 0 {
+		mux.HandleFunc("GET "+adminSessionsPath, s.requireAdminToken(s.handleAdminSessions))
+		mux.HandleFunc("GET "+adminSessionsPath+"/{id}", s.requireAdminToken(s.handleAdminSession))
+		mux.HandleFunc("DELETE "+adminSessionsPath+"/{id}", s.requireAdminToken(s.handleEndAdminSession))
+		mux.HandleFunc("GET "+eventsPath, s.requireAdminToken(s.handleEvents))
+		mux.HandleFunc("GET "+estimatesPath, s.requireAdminToken(s.handleEstimates))
+	}
+	return &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: handshakeTimeout,
+		ErrorLog:          log.New(ioutil.Discard, "", 0),
+	}
+}
+
+// serveMonitoring serves the monitoring endpoints on l until closeMonitoring is called
+func (s *Server) serveMonitoring(l net.Listener) {
+	s.monitoringServer.Serve(l)
+}
+
+// closeMonitoring stops serving the monitoring endpoints once the server has shut down
+func (s *Server) closeMonitoring() {
+	if s.monitoringServer != nil {
+		s.monitoringServer.Close()
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// scrapeMetrics returns the metrics the server serves
+func scrapeMetrics(t *testing.T, server *Server) string {
+	response, err := http.Get("http://" + server.MonitoringAddr().String() + metricsPath)
+	if err != nil {
+		t.Fatalf("Failed to get the metrics: %s", err)
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		t.Fatalf("Failed to read the metrics: %s", err)
+	}
+	return string(body)
+}
+
+func TestMetrics(t *testing.T) {
+	assert := assert.New(t)
+	clock := newFakeClock()
+	config := defaultConfig()
+	config.Sink = &memorySink{}
+	config.Clock = clock
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	config.MonitoringListener = l
+	server, err := newTestServer(config)
+	if err != nil {
+		t.Fatalf("Failed to start server: %s", err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		assert.NoError(server.Shutdown(ctx), "The server should shut down")
+	}()
+
+	conn := dialUDP(t, server)
+	defer conn.Close()
+	probe(t, clock, conn, NATtestCases[0])
+	conn.Write(errorCases[0])
+	conn.SetReadDeadline(time.Now().Add(replyTimeout))
+	_, err = conn.Read(make([]byte, 256))
+	assert.NoError(err, "The invalid message should be answered")
+
+	metrics := scrapeMetrics(t, server)
+	assert.Contains(metrics, `nat_messages_received_total{protocol="UDP"} 2`, "Both messages should be counted")
+	assert.Contains(metrics, `nat_schema_validation_failures_total{schema="nat"} 1`, "The invalid message should be counted")
+	assert.Contains(metrics, `nat_requested_interval_seconds_count 1`, "The interval of the valid message should be observed")
+	assert.Contains(metrics, "nat_pending_udp_sessions 1", "The client should be expected to follow up")
+
+	assert.True(clock.WaitForTimer(server.config.UDPTimeout), "The server should wait for the next message")
+	clock.Advance(server.config.UDPTimeout)
+	assert.Eventually(func() bool {
+		return len(server.config.Sink.(*memorySink).natLogEntries()) == 1
+	}, replyTimeout, time.Millisecond, "The probe should be logged")
+	metrics = scrapeMetrics(t, server)
+	assert.Contains(metrics, `nat_timeouts_total{protocol="UDP"} 1`, "The timeout should be counted")
+	assert.Contains(metrics, "nat_upload_duration_seconds_count 1", "The upload should be observed")
+	assert.Contains(metrics, "nat_pending_udp_sessions 0", "No client should be expected to follow up")
+}
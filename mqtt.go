@@ -0,0 +1,553 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// MQTT 3.1.1 control packet types
+const (
+	mqttConnect     = 1
+	mqttConnAck     = 2
+	mqttPublish     = 3
+	mqttPubAck      = 4
+	mqttSubscribe   = 8
+	mqttSubAck      = 9
+	mqttUnsubscribe = 10
+	mqttUnsubAck    = 11
+	mqttPingReq     = 12
+	mqttPingResp    = 13
+	mqttDisconnect  = 14
+)
+
+// Return codes of a CONNACK
+const (
+	mqttAccepted              = 0
+	mqttUnacceptableProtocol  = 1
+	mqttServerUnavailable     = 3
+	mqttBadUserNameOrPassword = 4
+)
+
+// mqttProtocolLevel is the protocol level of MQTT 3.1.1
+const mqttProtocolLevel = 4
+
+// mqttProbeTopic is the topic clients publish NAT test messages to after the first one sent in CONNECT,
+// the delayed responses are published to mqttReplyTopic
+const mqttProbeTopic = "nat/probe"
+const mqttReplyTopic = "nat/reply"
+
+// mqttMaxPacketSize is the largest packet the server reads
+const mqttMaxPacketSize = 4096
+
+// mqttAckTimeout is how long a client may take to acknowledge a delayed response
+const mqttAckTimeout = 60 * time.Second
+
+const defaultMQTTKeepAlivePercent = 150
+
+var errMQTTFormat = errors.New("Malformed MQTT packet")
+var errMQTTProtocol = errors.New("Unsupported MQTT protocol version")
+
+// MQTTInfo describes the MQTT connection a NAT test message was received on
+type MQTTInfo struct {
+	ClientID string
+	// KeepAlive is the keep alive interval the client asked for in seconds
+	KeepAlive int
+	// Stretched is true if the interval of the probe is longer than the keep alive interval
+	Stretched bool `json:",omitempty"`
+	// Pings is the number of PINGREQ packets the client sent while the probe was pending
+	Pings int
+	// Acknowledged is true if the client acknowledged the delayed PUBLISH
+	Acknowledged bool
+}
+
+// mqttPacket is an MQTT control packet
+type mqttPacket struct {
+	Type  uint8
+	Flags uint8
+	Body  []byte
+}
+
+// mqttConnectPacket holds the fields of a CONNECT the server uses
+type mqttConnectPacket struct {
+	ClientID  string
+	KeepAlive int
+	UserName  string
+}
+
+// mqttPublishPacket is a PUBLISH with QoS 0 or 1
+type mqttPublishPacket struct {
+	Topic    string
+	QoS      uint8
+	PacketID uint16
+	Payload  []byte
+}
+
+// mqttRead is the result of reading a packet from an MQTT connection
+type mqttRead struct {
+	packet mqttPacket
+	err    error
+}
+
+// mqttProbe is a NAT test on an MQTT connection, it waits for its interval and then for the acknowledgement of its response
+type mqttProbe struct {
+	Log NATLogEntry
+	// Interval fires once the response is due, Ack once the client failed to acknowledge it
+	Interval Timer
+	Ack      Timer
+	PacketID uint16
+}
+
+// MarshalBinary encodes the fixed header and the body of the packet
+func (p mqttPacket) MarshalBinary() ([]byte, error) {
+	length := len(p.Body)
+	if length > 268435455 {
+		return nil, errMQTTFormat
+	}
+	buffer := []byte{p.Type<<4 | p.Flags&0x0f}
+	for {
+		b := uint8(length % 128)
+		length /= 128
+		if length > 0 {
+			b |= 0x80
+		}
+		buffer = append(buffer, b)
+		if length == 0 {
+			break
+		}
+	}
+	return append(buffer, p.Body...), nil
+}
+
+// readMQTTPacket reads the next packet from r, packets larger than maxSize are rejected
+func readMQTTPacket(r *bufio.Reader, maxSize int) (mqttPacket, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return mqttPacket{}, err
+	}
+	var length int
+	for i := 0; ; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return mqttPacket{}, err
+		}
+		length |= int(b&0x7f) << (7 * uint(i))
+		if b&0x80 == 0 {
+			break
+		} else if i == 3 {
+			return mqttPacket{}, errMQTTFormat
+		}
+	}
+	if length > maxSize {
+		return mqttPacket{}, errMQTTFormat
+	}
+	p := mqttPacket{Type: header >> 4, Flags: header & 0x0f, Body: make([]byte, length)}
+	_, err = io.ReadFull(r, p.Body)
+	return p, err
+}
+
+// mqttString encodes s with its length prefix
+func mqttString(s string) []byte {
+	buffer := make([]byte, 2, 2+len(s))
+	binary.BigEndian.PutUint16(buffer, uint16(len(s)))
+	return append(buffer, s...)
+}
+
+// mqttFields reads the fields of a packet body
+type mqttFields []byte
+
+func (f *mqttFields) readUint16() (uint16, error) {
+	if len(*f) < 2 {
+		return 0, errMQTTFormat
+	}
+	v := binary.BigEndian.Uint16(*f)
+	*f = (*f)[2:]
+	return v, nil
+}
+
+func (f *mqttFields) readBytes() ([]byte, error) {
+	length, err := f.readUint16()
+	if err != nil || len(*f) < int(length) {
+		return nil, errMQTTFormat
+	}
+	v := (*f)[:length]
+	*f = (*f)[length:]
+	return v, nil
+}
+
+func (f *mqttFields) readByte() (uint8, error) {
+	if len(*f) < 1 {
+		return 0, errMQTTFormat
+	}
+	v := (*f)[0]
+	*f = (*f)[1:]
+	return v, nil
+}
+
+// decodeMQTTConnect decodes the body of a CONNECT packet
+func decodeMQTTConnect(p mqttPacket) (mqttConnectPacket, error) {
+	fields := mqttFields(p.Body)
+	name, err := fields.readBytes()
+	if err != nil {
+		return mqttConnectPacket{}, err
+	}
+	level, err := fields.readByte()
+	if err != nil {
+		return mqttConnectPacket{}, err
+	}
+	if string(name) != "MQTT" || level != mqttProtocolLevel {
+		return mqttConnectPacket{}, errMQTTProtocol
+	}
+	flags, err := fields.readByte()
+	if err != nil || flags&0x01 != 0 {
+		return mqttConnectPacket{}, errMQTTFormat
+	}
+	keepAlive, err := fields.readUint16()
+	if err != nil {
+		return mqttConnectPacket{}, err
+	}
+	clientID, err := fields.readBytes()
+	if err != nil {
+		return mqttConnectPacket{}, err
+	}
+	connect := mqttConnectPacket{ClientID: string(clientID), KeepAlive: int(keepAlive)}
+	if flags&0x04 != 0 {
+		// The will topic and message are not used
+		if _, err = fields.readBytes(); err != nil {
+			return mqttConnectPacket{}, err
+		}
+		if _, err = fields.readBytes(); err != nil {
+			return mqttConnectPacket{}, err
+		}
+	}
+	if flags&0x80 != 0 {
+		userName, err := fields.readBytes()
+		if err != nil {
+			return mqttConnectPacket{}, err
+		}
+		connect.UserName = string(userName)
+	}
+	return connect, nil
+}
+
+// decodeMQTTPublish decodes a PUBLISH packet
+func decodeMQTTPublish(p mqttPacket) (mqttPublishPacket, error) {
+	fields := mqttFields(p.Body)
+	topic, err := fields.readBytes()
+	if err != nil {
+		return mqttPublishPacket{}, err
+	}
+	publish := mqttPublishPacket{Topic: string(topic), QoS: p.Flags >> 1 & 0x03}
+	if publish.QoS > 2 {
+		return mqttPublishPacket{}, errMQTTFormat
+	}
+	if publish.QoS > 0 {
+		publish.PacketID, err = fields.readUint16()
+		if err != nil {
+			return mqttPublishPacket{}, err
+		}
+	}
+	publish.Payload = fields
+	return publish, nil
+}
+
+// packet encodes the PUBLISH
+func (p mqttPublishPacket) packet() mqttPacket {
+	body := mqttString(p.Topic)
+	if p.QoS > 0 {
+		body = append(body, uint8(p.PacketID>>8), uint8(p.PacketID))
+	}
+	return mqttPacket{Type: mqttPublish, Flags: p.QoS << 1, Body: append(body, p.Payload...)}
+}
+
+// mqttPacketID returns the packet ID a PUBACK, SUBSCRIBE or UNSUBSCRIBE starts with
+func mqttPacketID(p mqttPacket) (uint16, error) {
+	fields := mqttFields(p.Body)
+	return fields.readUint16()
+}
+
+// subscribeAck returns the SUBACK for a SUBSCRIBE, all subscriptions are granted with at most QoS 1
+func subscribeAck(p mqttPacket) (mqttPacket, error) {
+	fields := mqttFields(p.Body)
+	id, err := fields.readUint16()
+	if err != nil {
+		return mqttPacket{}, err
+	}
+	body := []byte{uint8(id >> 8), uint8(id)}
+	for len(fields) > 0 {
+		if _, err = fields.readBytes(); err != nil {
+			return mqttPacket{}, err
+		}
+		qos, err := fields.readByte()
+		if err != nil {
+			return mqttPacket{}, err
+		}
+		if qos > 1 {
+			qos = 1
+		}
+		body = append(body, qos)
+	}
+	return mqttPacket{Type: mqttSubAck, Body: body}, nil
+}
+
+func writeMQTT(conn net.Conn, p mqttPacket) error {
+	buffer, err := p.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(buffer)
+	return err
+}
+
+// readMQTT hands the packets read from r to reads until reading fails or done is closed
+func readMQTT(r *bufio.Reader, reads chan<- mqttRead, done <-chan struct{}) {
+	for {
+		p, err := readMQTTPacket(r, mqttMaxPacketSize)
+		select {
+		case reads <- mqttRead{packet: p, err: err}:
+		case <-done:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// timerC returns the channel of t, or nil if there is no timer
+func timerC(t Timer) <-chan time.Time {
+	if t == nil {
+		return nil
+	}
+	return t.C()
+}
+
+// keepAliveLimit returns how long the server waits for the next packet of a client with keepAlive seconds,
+// the specification allows one and a half times the keep alive interval, a higher percentage stretches it
+func (s *Server) keepAliveLimit(keepAlive int) time.Duration {
+	return time.Duration(keepAlive) * time.Second * time.Duration(s.config.MQTTKeepAlivePercent) / 100
+}
+
+// startMQTTProbe starts a NAT test for message, the response is due once the interval has passed
+func (s *Server) startMQTTProbe(conn net.Conn, message []byte, connect mqttConnectPacket) (*mqttProbe, error) {
+	logEntry, err := s.parseData(message, "MQTT", conn.RemoteAddr(), conn.LocalAddr())
+	if err != nil {
+		return nil, err
+	}
+	err = s.acquirePendingProbe(logEntry.IP)
+	if err != nil {
+		return nil, err
+	}
+	logEntry.MQTT = &MQTTInfo{
+		ClientID:  connect.ClientID,
+		KeepAlive: connect.KeepAlive,
+		Stretched: connect.KeepAlive > 0 && logEntry.Message.Interval > connect.KeepAlive,
+	}
+	return &mqttProbe{
+		Log:      logEntry,
+		Interval: s.config.Clock.NewTimer(time.Duration(logEntry.Message.Interval) * time.Second),
+	}, nil
+}
+
+// endMQTTProbe stops the timers of probe and records it as timed out, or as interrupted if the server is stopping.
+// A probe replaced by the next one before its response was due is not recorded.
+func (s *Server) endMQTTProbe(probe *mqttProbe, reason string, replaced bool) {
+	if probe.Interval != nil {
+		probe.Interval.Stop()
+		s.releasePendingProbe(probe.Log.IP)
+		entryLogger(probe.Log).Info("MQTT probe ended before the response was due", "reason", reason)
+		if replaced {
+			return
+		}
+	} else {
+		probe.Ack.Stop()
+		entryLogger(probe.Log).Info("MQTT response ended before it was acknowledged", "reason", reason)
+	}
+	if s.isStopping() {
+		probe.Log.Interrupted = true
+	} else {
+		probe.Log.Timeout = true
+	}
+	s.writeLog <- probe.Log
+}
+
+// handleMQTT runs the NAT test on an MQTT connection. The NAT test message is sent as user name in CONNECT,
+// later ones are published to mqttProbeTopic. Once the interval of a probe has passed the server publishes
+// the response to mqttReplyTopic with QoS 1, and the probe times out unless the client acknowledges it.
+// Clients which do not send a packet within their keep alive limit are disconnected.
+func (s *Server) handleMQTT(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	p, err := readMQTTPacket(reader, mqttMaxPacketSize)
+	if err == nil && p.Type != mqttConnect {
+		err = errMQTTFormat
+	}
+	var connect mqttConnectPacket
+	if err == nil {
+		connect, err = decodeMQTTConnect(p)
+	}
+	if err == errMQTTProtocol {
+		writeMQTT(conn, mqttPacket{Type: mqttConnAck, Body: []byte{0, mqttUnacceptableProtocol}})
+	}
+	if err != nil {
+		connLogger("MQTT", conn.RemoteAddr()).Warn("MQTT connection rejected", "error", err)
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	probe, err := s.startMQTTProbe(conn, []byte(connect.UserName), connect)
+	if err != nil {
+		connLogger("MQTT", conn.RemoteAddr()).Warn("MQTT connection terminated", "error", err)
+		code := uint8(mqttBadUserNameOrPassword)
+		if err == errIntervalTooLarge || err == errTooManyPending {
+			code = mqttServerUnavailable
+		}
+		writeMQTT(conn, mqttPacket{Type: mqttConnAck, Body: []byte{0, code}})
+		return
+	}
+	err = writeMQTT(conn, mqttPacket{Type: mqttConnAck, Body: []byte{0, mqttAccepted}})
+	if err != nil {
+		s.endMQTTProbe(probe, "was lost", false)
+		return
+	}
+
+	reads := make(chan mqttRead)
+	done := make(chan struct{})
+	defer close(done)
+	go readMQTT(reader, reads, done)
+
+	var keepAlive Timer
+	if connect.KeepAlive > 0 {
+		keepAlive = s.config.Clock.NewTimer(s.keepAliveLimit(connect.KeepAlive))
+		defer keepAlive.Stop()
+	}
+	var packetID uint16
+	for {
+		var intervalC, ackC <-chan time.Time
+		if probe != nil {
+			intervalC = timerC(probe.Interval)
+			ackC = timerC(probe.Ack)
+		}
+
+		select {
+		case <-intervalC:
+			s.releasePendingProbe(probe.Log.IP)
+			probe.Interval = nil
+			packetID++
+			if packetID == 0 {
+				packetID++
+			}
+			probe.PacketID = packetID
+			publish := mqttPublishPacket{Topic: mqttReplyTopic, QoS: 1, PacketID: packetID, Payload: s.replyData(probe.Log)}
+			err = writeMQTT(conn, publish.packet())
+			if err != nil {
+				entryLogger(probe.Log).Warn("MQTT write failed, connection terminated", "error", err)
+				probe.Log.Timeout = true
+				s.writeLog <- probe.Log
+				return
+			}
+			entryLogger(probe.Log).Debug("MQTT packet sent")
+			probe.Ack = s.config.Clock.NewTimer(mqttAckTimeout)
+			continue
+		case <-ackC:
+			entryLogger(probe.Log).Info("MQTT response was not acknowledged")
+			probe.Log.Timeout = true
+			s.writeLog <- probe.Log
+			probe = nil
+			continue
+		case <-timerC(keepAlive):
+			connLogger("MQTT", conn.RemoteAddr()).Info("MQTT client exceeded its keep alive, connection terminated", "keepAlive", connect.KeepAlive)
+			if probe != nil {
+				s.endMQTTProbe(probe, "exceeded its keep alive", false)
+			}
+			return
+		case r := <-reads:
+			p = r.packet
+			err = r.err
+		}
+
+		if err != nil {
+			if probe != nil {
+				s.endMQTTProbe(probe, "was disconnected", false)
+			}
+			return
+		}
+		if keepAlive != nil {
+			if !keepAlive.Stop() {
+				select {
+				case <-keepAlive.C():
+				default:
+				}
+			}
+			keepAlive.Reset(s.keepAliveLimit(connect.KeepAlive))
+		}
+
+		switch p.Type {
+		case mqttPingReq:
+			if probe != nil {
+				probe.Log.MQTT.Pings++
+			}
+			err = writeMQTT(conn, mqttPacket{Type: mqttPingResp})
+		case mqttPubAck:
+			var id uint16
+			id, err = mqttPacketID(p)
+			if err == nil && probe != nil && probe.Ack != nil && id == probe.PacketID {
+				probe.Ack.Stop()
+				entryLogger(probe.Log).Debug("MQTT response was acknowledged")
+				probe.Log.MQTT.Acknowledged = true
+				s.writeLog <- probe.Log
+				probe = nil
+			}
+		case mqttSubscribe:
+			var ack mqttPacket
+			ack, err = subscribeAck(p)
+			if err == nil {
+				err = writeMQTT(conn, ack)
+			}
+		case mqttUnsubscribe:
+			var id uint16
+			id, err = mqttPacketID(p)
+			if err == nil {
+				err = writeMQTT(conn, mqttPacket{Type: mqttUnsubAck, Body: []byte{uint8(id >> 8), uint8(id)}})
+			}
+		case mqttPublish:
+			var publish mqttPublishPacket
+			publish, err = decodeMQTTPublish(p)
+			if err == nil && publish.QoS == 1 {
+				err = writeMQTT(conn, mqttPacket{Type: mqttPubAck, Body: []byte{uint8(publish.PacketID >> 8), uint8(publish.PacketID)}})
+			}
+			if err != nil || publish.Topic != mqttProbeTopic {
+				break
+			}
+			if probe != nil {
+				// The client moved on to its next probe
+				s.endMQTTProbe(probe, "was replaced", true)
+				probe = nil
+			}
+			probe, err = s.startMQTTProbe(conn, publish.Payload, connect)
+			if err != nil {
+				connLogger("MQTT", conn.RemoteAddr()).Warn("MQTT connection terminated", "error", err)
+				writeMQTT(conn, mqttPublishPacket{Topic: mqttReplyTopic, Payload: s.errorMessage(err)}.packet())
+				return
+			}
+		case mqttDisconnect:
+			err = io.EOF
+		default:
+			err = errMQTTFormat
+		}
+		if err != nil {
+			if probe != nil {
+				s.endMQTTProbe(probe, "was disconnected", false)
+			}
+			return
+		}
+	}
+}
+
+func (s *Server) acceptMQTT(l net.Listener) {
+	s.acceptConnections(l, "MQTT", s.handleMQTT)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// mqttListener adds an MQTT listener on a random local port
+func mqttListener(t *testing.T) func(*Config) {
+	return func(config *Config) {
+		config.MQTTListeners = []net.Listener{localTCPListener(t)}
+	}
+}
+
+// mqttTestClient is a minimal MQTT client
+type mqttTestClient struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// dialMQTT connects to the server and sends a CONNECT with message as user name
+func dialMQTT(t *testing.T, server *Server, level uint8, keepAlive uint16, message []byte) *mqttTestClient {
+	conn, err := net.Dial("tcp", server.MQTTAddr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect to the server: %s", err)
+	}
+	c := &mqttTestClient{t: t, conn: conn, reader: bufio.NewReader(conn)}
+	body := append(mqttString("MQTT"), level, 0x82, uint8(keepAlive>>8), uint8(keepAlive))
+	body = append(body, mqttString("352656100367872")...)
+	body = append(body, mqttString(string(bytes.TrimSuffix(message, []byte("\n"))))...)
+	c.write(mqttPacket{Type: mqttConnect, Body: body})
+	return c
+}
+
+func (c *mqttTestClient) write(p mqttPacket) {
+	if err := writeMQTT(c.conn, p); err != nil {
+		c.t.Fatalf("Failed to write: %s", err)
+	}
+}
+
+func (c *mqttTestClient) read() mqttPacket {
+	c.conn.SetReadDeadline(time.Now().Add(replyTimeout))
+	p, err := readMQTTPacket(c.reader, mqttMaxPacketSize)
+	if err != nil {
+		c.t.Fatalf("Server failed to answer: %s", err)
+	}
+	return p
+}
+
+// awaitPublish advances clock by d and returns the delayed response the server publishes then
+func (c *mqttTestClient) awaitPublish(clock *fakeClock, d time.Duration) mqttPublishPacket {
+	if !clock.WaitForTimer(d) {
+		c.t.Fatalf("Server did not wait for %s", d)
+	}
+	clock.Advance(d)
+	p := c.read()
+	assert.Equal(c.t, uint8(mqttPublish), p.Type, "The server should publish the response")
+	publish, err := decodeMQTTPublish(p)
+	assert.NoError(c.t, err, "The response should be a valid PUBLISH")
+	assert.Equal(c.t, mqttReplyTopic, publish.Topic, "The response should be published to the reply topic")
+	assert.Equal(c.t, uint8(1), publish.QoS, "The response should be published with QoS 1")
+	return publish
+}
+
+func TestMQTTPacket(t *testing.T) {
+	assert := assert.New(t)
+	publish := mqttPublishPacket{Topic: mqttProbeTopic, QoS: 1, PacketID: 0x0102, Payload: bytes.Repeat([]byte{'x'}, 200)}
+	buffer, err := publish.packet().MarshalBinary()
+	assert.NoError(err, "The packet should be encoded")
+	assert.Equal([]byte{0x32, 0xd5, 0x01}, buffer[:3], "The remaining length should take two bytes")
+
+	p, err := readMQTTPacket(bufio.NewReader(bytes.NewReader(buffer)), mqttMaxPacketSize)
+	if assert.NoError(err, "The packet should be read") {
+		decoded, err := decodeMQTTPublish(p)
+		assert.NoError(err, "The PUBLISH should be decoded")
+		assert.Equal(publish, decoded, "The PUBLISH should be kept")
+	}
+
+	_, err = readMQTTPacket(bufio.NewReader(bytes.NewReader(buffer)), 100)
+	assert.Error(err, "Packets above the maximum size should be rejected")
+	_, err = readMQTTPacket(bufio.NewReader(bytes.NewReader([]byte{0x30, 0xff, 0xff, 0xff, 0xff, 0x01})), mqttMaxPacketSize)
+	assert.Error(err, "Remaining lengths above four bytes should be rejected")
+}
+
+func TestMQTT(t *testing.T) {
+	assert := assert.New(t)
+	sink := &memorySink{}
+	server, clock := newFakeClockServer(t, sink, mqttListener(t))
+
+	client := dialMQTT(t, server, mqttProtocolLevel, 0, NATtestCases[0])
+	defer client.conn.Close()
+	assert.Equal(mqttPacket{Type: mqttConnAck, Body: []byte{0, mqttAccepted}}, client.read(), "The connection should be accepted")
+	client.write(mqttPacket{Type: mqttSubscribe, Flags: 0x02, Body: append(append([]byte{0, 1}, mqttString(mqttReplyTopic)...), 1)})
+	assert.Equal(mqttPacket{Type: mqttSubAck, Body: []byte{0, 1, 1}}, client.read(), "The subscription should be granted")
+
+	var replies []string
+	response := client.awaitPublish(clock, time.Second)
+	replies = append(replies, string(response.Payload))
+	client.write(mqttPacket{Type: mqttPubAck, Body: []byte{uint8(response.PacketID >> 8), uint8(response.PacketID)}})
+
+	// The next probe is published on the same connection, and its response is not acknowledged
+	client.write(mqttPublishPacket{Topic: mqttProbeTopic, QoS: 1, PacketID: 7, Payload: bytes.TrimSuffix(NATtestCases[1], []byte("\n"))}.packet())
+	assert.Equal(mqttPacket{Type: mqttPubAck, Body: []byte{0, 7}}, client.read(), "The probe should be acknowledged")
+	response = client.awaitPublish(clock, 2*time.Second)
+	replies = append(replies, string(response.Payload))
+	assert.True(clock.WaitForTimer(mqttAckTimeout), "The server should wait for the acknowledgement")
+	clock.Advance(mqttAckTimeout)
+
+	assert.Eventually(func() bool {
+		return len(sink.natLogEntries()) == len(replies)
+	}, replyTimeout, time.Millisecond, "All MQTT probes should be logged")
+	entries := sink.natLogEntries()
+	assertNATLogEntries(t, entries, "MQTT", replies)
+	for _, entry := range entries {
+		if assert.NotNil(entry.MQTT, "The MQTT connection should be recorded") {
+			assert.Equal("352656100367872", entry.MQTT.ClientID, "The client ID should be recorded")
+			assert.Equal(entry.Message.Interval == 1, entry.MQTT.Acknowledged, "Only the first response was acknowledged")
+			assert.False(entry.MQTT.Stretched, "Without keep alive nothing is stretched")
+		}
+	}
+}
+
+func TestMQTTKeepAlive(t *testing.T) {
+	assert := assert.New(t)
+
+	// The client may stay silent for one and a half times its keep alive, which is shorter than the interval
+	sink := &memorySink{}
+	server, clock := newFakeClockServer(t, sink, mqttListener(t))
+	client := dialMQTT(t, server, mqttProtocolLevel, 2, NATtestCases[3])
+	defer client.conn.Close()
+	client.read()
+	client.write(mqttPacket{Type: mqttPingReq})
+	assert.Equal(uint8(mqttPingResp), client.read().Type, "Pings should be answered")
+	assert.True(clock.WaitForTimer(3*time.Second), "The server should wait for the keep alive")
+	clock.Advance(3 * time.Second)
+	client.conn.SetReadDeadline(time.Now().Add(replyTimeout))
+	_, err := client.reader.ReadByte()
+	assert.Error(err, "The client should be disconnected once its keep alive has passed")
+
+	assert.Eventually(func() bool {
+		return len(sink.natLogEntries()) == 1
+	}, replyTimeout, time.Millisecond, "The probe should be logged")
+	entries := sink.natLogEntries()
+	if assert.Len(entries, 1) && assert.NotNil(entries[0].MQTT, "The MQTT connection should be recorded") {
+		assert.True(entries[0].Timeout, "The probe should time out")
+		assert.True(entries[0].MQTT.Stretched, "The interval is longer than the keep alive")
+		assert.Equal(1, entries[0].MQTT.Pings, "The ping should be recorded")
+		assert.Equal(2, entries[0].MQTT.KeepAlive, "The keep alive should be recorded")
+	}
+
+	// Stretching the keep alive lets the connection stay idle for the whole interval
+	sink = &memorySink{}
+	server, clock = newFakeClockServer(t, sink, mqttListener(t), func(config *Config) {
+		config.MQTTKeepAlivePercent = 250
+	})
+	client = dialMQTT(t, server, mqttProtocolLevel, 2, NATtestCases[3])
+	defer client.conn.Close()
+	client.read()
+	response := client.awaitPublish(clock, 4*time.Second)
+	client.write(mqttPacket{Type: mqttPubAck, Body: []byte{uint8(response.PacketID >> 8), uint8(response.PacketID)}})
+	assert.Eventually(func() bool {
+		return len(sink.natLogEntries()) == 1
+	}, replyTimeout, time.Millisecond, "The probe should be logged")
+	entries = sink.natLogEntries()
+	if assert.Len(entries, 1) && assert.NotNil(entries[0].MQTT, "The MQTT connection should be recorded") {
+		assert.False(entries[0].Timeout, "The probe should not time out")
+		assert.True(entries[0].MQTT.Acknowledged, "The response should be acknowledged")
+		assert.True(entries[0].MQTT.Stretched, "The interval is longer than the keep alive")
+	}
+}
+
+func TestMQTTConnect(t *testing.T) {
+	assert := assert.New(t)
+	sink := &memorySink{}
+	server, _ := newFakeClockServer(t, sink, mqttListener(t))
+
+	client := dialMQTT(t, server, 3, 0, NATtestCases[0])
+	assert.Equal(mqttPacket{Type: mqttConnAck, Body: []byte{0, mqttUnacceptableProtocol}}, client.read(), "MQTT 3.1 should be rejected")
+	client.conn.Close()
+
+	client = dialMQTT(t, server, mqttProtocolLevel, 0, errorCases[0])
+	assert.Equal(mqttPacket{Type: mqttConnAck, Body: []byte{0, mqttBadUserNameOrPassword}}, client.read(), "Invalid messages should be rejected")
+	client.conn.Close()
+	assert.Empty(sink.natLogEntries(), "Rejected connections should not be logged")
+}
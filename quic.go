@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// quicALPN is the application protocol clients must offer in the QUIC handshake
+const quicALPN = "nat-test"
+
+// quicErrorCode is the application error code the server closes QUIC connections with
+const quicErrorCode = 0x100
+
+var errNoQUICStream = errors.New("No QUIC stream opened")
+
+// QUICInfo describes the QUIC connection a NAT test message was received in
+type QUICInfo struct {
+	// Migrated is true if the follow-up message arrived on the same connection, but from a different address,
+	// so the connection survived the NAT rebinding it
+	Migrated bool `json:",omitempty"`
+}
+
+// quicConn is a QUIC connection with the stream the client sends its NAT test messages on
+type quicConn struct {
+	*quic.Conn
+	stream *quic.Stream
+}
+
+func (c *quicConn) Read(b []byte) (int, error) {
+	if c.stream == nil {
+		return 0, errNoQUICStream
+	}
+	return c.stream.Read(b)
+}
+
+// Write writes b to the stream, before the client opened one b is sent as the reason for closing the connection
+func (c *quicConn) Write(b []byte) (int, error) {
+	if c.stream == nil {
+		return 0, c.CloseWithError(quicErrorCode, string(b))
+	}
+	return c.stream.Write(b)
+}
+
+func (c *quicConn) Close() error {
+	return c.CloseWithError(0, "")
+}
+
+func (c *quicConn) SetDeadline(t time.Time) error {
+	if c.stream == nil {
+		return errNoQUICStream
+	}
+	return c.stream.SetDeadline(t)
+}
+
+func (c *quicConn) SetReadDeadline(t time.Time) error {
+	if c.stream == nil {
+		return errNoQUICStream
+	}
+	return c.stream.SetReadDeadline(t)
+}
+
+func (c *quicConn) SetWriteDeadline(t time.Time) error {
+	if c.stream == nil {
+		return errNoQUICStream
+	}
+	return c.stream.SetWriteDeadline(t)
+}
+
+// quicListener accepts QUIC connections on conn, closing it closes all connections and conn
+type quicListener struct {
+	*quic.Listener
+	conn net.PacketConn
+}
+
+// Accept waits for the next connection to complete its handshake
+func (l *quicListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return &quicConn{Conn: conn}, nil
+}
+
+func (l *quicListener) Close() error {
+	err := l.Listener.Close()
+	l.conn.Close()
+	return err
+}
+
+// newSelfSignedTLSConfig returns a TLS configuration with a newly generated self-signed certificate
+func newSelfSignedTLSConfig() (*tls.Config, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "NAT Test Server"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(1, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}, nil
+}
+
+// quicConfig returns the transport parameters of the QUIC listeners
+func (s *Server) quicConfig() *quic.Config {
+	return &quic.Config{
+		HandshakeIdleTimeout: handshakeTimeout,
+		// The connection idles for the interval of each message, QUIC must not close it before the follow-up is due.
+		// Keep alives stay disabled, they would refresh the NAT binding under test.
+		MaxIdleTimeout: time.Duration(s.config.MaxInterval)*time.Second + s.config.UDPTimeout,
+	}
+}
+
+// listenQUIC opens a QUIC listener on each of conns
+func (s *Server) listenQUIC(conns []net.PacketConn) ([]net.Listener, error) {
+	if len(conns) == 0 {
+		return nil, nil
+	}
+	tlsConfig := s.config.QUICTLSConfig.Clone()
+	tlsConfig.NextProtos = []string{quicALPN}
+	var listeners []net.Listener
+	for _, conn := range conns {
+		l, err := quic.Listen(conn, tlsConfig, s.quicConfig())
+		if err != nil {
+			conn.Close()
+			closeAll(listeners)
+			return nil, err
+		}
+		listeners = append(listeners, &quicListener{Listener: l, conn: conn})
+	}
+	return listeners, nil
+}
+
+// handleQUIC runs the UDP NAT test on the first stream the client opens.
+// Like for DTLS, a probe times out if the device does not follow up within the UDP timeout or with a lower interval.
+// If the follow-up arrives from a different address, the NAT rebound the device and the connection migrated.
+func (s *Server) handleQUIC(conn net.Conn) {
+	defer conn.Close()
+	q, ok := conn.(*quicConn)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), handshakeTimeout)
+	stream, err := q.AcceptStream(ctx)
+	cancel()
+	if err != nil {
+		connLogger("QUIC", conn.RemoteAddr()).Warn("No QUIC stream opened", "error", err)
+		return
+	}
+	q.stream = stream
+
+	reads := make(chan connRead)
+	done := make(chan struct{})
+	defer close(done)
+	go readMessages(conn, s.config.BufferSize, reads, done)
+
+	var logEntry NATLogEntry
+	var followUp Timer
+	var timeout <-chan time.Time
+	for {
+		var r connRead
+		select {
+		case r = <-reads:
+		case <-timeout:
+			entryLogger(logEntry).Info("No QUIC message within the UDP timeout", "timeout", s.config.UDPTimeout)
+			logEntry.Timeout = true
+			s.writeLog <- logEntry
+			return
+		}
+		if followUp != nil {
+			followUp.Stop()
+		}
+
+		if r.err != nil {
+			if logEntry.Protocol != "" && s.connectionInterrupted(conn) {
+				entryLogger(logEntry).Info("Waiting for QUIC message interrupted")
+				logEntry.Interrupted = true
+				s.writeLog <- logEntry
+			} else if logEntry.Protocol != "" {
+				entryLogger(logEntry).Info("Error reading QUIC connection", "error", r.err)
+				logEntry.Timeout = true
+				s.writeLog <- logEntry
+			} else {
+				connLogger("QUIC", conn.RemoteAddr()).Warn("Error reading QUIC connection", "error", r.err)
+			}
+			return
+		}
+		if logEntry.Protocol != "" {
+			logEntry.QUIC.Migrated = conn.RemoteAddr().String() != logEntry.IP
+			if logEntry.QUIC.Migrated {
+				entryLogger(logEntry).Info("QUIC connection migrated", "migratedTo", conn.RemoteAddr().String())
+			}
+			var next deviceMessage
+			if json.Unmarshal(r.buffer, &next) == nil && next.Interval <= logEntry.Message.Interval {
+				// The device did not receive our response and now starts with the binary search
+				logEntry.Timeout = true
+			}
+			// Store log from previous interval
+			s.writeLog <- logEntry
+		}
+
+		var retBuffer []byte
+		retBuffer, logEntry, err = s.HandleData(r.buffer, "QUIC", conn.RemoteAddr(), conn.LocalAddr())
+		logEntry.QUIC = &QUICInfo{}
+		if err == errInterrupted {
+			entryLogger(logEntry).Info("QUIC response interrupted")
+			s.writeLog <- logEntry
+			return
+		} else if err != nil {
+			connLogger("QUIC", conn.RemoteAddr()).Warn("QUIC connection terminated", "error", err)
+			conn.Write(s.errorMessage(err))
+			return
+		}
+
+		_, err = conn.Write(retBuffer)
+		if err != nil {
+			entryLogger(logEntry).Warn("QUIC write failed, connection terminated", "error", err)
+			logEntry.Timeout = true
+			s.writeLog <- logEntry
+			return
+		}
+		entryLogger(logEntry).Debug("QUIC packet sent")
+		followUp = s.config.Clock.NewTimer(s.config.UDPTimeout)
+		timeout = followUp.C()
+	}
+}
+
+func (s *Server) acceptQUIC(l net.Listener) {
+	s.acceptConnections(l, "QUIC", s.handleQUIC)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/stretchr/testify/assert"
+)
+
+// quicSocket adds a QUIC socket on a random local port
+func quicSocket(t *testing.T) func(*Config) {
+	return func(config *Config) {
+		config.QUICConns = []net.PacketConn{localUDPConn(t)}
+	}
+}
+
+// newQUICTransport returns a QUIC transport on a new local UDP socket, like the address a NAT assigns
+func newQUICTransport(t *testing.T) *quic.Transport {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	tr := &quic.Transport{Conn: conn}
+	t.Cleanup(func() {
+		tr.Close()
+		conn.Close()
+	})
+	return tr
+}
+
+func TestQUIC(t *testing.T) {
+	assert := assert.New(t)
+	sink := &memorySink{}
+	server, clock := newFakeClockServer(t, sink, quicSocket(t))
+
+	ctx, cancel := context.WithTimeout(context.Background(), replyTimeout)
+	defer cancel()
+	tlsConfig := &tls.Config{InsecureSkipVerify: true, NextProtos: []string{quicALPN}}
+	conn, err := newQUICTransport(t).Dial(ctx, server.QUICAddr(), tlsConfig, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect to the server: %s", err)
+	}
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		t.Fatalf("Failed to open a stream: %s", err)
+	}
+
+	var replies []string
+	for i, message := range NATtestCases[:2] {
+		if i > 0 {
+			// The NAT rebinds the device to a new address, the connection migrates to it
+			path, err := conn.AddPath(newQUICTransport(t))
+			if err != nil {
+				t.Fatalf("Failed to add a path: %s", err)
+			}
+			assert.NoError(path.Probe(ctx), "The new path should be validated")
+			assert.NoError(path.Switch(), "The connection should switch to the new path")
+		}
+		_, err = stream.Write(message)
+		assert.NoError(err, "The message should be sent")
+		interval := time.Duration(i+1) * time.Second
+		if !clock.WaitForTimer(interval) {
+			t.Fatalf("Server did not wait for the interval of %s", interval)
+		}
+		clock.Advance(interval)
+		stream.SetReadDeadline(time.Now().Add(replyTimeout))
+		buffer := make([]byte, 1024)
+		n, err := stream.Read(buffer)
+		if err != nil {
+			t.Fatalf("Server failed to answer: %s", err)
+		}
+		replies = append(replies, string(buffer[:n]))
+	}
+	conn.CloseWithError(0, "")
+
+	assert.Eventually(func() bool {
+		return len(sink.natLogEntries()) == len(replies)
+	}, replyTimeout, time.Millisecond, "All QUIC probes should be logged")
+	entries := sink.natLogEntries()
+	assertNATLogEntries(t, entries, "QUIC", replies)
+	if assert.Len(entries, 2) && assert.NotNil(entries[0].QUIC, "The QUIC connection should be recorded") {
+		assert.True(entries[0].QUIC.Migrated, "The follow-up arrived from the new address")
+		assert.False(entries[1].QUIC.Migrated, "The connection was closed without a follow-up")
+	}
+}
+
+func TestQUICALPN(t *testing.T) {
+	sink := &memorySink{}
+	server, _ := newFakeClockServer(t, sink, quicSocket(t))
+
+	ctx, cancel := context.WithTimeout(context.Background(), replyTimeout)
+	defer cancel()
+	tlsConfig := &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h3"}}
+	_, err := newQUICTransport(t).Dial(ctx, server.QUICAddr(), tlsConfig, nil)
+	assert.Error(t, err, "Connections for other application protocols should be rejected")
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// scheduledTask is a function the scheduler runs once At has passed.
+// If the scheduler is stopped before that, interrupted is run instead.
+type scheduledTask struct {
+	At          time.Time
+	fn          func()
+	interrupted func()
+	index       int
+}
+
+// taskQueue is a min-heap of tasks ordered by their due time
+type taskQueue []*scheduledTask
+
+func (q taskQueue) Len() int           { return len(q) }
+func (q taskQueue) Less(i, j int) bool { return q[i].At.Before(q[j].At) }
+func (q taskQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *taskQueue) Push(x interface{}) {
+	t := x.(*scheduledTask)
+	t.index = len(*q)
+	*q = append(*q, t)
+}
+
+func (q *taskQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	t := old[n-1]
+	old[n-1] = nil
+	t.index = -1
+	*q = old[:n-1]
+	return t
+}
+
+// scheduler runs delayed replies and follow-up timeouts from a single goroutine and timer,
+// instead of parking one goroutine and timer per message.
+type scheduler struct {
+	Queue   taskQueue
+	Mux     sync.Mutex
+	Stopped bool
+	clock   Clock
+	wake    chan struct{}
+	stop    chan struct{}
+}
+
+func newScheduler(clock Clock) *scheduler {
+	return &scheduler{clock: clock, wake: make(chan struct{}, 1), stop: make(chan struct{})}
+}
+
+// After schedules fn to run once d has passed. fn is run in its own goroutine so it may block.
+// interrupted is run instead of fn if the scheduler is stopped before d has passed, it may be nil.
+func (s *scheduler) After(d time.Duration, fn func(), interrupted func()) *scheduledTask {
+	t := &scheduledTask{At: s.clock.Now().Add(d), fn: fn, interrupted: interrupted}
+	s.Mux.Lock()
+	if s.Stopped {
+		s.Mux.Unlock()
+		t.index = -1
+		if interrupted != nil {
+			go interrupted()
+		}
+		return t
+	}
+	heap.Push(&s.Queue, t)
+	first := t.index == 0
+	s.Mux.Unlock()
+	if first {
+		s.notify()
+	}
+	return t
+}
+
+// Cancel removes t from the schedule. It returns false if t has already run or was canceled before.
+func (s *scheduler) Cancel(t *scheduledTask) bool {
+	s.Mux.Lock()
+	defer s.Mux.Unlock()
+	if t.index < 0 || t.index >= len(s.Queue) || s.Queue[t.index] != t {
+		return false
+	}
+	heap.Remove(&s.Queue, t.index)
+	return true
+}
+
+// Len returns the number of tasks waiting to be run
+func (s *scheduler) Len() int {
+	s.Mux.Lock()
+	defer s.Mux.Unlock()
+	return len(s.Queue)
+}
+
+func (s *scheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Stop stops running tasks and runs the interrupted function of every task still waiting
+func (s *scheduler) Stop() {
+	s.Mux.Lock()
+	if s.Stopped {
+		s.Mux.Unlock()
+		return
+	}
+	s.Stopped = true
+	waiting := s.Queue
+	for _, t := range waiting {
+		t.index = -1
+	}
+	s.Queue = nil
+	s.Mux.Unlock()
+	close(s.stop)
+
+	for _, t := range waiting {
+		if t.interrupted != nil {
+			t.interrupted()
+		}
+	}
+}
+
+// Run runs the due tasks until the scheduler is stopped
+func (s *scheduler) Run() {
+	timer := s.clock.NewTimer(time.Hour)
+	for {
+		s.Mux.Lock()
+		now := s.clock.Now()
+		for len(s.Queue) > 0 && !s.Queue[0].At.After(now) {
+			t := heap.Pop(&s.Queue).(*scheduledTask)
+			go t.fn()
+		}
+		wait := time.Hour
+		if len(s.Queue) > 0 {
+			wait = s.Queue[0].At.Sub(now)
+		}
+		s.Mux.Unlock()
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C():
+			default:
+			}
+		}
+		timer.Reset(wait)
+		select {
+		case <-timer.C():
+		case <-s.wake:
+		case <-s.stop:
+			timer.Stop()
+			return
+		}
+	}
+}
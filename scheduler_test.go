@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScheduler(t *testing.T) {
+	assert := assert.New(t)
+	clock := newFakeClock()
+	s := newScheduler(clock)
+	go s.Run()
+
+	ran := make(chan int, 3)
+	s.After(300*time.Millisecond, func() { ran <- 3 }, nil)
+	s.After(100*time.Millisecond, func() { ran <- 1 }, nil)
+	canceled := s.After(200*time.Millisecond, func() { ran <- 2 }, nil)
+
+	assert.True(s.Cancel(canceled), "A waiting task should be canceled")
+	assert.False(s.Cancel(canceled), "A task should only be canceled once")
+
+	assert.True(clock.WaitForTimer(100*time.Millisecond), "The scheduler should wait for the earliest task")
+	clock.Advance(100 * time.Millisecond)
+	assert.Equal(1, <-ran, "The earliest task should run first")
+	assert.True(clock.WaitForTimer(200*time.Millisecond), "The scheduler should wait for the next task")
+	clock.Advance(200 * time.Millisecond)
+	assert.Equal(3, <-ran, "The canceled task should not run")
+	assert.Equal(0, s.Len(), "All tasks should have run")
+	s.Stop()
+}
+
+func TestSchedulerStop(t *testing.T) {
+	assert := assert.New(t)
+	s := newScheduler(realClock{})
+	go s.Run()
+
+	interrupted := make(chan int, 2)
+	s.After(time.Hour, func() { t.Error("The task should not run") }, func() { interrupted <- 1 })
+	s.Stop()
+	assert.Equal(1, <-interrupted, "A waiting task should be interrupted")
+
+	s.After(time.Millisecond, func() { t.Error("The task should not run") }, func() { interrupted <- 2 })
+	assert.Equal(2, <-interrupted, "A task scheduled after stopping should be interrupted")
+}
+
+// simulatedDevices are the numbers of devices the benchmarks simulate
+var simulatedDevices = []int{1000, 10000, 100000}
+
+// BenchmarkScheduler schedules a delayed response and its follow-up timeout for every simulated device
+// and reports the memory and goroutines needed while they are pending.
+func BenchmarkScheduler(b *testing.B) {
+	for _, devices := range simulatedDevices {
+		b.Run(fmt.Sprintf("%d devices", devices), func(b *testing.B) {
+			benchmarkPending(b, devices, func(wg *sync.WaitGroup) func() {
+				s := newScheduler(realClock{})
+				go s.Run()
+				return func() {
+					s.After(500*time.Millisecond, func() {
+						s.After(500*time.Millisecond, wg.Done, nil)
+					}, nil)
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkSleepingGoroutines simulates the same load with one goroutine sleeping and waiting on a timer per device,
+// as a baseline for BenchmarkScheduler.
+func BenchmarkSleepingGoroutines(b *testing.B) {
+	for _, devices := range simulatedDevices {
+		b.Run(fmt.Sprintf("%d devices", devices), func(b *testing.B) {
+			benchmarkPending(b, devices, func(wg *sync.WaitGroup) func() {
+				return func() {
+					go func() {
+						time.Sleep(500 * time.Millisecond)
+						timer := time.NewTimer(500 * time.Millisecond)
+						<-timer.C
+						wg.Done()
+					}()
+				}
+			})
+		})
+	}
+}
+
+func benchmarkPending(b *testing.B, devices int, setup func(wg *sync.WaitGroup) func()) {
+	b.ReportAllocs()
+	var memBytes, goroutines uint64
+	for i := 0; i < b.N; i++ {
+		var wg sync.WaitGroup
+		wg.Add(devices)
+		probe := setup(&wg)
+
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		startGoroutines := runtime.NumGoroutine()
+
+		for d := 0; d < devices; d++ {
+			probe()
+		}
+
+		runtime.ReadMemStats(&after)
+		// Goroutine stacks are not part of the heap, so count both
+		memBytes += (after.HeapAlloc + after.StackInuse) - (before.HeapAlloc + before.StackInuse)
+		goroutines += uint64(runtime.NumGoroutine() - startGoroutines)
+		wg.Wait()
+	}
+	b.ReportMetric(float64(memBytes)/float64(b.N*devices), "mem-B/device")
+	b.ReportMetric(float64(goroutines)/float64(b.N), "goroutines")
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const defaultSearchIdleTimeoutInSeconds = 900
+
+// searchResolution is the width in seconds of the bracket at which a device's binary search has converged,
+// the intervals are whole seconds
+const searchResolution = 1
+
+// Reasons a device's search for the NAT timeout ended
+const (
+	searchConverged = "converged"
+	searchIdle      = "idle"
+)
+
+// NATSearchSummary gets logged to S3 once a device's search for the NAT timeout of a protocol has ended
+type NATSearchSummary struct {
+	IMEI     string
+	ICCID    string
+	Operator string
+	Protocol string
+	// Reason is why the search ended: converged or idle
+	Reason string
+	// LargestSuccess and SmallestTimeout bracket the NAT timeout in seconds, they are 0 if no probe survived or timed out
+	LargestSuccess  int `json:",omitempty"`
+	SmallestTimeout int `json:",omitempty"`
+	Probes          int
+	Timeouts        int
+	// Rebindings counts the probes which arrived from a new address, although the previous probe did not time out
+	Rebindings int
+	// Start and End are the timestamps of the first and the last probe, DurationSeconds the time between them
+	Start           time.Time
+	End             time.Time
+	DurationSeconds float64
+	// ProbeTraceIDs are the trace IDs of the NAT log entries of the search
+	ProbeTraceIDs []string
+	ServerVersion string
+	TraceID       string
+}
+
+func (e NATSearchSummary) getKey() string {
+	return fmt.Sprintf("%s/%s/%s-%s-%s-%s.json", "NATSummary", e.End.Format("2006/01/02/15"), e.IMEI, e.Protocol, e.End.Format("150405"), e.TraceID)
+}
+
+// deviceSearch is the search of a device for the NAT timeout of a protocol which has not ended yet
+type deviceSearch struct {
+	Summary     NATSearchSummary
+	LastIP      string
+	LastTimeout bool
+	LastSeen    time.Time
+}
+
+// searchTracker follows the searches of all devices, it is only used by the goroutine saving the log entries.
+// Searches which have not ended when the server shuts down are not summarized.
+type searchTracker struct {
+	Map map[string]*deviceSearch
+}
+
+func newSearchTracker() *searchTracker {
+	return &searchTracker{Map: make(map[string]*deviceSearch)}
+}
+
+// add records the probe of e seen at now, and returns the summary of its search if the search has converged
+func (t *searchTracker) add(e NATLogEntry, now time.Time) *NATSearchSummary {
+	key := e.Message.IMEI + "/" + e.Protocol
+	search, ok := t.Map[key]
+	if !ok {
+		search = &deviceSearch{Summary: NATSearchSummary{
+			IMEI:     e.Message.IMEI,
+			Protocol: e.Protocol,
+			Start:    e.Timestamp,
+		}}
+		t.Map[key] = search
+	} else if (e.IP != search.LastIP && !search.LastTimeout) || (e.QUIC != nil && e.QUIC.Migrated) {
+		search.Summary.Rebindings++
+	}
+	search.LastIP = e.IP
+	search.LastTimeout = e.Timeout
+	search.LastSeen = now
+
+	summary := &search.Summary
+	summary.ICCID = e.Message.ICCID
+	summary.Operator = e.Message.Operator
+	summary.End = e.Timestamp
+	summary.Probes++
+	summary.ProbeTraceIDs = append(summary.ProbeTraceIDs, e.TraceID)
+	if e.Timeout {
+		summary.Timeouts++
+		if summary.SmallestTimeout == 0 || e.Message.Interval < summary.SmallestTimeout {
+			summary.SmallestTimeout = e.Message.Interval
+		}
+	} else if !e.Interrupted && e.Message.Interval > summary.LargestSuccess {
+		summary.LargestSuccess = e.Message.Interval
+	}
+
+	// A timeout at or below the largest success is noise, e.g. a lost packet, and does not bracket the NAT timeout
+	if summary.LargestSuccess > 0 && summary.SmallestTimeout > summary.LargestSuccess && summary.SmallestTimeout-summary.LargestSuccess <= searchResolution {
+		return t.end(key, searchConverged)
+	}
+	return nil
+}
+
+// end removes the search of key and returns its summary
+func (t *searchTracker) end(key string, reason string) *NATSearchSummary {
+	summary := t.Map[key].Summary
+	delete(t.Map, key)
+	summary.Reason = reason
+	summary.DurationSeconds = summary.End.Sub(summary.Start).Seconds()
+	summary.ServerVersion = version
+	summary.TraceID = uuid.New().String()
+	return &summary
+}
+
+// expire ends the searches without a probe for idle before now
+func (t *searchTracker) expire(now time.Time, idle time.Duration) []NATSearchSummary {
+	var summaries []NATSearchSummary
+	for key, search := range t.Map {
+		if !search.LastSeen.Add(idle).After(now) {
+			summaries = append(summaries, *t.end(key, searchIdle))
+		}
+	}
+	return summaries
+}
+
+// nextExpiry returns when the next search idles for idle, it returns false if there is no search
+func (t *searchTracker) nextExpiry(idle time.Duration) (time.Time, bool) {
+	var next time.Time
+	for _, search := range t.Map {
+		if at := search.LastSeen.Add(idle); next.IsZero() || at.Before(next) {
+			next = at
+		}
+	}
+	return next, !next.IsZero()
+}
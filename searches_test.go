@@ -0,0 +1,108 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+// searchEntry returns the NAT log entry of a probe of the device 352656100367872 from addr
+func searchEntry(addr string, interval int, timeout bool, timestamp time.Time) NATLogEntry {
+	e := estimateEntry("UDP", interval, timeout)
+	e.IP = addr
+	e.Timestamp = timestamp
+	e.TraceID = uuid.New().String()
+	e.Message.IMEI = "352656100367872"
+	return e
+}
+
+// searchSummaries returns the search summaries saved to s so far
+func (s *memorySink) searchSummaries() []NATSearchSummary {
+	s.Mux.Lock()
+	defer s.Mux.Unlock()
+	var summaries []NATSearchSummary
+	for _, entry := range s.Entries {
+		if summary, ok := entry.(NATSearchSummary); ok {
+			summaries = append(summaries, summary)
+		}
+	}
+	return summaries
+}
+
+func TestSearchTracker(t *testing.T) {
+	assert := assert.New(t)
+	tracker := newSearchTracker()
+	start := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	assert.Nil(tracker.add(searchEntry("192.0.2.1:1000", 60, false, start), start))
+	// The follow-up of the successful probe arrives from a new port
+	assert.Nil(tracker.add(searchEntry("192.0.2.1:1001", 120, true, start.Add(time.Minute)), start))
+	assert.Nil(tracker.add(searchEntry("192.0.2.1:1002", 90, false, start.Add(3*time.Minute)), start))
+	summary := tracker.add(searchEntry("192.0.2.1:1002", 91, true, start.Add(5*time.Minute)), start)
+	if assert.NotNil(summary, "The search has converged once the bracket is a second wide") {
+		assert.Equal(searchConverged, summary.Reason)
+		assert.Equal("352656100367872", summary.IMEI)
+		assert.Equal("24201", summary.Operator)
+		assert.Equal("UDP", summary.Protocol)
+		assert.Equal(90, summary.LargestSuccess)
+		assert.Equal(91, summary.SmallestTimeout)
+		assert.Equal(4, summary.Probes)
+		assert.Equal(2, summary.Timeouts)
+		assert.Equal(1, summary.Rebindings, "A new address after a timeout is no rebinding")
+		assert.Equal(300.0, summary.DurationSeconds)
+		assert.Len(summary.ProbeTraceIDs, 4)
+		assert.NotEmpty(summary.TraceID)
+	}
+	assert.Empty(tracker.Map, "The converged search should be removed")
+
+	// A timeout below a success received out of order does not bracket the NAT timeout
+	assert.Nil(tracker.add(searchEntry("192.0.2.1:1000", 120, false, start), start))
+	assert.Nil(tracker.add(searchEntry("192.0.2.1:1000", 60, true, start.Add(time.Minute)), start), "The search should not converge on a negative bracket")
+	summaries := tracker.expire(start.Add(2*time.Minute), time.Minute)
+	if assert.Len(summaries, 1, "The search should be left to idle") {
+		assert.Equal(searchIdle, summaries[0].Reason)
+		assert.Equal(120, summaries[0].LargestSuccess)
+		assert.Equal(60, summaries[0].SmallestTimeout)
+	}
+
+	tracker.add(searchEntry("192.0.2.1:1000", 60, false, start), start)
+	_, ok := tracker.nextExpiry(time.Minute)
+	assert.True(ok, "The search should expire")
+	assert.Empty(tracker.expire(start.Add(59*time.Second), time.Minute), "The search has not idled yet")
+	summaries = tracker.expire(start.Add(time.Minute), time.Minute)
+	if assert.Len(summaries, 1) {
+		assert.Equal(searchIdle, summaries[0].Reason)
+		assert.Equal(60, summaries[0].LargestSuccess)
+		assert.Zero(summaries[0].SmallestTimeout)
+	}
+	_, ok = tracker.nextExpiry(time.Minute)
+	assert.False(ok, "No search should be left")
+}
+
+func TestSearchSummaries(t *testing.T) {
+	assert := assert.New(t)
+	sink := &memorySink{}
+	server, clock := newFakeClockServer(t, sink)
+	start := clock.Now()
+
+	server.writeLog <- searchEntry("192.0.2.1:1000", 60, false, start)
+	server.writeLog <- searchEntry("192.0.2.1:1000", 61, true, start)
+	assert.Eventually(func() bool {
+		return len(sink.searchSummaries()) == 1
+	}, replyTimeout, time.Millisecond, "The converged search should be saved")
+
+	server.writeLog <- searchEntry("192.0.2.1:1000", 60, false, start)
+	assert.True(clock.WaitForTimer(server.config.SearchIdleTimeout), "The server should wait for the device to idle")
+	clock.Advance(server.config.SearchIdleTimeout)
+	assert.Eventually(func() bool {
+		return len(sink.searchSummaries()) == 2
+	}, replyTimeout, time.Millisecond, "The idle search should be saved")
+	summaries := sink.searchSummaries()
+	if assert.Len(summaries, 2) {
+		assert.Equal(searchConverged, summaries[0].Reason)
+		assert.Equal(searchIdle, summaries[1].Reason)
+		assert.Equal(1, summaries[1].Probes)
+	}
+}
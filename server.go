@@ -2,24 +2,27 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"log"
+	"log/slog"
+	"math/rand"
 	"net"
+	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strconv"
-	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/request"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/google/uuid"
+	"github.com/pion/dtls/v3"
 	"github.com/xeipuuv/gojsonschema"
 )
 
@@ -60,15 +63,25 @@ type ATLogEntry struct {
 type NATLogEntry struct {
 	Protocol      string
 	IP            string
+	AddressFamily string
+	LocalAddr     string
+	LocalPort     int
 	Timeout       bool
+	Interrupted   bool
 	Timestamp     time.Time
 	Message       deviceMessage
 	ServerVersion string
 	TraceID       string
+	TLS           *TLSInfo  `json:",omitempty"`
+	DTLS          *DTLSInfo `json:",omitempty"`
+	CoAP          *CoAPInfo `json:",omitempty"`
+	MQTT          *MQTTInfo `json:",omitempty"`
+	HTTP          *HTTPInfo `json:",omitempty"`
+	QUIC          *QUICInfo `json:",omitempty"`
 }
 
 type udpClientTimeout struct {
-	Timeout *time.Timer
+	Timeout *scheduledTask
 	Log     NATLogEntry
 }
 
@@ -77,24 +90,152 @@ type udpClientTimeoutMap struct {
 	Mux sync.Mutex
 }
 
-var udpPort = 3050
-var tcpPort = 3051
-var atPort = 3060
+// udpReplyMap stores the delayed replies to UDP probes by the trace ID of the probe
+type udpReplyMap struct {
+	Map map[string]udpClientTimeout
+	Mux sync.Mutex
+}
+
+// Config configures a Server, use defaultConfig to start from the default values
+type Config struct {
+	UDPPorts             []int
+	TCPPorts             []int
+	TLSPorts             []int
+	DTLSPorts            []int
+	CoAPPorts            []int
+	MQTTPorts            []int
+	HTTPPorts            []int
+	QUICPorts            []int
+	ATPort               int
+	IPMode               string
+	BufferSize           int
+	NATSchemaFile        string
+	ATSchemaFile         string
+	UDPTimeout           time.Duration
+	UploadTimeout        time.Duration
+	MaxInterval          int
+	MaxPendingPerAddress int
+	MaxHandlers          int
+	// MaxLogBacklog is the number of unsaved log entries from which on the server reports it is not ready
+	MaxLogBacklog int
+	// MQTTKeepAlivePercent is how long the server waits for a packet from an MQTT client in percent of its keep alive interval
+	MQTTKeepAlivePercent int
+	// SearchIdleTimeout is how long a device may not send a probe before the summary of its search is saved
+	SearchIdleTimeout time.Duration
+
+	// Sink stores the log entries, it is required
+	Sink Sink
+	// Clock is the source of time for all timeouts
+	Clock Clock
+	// Random returns numbers in [0, 1) to spread timeouts which must not be synchronized, like CoAP retransmissions
+	Random func() float64
+	// Sessions keeps the clients waiting to follow up across restarts, they are not kept if it is nil
+	Sessions SessionStore
+	// History holds the log entries saved before the server started, the timeout estimates are seeded from its NAT log entries if it is set.
+	// HistoryPrefix is the prefix of their keys, like the prefix of the sink.
+	History       objectStore
+	HistoryPrefix string
+	// UDPConns, TCPListeners, TLSListeners, CoAPConns, MQTTListeners, HTTPListeners, QUICConns and ATListener are used instead of listening on the configured ports if set,
+	// DTLS listeners are always opened on DTLSPorts.
+	// TLSListeners accept plain TCP connections, the server wraps them in TLS.
+	UDPConns      []net.PacketConn
+	TCPListeners  []net.Listener
+	TLSListeners  []net.Listener
+	CoAPConns     []net.PacketConn
+	MQTTListeners []net.Listener
+	HTTPListeners []net.Listener
+	QUICConns     []net.PacketConn
+	ATListener    net.Listener
+	// TLSConfig holds the certificate of the TLS listeners, it is required if there are any
+	TLSConfig *tls.Config
+	// DTLSConfig holds the pre-shared key of the DTLS listeners, it is required if there are any
+	DTLSConfig *dtls.Config
+	// MonitoringAddr is the address the metrics and health checks are served on, they are not served if it is empty.
+	// MonitoringListener is used instead if set.
+	MonitoringAddr     string
+	MonitoringListener net.Listener
+	// AdminToken is the bearer token of the admin API on the monitoring listener, the API is not served if it is empty
+	AdminToken string
+	// QUICTLSConfig holds the certificate of the QUIC listeners, a self-signed certificate is generated if it is nil
+	QUICTLSConfig *tls.Config
+}
+
+// Server receives NAT test and AT command messages and saves their results to the Sink
+type Server struct {
+	config Config
+
+	writeLog        chan logEntry
+	natSchemaLoader gojsonschema.JSONLoader
+	atSchemaLoader  gojsonschema.JSONLoader
+
+	// updClientTimeouts stores timers to wait for UDP client responses
+	updClientTimeouts udpClientTimeoutMap
+	// udpReplies stores the UDP probes waiting out their interval before the server replies
+	udpReplies udpReplyMap
+	// scheduler runs the delayed UDP responses and timeouts
+	scheduler *scheduler
+
+	pendingProbes   pendingProbeMap
+	handlerSlots    chan struct{}
+	runningHandlers sync.WaitGroup
+	rejections      rejectionCounters
+
+	// stopping is closed once the server starts shutting down
+	stopping         chan struct{}
+	openConnections  openConnectionSet
+	runningAcceptors sync.WaitGroup
+	// acceptorErrors are the listeners which stopped accepting while the server was running
+	acceptorErrors acceptorErrorMap
+
+	// saved is done once all log entries have been saved
+	saved          sync.WaitGroup
+	cancelUploads  func()
+	uploadFailures int64
+	// logBacklog counts the log entries handed to the sink which are not saved yet
+	logBacklog int64
+	lastUpload uploadState
+
+	udpListeners  []*udpListener
+	tcpListeners  []net.Listener
+	tlsListeners  []net.Listener
+	dtlsListeners []net.Listener
+	coapListeners []*udpListener
+	mqttListeners []net.Listener
+	httpListeners []net.Listener
+	quicListeners []net.Listener
+	atListeners   []net.Listener
+	// httpServer serves the long-poll and WebSocket endpoints on httpListeners
+	httpServer *http.Server
+
+	metrics             *metrics
+	monitoringListeners []net.Listener
+	// monitoringServer serves the metrics and health checks on monitoringListeners until the server has shut down
+	monitoringServer *http.Server
+	// eventSubscribers receive every log entry handed to the sink
+	eventSubscribers eventSubscriberMap
+	// timeoutIndex estimates the NAT timeouts from the log entries handed to the sink
+	timeoutIndex *timeoutIndex
+
+	// dtlsSessions stores the DTLS session of each device to detect when it is lost
+	dtlsSessions dtlsSessionMap
+	// coapExchanges stores the CoAP requests waiting for their response to be sent or acknowledged
+	coapExchanges coapExchangeMap
+	coapMessageID uint32
+}
+
 var version = "0.0.0-development"
 
+const defaultUDPPort = 3050
+const defaultTCPPort = 3051
+const defaultATPort = 3060
 const newUDPMessageTimeoutInSeconds = 60
+const uploadTimeoutInSeconds = 60
 const maxBufferSize = 256
 const natSchemaFile = "nat_schema.json"
 const atSchemaFile = "at_schema.json"
 const timeFormat = "2006-01-02T15:04:05.00-0700"
 
 var genericErrorMessage []byte = []byte(fmt.Sprintf("Error occured.\nConnection closed.\nVersion: %s\n", version))
-var writeLog chan logEntry
-var natSchemaLoader gojsonschema.JSONLoader
-var atSchemaLoader gojsonschema.JSONLoader
-
-// updClientTimeouts stores timers to wait for UDP client responses
-var updClientTimeouts udpClientTimeoutMap
 
 func (e NATLogEntry) getKey() string {
 	return fmt.Sprintf("%s/%s/%s-%s-%s.json", "NATLog", e.Timestamp.Format("2006/01/02/15"), e.IP, e.Timestamp.Format("150405"), e.TraceID)
@@ -104,82 +245,275 @@ func (e ATLogEntry) getKey() string {
 	return fmt.Sprintf("%s/%s/%s-%s-%s.json", "ATLog", e.Timestamp.Format("2006/01/02/15"), e.IP, e.Timestamp.Format("150405"), e.TraceID)
 }
 
-func saveLog(awsBucket string, prefix string) {
-	sess, err := session.NewSession(&aws.Config{})
-	if err != nil {
-		log.Fatal("Error creating session ", err)
+// defaultConfig returns the configuration the server uses unless told otherwise
+func defaultConfig() Config {
+	return Config{
+		UDPPorts:             []int{defaultUDPPort},
+		TCPPorts:             []int{defaultTCPPort},
+		ATPort:               defaultATPort,
+		IPMode:               ipModeSystem,
+		BufferSize:           maxBufferSize,
+		NATSchemaFile:        natSchemaFile,
+		ATSchemaFile:         atSchemaFile,
+		UDPTimeout:           newUDPMessageTimeoutInSeconds * time.Second,
+		UploadTimeout:        uploadTimeoutInSeconds * time.Second,
+		MaxInterval:          defaultMaxInterval,
+		MaxPendingPerAddress: defaultMaxPendingPerAddress,
+		MaxHandlers:          defaultMaxHandlers,
+		MaxLogBacklog:        defaultMaxLogBacklog,
+		MQTTKeepAlivePercent: defaultMQTTKeepAlivePercent,
+		SearchIdleTimeout:    defaultSearchIdleTimeoutInSeconds * time.Second,
+		Clock:                realClock{},
+		Random:               rand.Float64,
 	}
-	svc := s3.New(sess, &aws.Config{})
+}
 
-	for i := range writeLog {
-		buffer, err := json.Marshal(i)
+// NewServer creates a server for config, which starts receiving messages once Start is called
+func NewServer(config Config) (*Server, error) {
+	if config.Sink == nil {
+		return nil, errors.New("No sink configured")
+	}
+	if config.Clock == nil {
+		config.Clock = realClock{}
+	}
+	if config.Random == nil {
+		config.Random = rand.Float64
+	}
+	if config.MaxInterval < 1 || config.MaxPendingPerAddress < 1 || config.MaxHandlers < 1 || config.MaxLogBacklog < 1 || config.MQTTKeepAlivePercent < 1 {
+		return nil, errors.New("Limits must be positive")
+	}
+	if config.BufferSize < 1 {
+		return nil, errors.New("Buffer size must be positive")
+	}
+	if config.SearchIdleTimeout <= 0 {
+		return nil, errors.New("Search idle timeout must be positive")
+	}
+	if len(config.TLSPorts)+len(config.TLSListeners) > 0 && config.TLSConfig == nil {
+		return nil, errors.New("No TLS certificate configured")
+	}
+	if len(config.DTLSPorts) > 0 && config.DTLSConfig == nil {
+		return nil, errors.New("No DTLS pre-shared key configured")
+	}
+	if len(config.QUICPorts)+len(config.QUICConns) > 0 && config.QUICTLSConfig == nil {
+		var err error
+		config.QUICTLSConfig, err = newSelfSignedTLSConfig()
 		if err != nil {
-			log.Printf("JSON invalid. Cannot write to file, error: %d\n", err)
-			return
+			return nil, err
 		}
+	}
+
+	s := &Server{
+		config:            config,
+		writeLog:          make(chan logEntry),
+		updClientTimeouts: udpClientTimeoutMap{Map: make(map[string]udpClientTimeout)},
+		udpReplies:        udpReplyMap{Map: make(map[string]udpClientTimeout)},
+		scheduler:         newScheduler(config.Clock),
+		pendingProbes:     pendingProbeMap{Map: make(map[string]int)},
+		handlerSlots:      make(chan struct{}, config.MaxHandlers),
+		stopping:          make(chan struct{}),
+		openConnections:   openConnectionSet{Map: make(map[net.Conn]*openConnection), ByAddr: make(map[string]*openConnection)},
+		dtlsSessions:      dtlsSessionMap{Map: make(map[string]*dtlsSession)},
+		coapExchanges:     coapExchangeMap{Map: make(map[string]*coapExchange), Pending: make(map[string]*coapExchange)},
+		eventSubscribers:  eventSubscriberMap{Map: make(map[chan logEntry]eventFilter)},
+		acceptorErrors:    acceptorErrorMap{Map: make(map[string]error)},
+		timeoutIndex:      newTimeoutIndex(),
+		cancelUploads:     func() {},
+	}
+	s.metrics = newMetrics(s)
+	return s, nil
+}
+
+// schemaLoader returns a loader for the JSON schema in file
+func schemaLoader(file string) (gojsonschema.JSONLoader, error) {
+	absPath, err := filepath.Abs(file)
+	if err != nil {
+		return nil, err
+	}
+	return gojsonschema.NewReferenceLoader(fmt.Sprintf("file://%s", absPath)), nil
+}
+
+// Start listens on the configured ports and starts handling messages.
+// Canceling ctx aborts the uploads in progress, use Shutdown to stop the server.
+func (s *Server) Start(ctx context.Context) error {
+	var err error
+
+	// Initialize the schema loaders
+	s.natSchemaLoader, err = schemaLoader(s.config.NATSchemaFile)
+	if err != nil {
+		return err
+	}
+	s.atSchemaLoader, err = schemaLoader(s.config.ATSchemaFile)
+	if err != nil {
+		return err
+	}
+
+	// Start listening on ports
+	err = s.listen()
+	if err != nil {
+		s.closeListeners()
+		closeAll(s.monitoringListeners)
+		return err
+	}
+
+	var uploadCtx context.Context
+	uploadCtx, s.cancelUploads = context.WithCancel(ctx)
+	s.saved.Add(1)
+	go s.saveLog(uploadCtx)
+	go s.scheduler.Run()
+
+	// Pick up the sessions of the previous server before new messages arrive
+	s.restoreSessions()
+	// The estimates are incomplete until the history is read, the server does not wait for it
+	if s.config.History != nil {
+		go s.seedTimeoutIndex(s.config.Clock.Now())
+	}
 
-		key := i.getKey()
-		log.Printf("Uploading %s: %s", key, buffer)
+	s.runningAcceptors.Add(len(s.udpListeners) + len(s.tcpListeners) + len(s.tlsListeners) + len(s.dtlsListeners) + len(s.coapListeners) + len(s.mqttListeners) + len(s.httpListeners) + len(s.quicListeners) + len(s.atListeners))
+	for _, l := range s.udpListeners {
+		go s.acceptUDP(l)
+	}
+	for _, l := range s.tcpListeners {
+		go s.acceptTCP(l)
+	}
+	for _, l := range s.tlsListeners {
+		go s.acceptTLS(l)
+	}
+	for _, l := range s.dtlsListeners {
+		go s.acceptDTLS(l)
+	}
+	for _, l := range s.coapListeners {
+		go s.acceptCoAP(l)
+	}
+	for _, l := range s.mqttListeners {
+		go s.acceptMQTT(l)
+	}
+	s.httpServer = s.newHTTPServer()
+	for _, l := range s.httpListeners {
+		go s.acceptHTTP(l)
+	}
+	for _, l := range s.quicListeners {
+		go s.acceptQUIC(l)
+	}
+	for _, l := range s.atListeners {
+		go s.acceptAT(l)
+	}
+	s.monitoringServer = s.newMonitoringServer()
+	for _, l := range s.monitoringListeners {
+		go s.serveMonitoring(l)
+	}
 
-		ctx := context.Background()
-		var cancelFn func()
-		ctx, cancelFn = context.WithTimeout(ctx, 60*time.Second)
+	attrs := []any{"version", version, "tcpPorts", joinAddrs(s.TCPAddrs()), "udpPorts", joinAddrs(s.UDPAddrs())}
+	optional := []struct {
+		key   string
+		addrs []net.Addr
+	}{
+		{"tlsPorts", s.TLSAddrs()},
+		{"dtlsPorts", s.DTLSAddrs()},
+		{"coapPorts", s.CoAPAddrs()},
+		{"mqttPorts", s.MQTTAddrs()},
+		{"httpPorts", s.HTTPAddrs()},
+		{"quicPorts", s.QUICAddrs()},
+		{"monitoring", listenerAddrs(s.monitoringListeners)},
+	}
+	for _, o := range optional {
+		if len(o.addrs) > 0 {
+			attrs = append(attrs, o.key, joinAddrs(o.addrs))
+		}
+	}
+	attrs = append(attrs, "atPorts", joinAddrs(s.ATAddrs()), "ipMode", s.config.IPMode,
+		"maxInterval", s.config.MaxInterval, "maxPending", s.config.MaxPendingPerAddress, "maxHandlers", s.config.MaxHandlers)
+	slog.Info("NAT Test Server started", attrs...)
+	return nil
+}
 
-		go func() {
-			var Key = key
-			if len(prefix) > 0 {
-				Key = fmt.Sprintf("%s/%s", prefix, key)
+// saveLog saves the entries sent to writeLog until it is closed,
+// and the summary of each device's search once it has converged or idled for the search idle timeout
+func (s *Server) saveLog(ctx context.Context) {
+	defer s.saved.Done()
+	searches := newSearchTracker()
+	idle := s.config.Clock.NewTimer(time.Hour)
+	idle.Stop()
+	defer idle.Stop()
+	for {
+		select {
+		case entry, ok := <-s.writeLog:
+			if !ok {
+				return
 			}
-			_, err = svc.PutObjectWithContext(ctx, &s3.PutObjectInput{
-				Bucket: aws.String(awsBucket),
-				Key:    aws.String(Key),
-				Body:   strings.NewReader(string(buffer)),
-			})
-			if err != nil {
-				if aerr, ok := err.(awserr.Error); ok && aerr.Code() == request.CanceledErrorCode {
-					log.Printf("Upload canceled due to timeout, %s\n", err.Error())
-				} else {
-					log.Printf("Failed to upload object, %s\n", err.Error())
+			s.save(ctx, entry)
+			if e, ok := entry.(NATLogEntry); ok {
+				if summary := searches.add(e, s.config.Clock.Now()); summary != nil {
+					s.save(ctx, *summary)
 				}
 			}
-
-			if cancelFn != nil {
-				cancelFn()
+		case <-idle.C():
+			for _, summary := range searches.expire(s.config.Clock.Now(), s.config.SearchIdleTimeout) {
+				s.save(ctx, summary)
 			}
-		}()
+		}
+		idle.Stop()
+		if next, ok := searches.nextExpiry(s.config.SearchIdleTimeout); ok {
+			idle.Reset(next.Sub(s.config.Clock.Now()))
+		}
 	}
 }
 
+// save hands entry to the sink in the background
+func (s *Server) save(ctx context.Context, entry logEntry) {
+	ctx, cancelFn := context.WithTimeout(ctx, s.config.UploadTimeout)
+	atomic.AddInt64(&s.logBacklog, 1)
+	s.metrics.observeQueued(entry)
+	s.publish(entry)
+	s.timeoutIndex.add(entry)
+
+	s.saved.Add(1)
+	go func() {
+		defer s.saved.Done()
+		defer cancelFn()
+		start := time.Now()
+		err := s.config.Sink.Save(ctx, entry)
+		s.metrics.observeSaved(time.Since(start))
+		atomic.AddInt64(&s.logBacklog, -1)
+		s.recordUpload(err)
+		if err != nil {
+			atomic.AddInt64(&s.uploadFailures, 1)
+		}
+	}()
+}
+
 // HandleAT Handle AT cmd messages
-func handleAT(conn net.Conn) {
+func (s *Server) handleAT(conn net.Conn) {
 	for {
-		buffer := make([]byte, maxBufferSize)
+		buffer := make([]byte, s.config.BufferSize)
 
 		n, err := conn.Read(buffer)
 		if err != nil {
 			conn.Close()
-			log.Printf("Error reading TCP connection %s, error: %s", conn.RemoteAddr().String(), err.Error())
+			connLogger("AT", conn.RemoteAddr()).Info("Error reading AT connection", "error", err)
 			break
 		}
-		timestamp := time.Now()
+		timestamp := s.config.Clock.Now()
+		s.metrics.messagesReceived.WithLabelValues("AT").Inc()
 
 		traceID, err := uuid.NewRandom()
 		if err != nil {
-			log.Printf("Failed to create new UUID: %d\n", err)
+			slog.Error("Failed to create new UUID", "error", err)
 			conn.Write(genericErrorMessage)
 			conn.Close()
 			break
 		}
 
 		documentLoader := gojsonschema.NewStringLoader(string(buffer))
-		result, err := gojsonschema.Validate(atSchemaLoader, documentLoader)
+		result, err := gojsonschema.Validate(s.atSchemaLoader, documentLoader)
 		if err != nil {
-			log.Printf("JSON validation error: %d\nConnection to %s terminated.\n", err, conn.RemoteAddr().String())
+			s.metrics.schemaFailures.WithLabelValues("at").Inc()
+			connLogger("AT", conn.RemoteAddr()).Warn("AT command JSON validation failed, connection terminated", "error", err)
 			conn.Write(genericErrorMessage)
 			conn.Close()
 			break
 		} else if !result.Valid() {
-			log.Printf("Invalid AT-cmd JSON format.\nConnection to %s terminated.\n", conn.RemoteAddr().String())
+			s.metrics.schemaFailures.WithLabelValues("at").Inc()
+			connLogger("AT", conn.RemoteAddr()).Warn("Invalid AT command JSON format, connection terminated")
 			conn.Write(genericErrorMessage)
 			conn.Close()
 			break
@@ -188,13 +522,14 @@ func handleAT(conn net.Conn) {
 		var message atMessage
 		err = json.Unmarshal(buffer[:n-1], &message)
 		if err != nil {
-			log.Printf("Failed to unmarshal JSON, error: %d.\n", err)
+			connLogger("AT", conn.RemoteAddr()).Warn("Failed to unmarshal AT command JSON, connection terminated", "error", err)
 			conn.Write(genericErrorMessage)
 			conn.Close()
 			break
 		}
 
-		log.Printf("AT-cmd Message received from %s\n", conn.RemoteAddr().String())
+		connLogger("AT", conn.RemoteAddr()).Debug("AT command message received", "traceID", traceID.String(), "imei", message.IMEI)
+		s.updateConnection(conn.LocalAddr(), conn.RemoteAddr(), message.IMEI, message.Operator, 0, traceID.String())
 
 		saveData := ATLogEntry{
 			IP:            conn.RemoteAddr().String(),
@@ -204,7 +539,7 @@ func handleAT(conn net.Conn) {
 			TraceID:       traceID.String(),
 		}
 
-		writeLog <- saveData
+		s.writeLog <- saveData
 
 		retString := fmt.Sprintf(
 			"AT-cmd message received.\nVersion:  %s\nTraceID:  %s\n", version, traceID,
@@ -213,252 +548,428 @@ func handleAT(conn net.Conn) {
 	}
 }
 
-// HandleData read incoming data from the handed buffer and pause execution based on the requested interval
-func HandleData(buffer []byte, protocol string, addr string) ([]byte, NATLogEntry, error) {
-	timestamp := time.Now()
+// HandleData read incoming data from the handed buffer and pause execution based on the requested interval.
+// The message was sent from the client at remote to the server's address local.
+func (s *Server) HandleData(buffer []byte, protocol string, remote net.Addr, local net.Addr) ([]byte, NATLogEntry, error) {
+	logEntry, err := s.parseData(buffer, protocol, remote, local)
+	if err != nil {
+		return nil, NATLogEntry{}, err
+	}
+	s.updateConnection(local, remote, logEntry.Message.IMEI, logEntry.Message.Operator, logEntry.Message.Interval, logEntry.TraceID)
 
-	traceID, err := uuid.NewRandom()
+	err = s.acquirePendingProbe(logEntry.IP)
 	if err != nil {
-		log.Printf("Failed to create new UUID: %d\n", err)
 		return nil, NATLogEntry{}, err
 	}
+	defer s.releasePendingProbe(logEntry.IP)
+
+	timer := s.config.Clock.NewTimer(time.Duration(logEntry.Message.Interval) * time.Second)
+	select {
+	case <-timer.C():
+	case <-s.stopping:
+		timer.Stop()
+		logEntry.Interrupted = true
+		return nil, logEntry, errInterrupted
+	}
+
+	return s.replyData(logEntry), logEntry, nil
+}
+
+// parseData validates the message in the handed buffer and prepares its log entry
+func (s *Server) parseData(buffer []byte, protocol string, remote net.Addr, local net.Addr) (NATLogEntry, error) {
+	timestamp := s.config.Clock.Now()
+	s.metrics.messagesReceived.WithLabelValues(protocol).Inc()
+
+	traceID, err := uuid.NewRandom()
+	if err != nil {
+		slog.Error("Failed to create new UUID", "error", err)
+		return NATLogEntry{}, err
+	}
 
 	documentLoader := gojsonschema.NewStringLoader(string(buffer))
-	result, err := gojsonschema.Validate(natSchemaLoader, documentLoader)
+	result, err := gojsonschema.Validate(s.natSchemaLoader, documentLoader)
 	if err != nil {
-		return nil, NATLogEntry{}, err
+		s.metrics.schemaFailures.WithLabelValues("nat").Inc()
+		return NATLogEntry{}, err
 	} else if !result.Valid() {
-		return nil, NATLogEntry{}, errors.New("Message uses wrong format")
+		s.metrics.schemaFailures.WithLabelValues("nat").Inc()
+		return NATLogEntry{}, errors.New("Message uses wrong format")
 	}
 
 	var message deviceMessage
 	err = json.Unmarshal(buffer, &message)
 	if err != nil {
-		return nil, NATLogEntry{}, err
+		return NATLogEntry{}, err
 	}
 
-	log.Printf("[%s] %s Message received from %s: interval %s\n", traceID, protocol, addr, strconv.Itoa(message.Interval))
-
-	time.Sleep(time.Duration(message.Interval) * time.Second)
-
-	endTime := time.Now().Format(timeFormat)
+	err = s.checkInterval(message.Interval)
+	if err != nil {
+		return NATLogEntry{}, err
+	}
+	s.metrics.intervals.Observe(float64(message.Interval))
 
-	retString := fmt.Sprintf(
-		"Interval: %s\nReturned: %s\nVersion:  %s\nTraceID:  %s\n", strconv.Itoa(message.Interval), endTime, version, traceID,
-	)
-	saveData := NATLogEntry{
+	logEntry := NATLogEntry{
 		Timestamp:     timestamp,
 		Protocol:      protocol,
-		IP:            addr,
+		IP:            remote.String(),
+		AddressFamily: addressFamily(remote),
+		LocalAddr:     local.String(),
+		LocalPort:     localPort(local),
 		Timeout:       false,
 		Message:       message,
 		ServerVersion: version,
 		TraceID:       traceID.String(),
 	}
-	return []byte(retString), saveData, nil
+	entryLogger(logEntry).Debug("Message received", "local", logEntry.LocalAddr, "family", logEntry.AddressFamily)
+	return logEntry, nil
+}
+
+// replyData returns the response sent to the client once the interval of logEntry has passed
+func (s *Server) replyData(logEntry NATLogEntry) []byte {
+	endTime := s.config.Clock.Now().Format(timeFormat)
+
+	retString := fmt.Sprintf(
+		"Interval: %s\nReturned: %s\nVersion:  %s\nTraceID:  %s\n", strconv.Itoa(logEntry.Message.Interval), endTime, version, logEntry.TraceID,
+	)
+	return []byte(retString)
 }
 
 // handleUDP handle UDP messages.
 // Timeouts are detected by waiting for a client to send a new message withing 60 seconds after having sent the delayed response.
-func handleUDP(pc net.PacketConn, addr net.Addr, buffer []byte) {
-	retBuffer, logEntry, err := HandleData(buffer, "UDP", addr.String())
+// The delayed response and the timeout are run by the scheduler, so no goroutine waits for them.
+// The handler slot is held until the probe has either timed out or was followed up by the client.
+func (s *Server) handleUDP(conn net.PacketConn, addr net.Addr, local net.Addr, buffer []byte) {
+	logEntry, err := s.parseData(buffer, "UDP", addr, local)
+	if err == nil {
+		err = s.acquirePendingProbe(addr.String())
+	}
 	if err != nil {
-		log.Printf("HandleData Error: %s\nConnection to %s terminated.\n", err.Error(), addr.String())
-		pc.WriteTo(genericErrorMessage, addr)
+		connLogger("UDP", addr).Warn("UDP message rejected", "error", err)
+		conn.WriteTo(s.errorMessage(err), addr)
+		s.releaseHandler()
 		return
 	}
 
-	updClientTimeouts.Mux.Lock()
-	v, ok := updClientTimeouts.Map[addr.String()]
-	delete(updClientTimeouts.Map, addr.String())
-	updClientTimeouts.Mux.Unlock()
+	key := udpSessionKey(logEntry.LocalPort, addr.String())
+	s.updClientTimeouts.Mux.Lock()
+	v, ok := s.updClientTimeouts.Map[key]
+	delete(s.updClientTimeouts.Map, key)
+	s.updClientTimeouts.Mux.Unlock()
 	if ok {
-		v.Timeout.Stop()
+		s.scheduler.Cancel(v.Timeout)
 		if logEntry.Message.Interval <= v.Log.Message.Interval {
 			// The device did not receive our response and now starts with the binary search
 			// so it will send a message, but with a lower interval
 			v.Log.Timeout = true
 		}
-		writeLog <- v.Log
+		s.writeLog <- v.Log
+		s.releaseHandler()
 	}
 
-	_, err = pc.WriteTo(retBuffer, addr)
+	s.udpReplies.Mux.Lock()
+	defer s.udpReplies.Mux.Unlock()
+	task := s.scheduler.After(time.Duration(logEntry.Message.Interval)*time.Second, func() {
+		s.forgetUDPReply(logEntry.TraceID)
+		s.replyUDP(conn, addr, logEntry)
+	}, func() {
+		s.forgetUDPReply(logEntry.TraceID)
+		s.releasePendingProbe(addr.String())
+		entryLogger(logEntry).Info("UDP response interrupted")
+		logEntry.Interrupted = true
+		s.writeLog <- logEntry
+		s.releaseHandler()
+	})
+	s.udpReplies.Map[logEntry.TraceID] = udpClientTimeout{Timeout: task, Log: logEntry}
+}
+
+// forgetUDPReply removes the reply to the probe with traceID from udpReplies once it is due
+func (s *Server) forgetUDPReply(traceID string) {
+	s.udpReplies.Mux.Lock()
+	defer s.udpReplies.Mux.Unlock()
+	delete(s.udpReplies.Map, traceID)
+}
+
+// replyUDP sends the delayed response for logEntry and starts waiting for the client's next message
+func (s *Server) replyUDP(conn net.PacketConn, addr net.Addr, logEntry NATLogEntry) {
+	s.releasePendingProbe(addr.String())
+
+	_, err := conn.WriteTo(s.replyData(logEntry), addr)
 	if err != nil {
-		log.Printf("[%s] UDP write to %s failed, error: %s\n", logEntry.TraceID, addr.String(), err.Error())
+		entryLogger(logEntry).Warn("UDP write failed", "error", err)
+		s.releaseHandler()
 		return
 	}
-	log.Printf("[%s] UDP Packet sent to %s. Interval: %s.\n", logEntry.TraceID, addr.String(), strconv.Itoa(logEntry.Message.Interval))
+	entryLogger(logEntry).Debug("UDP packet sent")
 
-	timer := time.NewTimer(newUDPMessageTimeoutInSeconds * time.Second)
-	updClientTimeouts.Mux.Lock()
-	updClientTimeouts.Map[addr.String()] = udpClientTimeout{Timeout: timer, Log: logEntry}
-	updClientTimeouts.Mux.Unlock()
-	select {
-	case <-timer.C:
-		updClientTimeouts.Mux.Lock()
-		delete(updClientTimeouts.Map, addr.String())
-		updClientTimeouts.Mux.Unlock()
-		log.Printf("[%s] UDP connection to %s timed out. Connection terminated. Interval: %s.\n", logEntry.TraceID, addr, strconv.Itoa(logEntry.Message.Interval))
-		logEntry.Timeout = true
-		writeLog <- logEntry
+	s.awaitUDPFollowUp(addr.String(), logEntry, s.config.UDPTimeout)
+}
+
+// awaitUDPFollowUp waits d for the client at addr to send its next message to the same port, and records logEntry as timed out otherwise
+func (s *Server) awaitUDPFollowUp(addr string, logEntry NATLogEntry, d time.Duration) {
+	key := udpSessionKey(logEntry.LocalPort, addr)
+	var task *scheduledTask
+	// owned removes the timeout from updClientTimeouts, it returns false if the client has followed up in the meantime
+	owned := func() bool {
+		s.updClientTimeouts.Mux.Lock()
+		defer s.updClientTimeouts.Mux.Unlock()
+		v, ok := s.updClientTimeouts.Map[key]
+		if !ok || v.Timeout != task {
+			return false
+		}
+		delete(s.updClientTimeouts.Map, key)
+		return true
 	}
+	s.updClientTimeouts.Mux.Lock()
+	task = s.scheduler.After(d, func() {
+		if !owned() {
+			return
+		}
+		entryLogger(logEntry).Info("No UDP message within the UDP timeout", "timeout", d)
+		logEntry.Timeout = true
+		s.writeLog <- logEntry
+		s.releaseHandler()
+	}, func() {
+		if !owned() {
+			return
+		}
+		entryLogger(logEntry).Info("Waiting for UDP message interrupted")
+		logEntry.Interrupted = true
+		s.writeLog <- logEntry
+		s.releaseHandler()
+	})
+	s.updClientTimeouts.Map[key] = udpClientTimeout{Timeout: task, Log: logEntry}
+	s.updClientTimeouts.Mux.Unlock()
 }
 
 // handleTCP handle TCP messages.
+func (s *Server) handleTCP(conn net.Conn) {
+	s.handleStream(conn, "TCP", nil)
+}
+
+// handleStream handles the messages of a TCP or TLS connection, tlsInfo describes the TLS session if there is one.
 // Timouts are detected by checking for successfull TCP writes.
-func handleTCP(conn net.Conn) {
+func (s *Server) handleStream(conn net.Conn, protocol string, tlsInfo *TLSInfo) {
 	var logEntry NATLogEntry
 	for {
-		buffer := make([]byte, maxBufferSize)
+		buffer := make([]byte, s.config.BufferSize)
 
 		n, err := conn.Read(buffer)
 		if err != nil {
 			conn.Close()
-			if logEntry.Protocol != "" {
-				log.Printf("[%s] Error reading TCP connection %s, error: %s. Interval: %s.", logEntry.TraceID, conn.RemoteAddr().String(), err.Error(), strconv.Itoa(logEntry.Message.Interval))
+			if logEntry.Protocol != "" && s.connectionInterrupted(conn) {
+				entryLogger(logEntry).Info("Waiting for " + protocol + " message interrupted")
+				// Store log from previous interval
+				logEntry.Interrupted = true
+				s.writeLog <- logEntry
+			} else if logEntry.Protocol != "" {
+				entryLogger(logEntry).Info("Error reading "+protocol+" connection", "error", err)
 				// Store log from previous interval
 				logEntry.Timeout = true
-				writeLog <- logEntry
+				s.writeLog <- logEntry
 			} else {
-				log.Printf("Error reading TCP connection %s, error: %s", conn.RemoteAddr().String(), err.Error())
+				connLogger(protocol, conn.RemoteAddr()).Warn("Error reading "+protocol+" connection", "error", err)
 			}
 			break
 		}
 		if logEntry.Protocol != "" {
 			// Store log from previous interval
-			writeLog <- logEntry
+			s.writeLog <- logEntry
 		}
 
 		var retBuffer []byte
-		retBuffer, logEntry, err = HandleData(buffer[:n-1], "TCP", conn.RemoteAddr().String())
-		if err != nil {
-			log.Printf("HandleData Error: %s\nConnection to %s terminated.\n", err.Error(), conn.RemoteAddr().String())
-			conn.Write(genericErrorMessage)
+		retBuffer, logEntry, err = s.HandleData(buffer[:n-1], protocol, conn.RemoteAddr(), conn.LocalAddr())
+		logEntry.TLS = tlsInfo
+		if err == errInterrupted {
+			entryLogger(logEntry).Info(protocol + " response interrupted")
+			s.writeLog <- logEntry
+			conn.Close()
+			break
+		} else if err != nil {
+			connLogger(protocol, conn.RemoteAddr()).Warn(protocol+" connection terminated", "error", err)
+			conn.Write(s.errorMessage(err))
 			conn.Close()
 			break
 		}
 
 		_, err = conn.Write(retBuffer)
-		if err != nil {
-			log.Printf("[%s] TCP write to %s failed. Connection terminated. Interval: %s.\n", logEntry.TraceID, conn.RemoteAddr().String(), strconv.Itoa(logEntry.Message.Interval))
+		if err != nil && s.connectionInterrupted(conn) {
+			entryLogger(logEntry).Info(protocol + " response interrupted")
+			logEntry.Interrupted = true
+			s.writeLog <- logEntry
+			conn.Close()
+			break
+		} else if err != nil {
+			entryLogger(logEntry).Warn(protocol+" write failed, connection terminated", "error", err)
 			logEntry.Timeout = true
-			writeLog <- logEntry
+			s.writeLog <- logEntry
 			conn.Close()
 			break
 		}
-		log.Printf("[%s] TCP Packet sent to %s. Interval: %s.\n", logEntry.TraceID, conn.RemoteAddr().String(), strconv.Itoa(logEntry.Message.Interval))
+		entryLogger(logEntry).Debug(protocol + " packet sent")
 	}
 }
 
-func acceptUDP(pc net.PacketConn) {
+func (s *Server) acceptUDP(l *udpListener) {
+	conn := l.Conn
+	defer s.runningAcceptors.Done()
 	for {
-		buffer := make([]byte, maxBufferSize)
+		buffer := make([]byte, s.config.BufferSize)
 
-		n, addr, err := pc.ReadFrom(buffer)
-		if err != nil {
-			log.Printf("Error reading UDP connection %s, error: %s", addr.String(), err.Error())
+		n, addr, local, err := l.ReadFrom(buffer)
+		if err != nil && s.isStopping() {
+			return
+		} else if err != nil && acceptFailed(err) {
+			s.recordAcceptorError("UDP", conn.LocalAddr(), err)
+			return
+		} else if err != nil {
+			slog.Warn("Error reading UDP listener", "local", conn.LocalAddr().String(), "error", err)
+			continue
+		}
+		// The last byte is cut off below, an empty datagram has none
+		if n == 0 {
+			connLogger("UDP", addr).Warn("Empty UDP datagram ignored")
 			continue
 		}
 
-		go handleUDP(pc, addr, buffer[:n-1])
-	}
-}
-
-func acceptTCP(l net.Listener) {
-	for {
-		conn, err := l.Accept()
+		err = s.acquireHandler()
 		if err != nil {
+			s.logRejection(err, addr.String())
+			conn.WriteTo(s.errorMessage(err), addr)
 			continue
 		}
 
-		go handleTCP(conn)
+		s.handleUDP(conn, addr, local, buffer[:n-1])
 	}
 }
 
-func acceptAT(l net.Listener) {
+// acceptConnections hands every connection accepted on l to handle until the server is stopping
+func (s *Server) acceptConnections(l net.Listener, protocol string, handle func(conn net.Conn)) {
+	defer s.runningAcceptors.Done()
 	for {
 		conn, err := l.Accept()
+		if err != nil && s.isStopping() {
+			return
+		} else if err != nil && acceptFailed(err) {
+			s.recordAcceptorError(protocol, l.Addr(), err)
+			return
+		} else if err != nil {
+			continue
+		}
+
+		err = s.acquireHandler()
 		if err != nil {
+			s.logRejection(err, conn.RemoteAddr().String())
+			conn.Write(s.errorMessage(err))
+			conn.Close()
 			continue
 		}
 
-		go handleAT(conn)
+		s.trackConnection(conn, protocol)
+		go func(conn net.Conn) {
+			defer s.releaseHandler()
+			defer s.untrackConnection(conn)
+			handle(conn)
+		}(conn)
 	}
 }
 
+func (s *Server) acceptTCP(l net.Listener) {
+	s.acceptConnections(l, "TCP", s.handleTCP)
+}
+
+func (s *Server) acceptAT(l net.Listener) {
+	s.acceptConnections(l, "AT", s.handleAT)
+}
+
+// udpSessionKey identifies the clients waiting to follow up in updClientTimeouts.
+// A follow-up must arrive on the same port, because the NAT keeps a separate binding per destination.
+func udpSessionKey(localPort int, addr string) string {
+	return fmt.Sprintf("%d/%s", localPort, addr)
+}
+
 func main() {
 	log.SetFlags(0) // Do not prefix with date, this is handled by the operating system
 
-	awsBucket := os.Getenv("AWS_BUCKET")
-	awsRegion := os.Getenv("AWS_REGION")
-	awsAccessKeyID := os.Getenv("AWS_ACCESS_KEY_ID")
-	awsSecretAccessKey := os.Getenv("AWS_SECRET_ACCESS_KEY")
-	if len(awsBucket) == 0 {
-		log.Fatal("AWS_BUCKET not defined")
+	if len(os.Args) > 1 && os.Args[1] == exportCommand {
+		err := runExport(os.Args[2:], os.Getenv, os.Stdout)
+		if err != nil && err != flag.ErrHelp {
+			log.Fatal(err)
+		}
+		return
 	}
-	if len(awsRegion) == 0 {
-		log.Fatal("AWS_REGION not defined")
+	if len(os.Args) > 1 && os.Args[1] == concatenateCommand {
+		err := runConcatenate(os.Args[2:], os.Getenv, time.Now())
+		if err != nil && err != flag.ErrHelp {
+			log.Fatal(err)
+		}
+		return
 	}
-	if len(awsAccessKeyID) == 0 {
-		log.Fatal("AWS_ACCESS_KEY_ID not defined")
+
+	settings, printConfig, err := loadSettings(os.Args[1:], os.Getenv)
+	if err == flag.ErrHelp {
+		return
+	} else if err != nil {
+		log.Fatal(err)
 	}
-	if len(awsSecretAccessKey) == 0 {
-		log.Fatal("AWS_SECRET_ACCESS_KEY not defined")
+	if printConfig {
+		settings.print(os.Stdout)
 	}
-
-	done := make(chan bool)
-	writeLog = make(chan logEntry)
-	updClientTimeouts = udpClientTimeoutMap{Map: make(map[string]udpClientTimeout)}
-
-	// Initialize the schema loaders
-	absPath, err := filepath.Abs(natSchemaFile)
+	err = settings.validate()
 	if err != nil {
 		log.Fatal(err)
 	}
-	natSchemaLoader = gojsonschema.NewReferenceLoader(fmt.Sprintf("file://%s", absPath))
+	if printConfig {
+		return
+	}
+	// Lines of the log package, like the fatal errors below, are written by the structured logger at info level
+	logger, _ := newLogger(os.Stderr, settings.LogFormat, settings.LogLevel)
+	slog.SetDefault(logger)
 
-	absPath, err = filepath.Abs(atSchemaFile)
+	svc, err := settings.s3Client()
 	if err != nil {
-		log.Fatal(err)
+		log.Fatal("Error creating session ", err)
 	}
-	atSchemaLoader = gojsonschema.NewReferenceLoader(fmt.Sprintf("file://%s", absPath))
 
-	// Start listening on ports
-	pc, err := net.ListenPacket("udp", fmt.Sprintf(":%d", udpPort))
+	config := settings.serverConfig()
+	config.Sink = &s3Sink{svc: svc, Bucket: settings.AWSBucket, Prefix: settings.LogPrefix}
+	config.Sessions = settings.sessionStore(svc)
+	config.History = s3Store{svc: svc, Bucket: settings.AWSBucket}
+	config.HistoryPrefix = settings.LogPrefix
+	config.TLSConfig, err = settings.tlsConfig()
 	if err != nil {
-		log.Fatal(err)
+		log.Fatal("Error loading the TLS certificate ", err)
+	}
+	config.DTLSConfig, err = settings.dtlsConfig()
+	if err != nil {
+		log.Fatal("Error loading the DTLS pre-shared key ", err)
+	}
+	config.QUICTLSConfig, err = settings.quicTLSConfig()
+	if err != nil {
+		log.Fatal("Error loading the QUIC certificate ", err)
 	}
 
-	l, err := net.Listen("tcp", fmt.Sprintf(":%d", tcpPort))
+	server, err := NewServer(config)
 	if err != nil {
 		log.Fatal(err)
 	}
-
-	atL, err := net.Listen("tcp", fmt.Sprintf(":%d", atPort))
+	err = server.Start(context.Background())
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	defer pc.Close()
-	defer l.Close()
-	defer atL.Close()
-
-	go acceptUDP(pc)
-	go acceptTCP(l)
-	go acceptAT(atL)
+	slog.Info("Saving log entries to AWS", "bucket", settings.AWSBucket, "logPrefix", settings.LogPrefix,
+		"region", settings.AWSRegion, "accessKey", settings.AWSAccessKeyID)
 
-	logPrefix := os.Getenv("LOG_PREFIX")
-	go saveLog(awsBucket, logPrefix)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-signals
+	slog.Info("Received signal, shutting down", "signal", sig.String())
 
-	log.Printf("NAT Test Server %s started.\n", version)
-	log.Printf("TCP Port:       %d\n", tcpPort)
-	log.Printf("UDP Port:       %d\n", udpPort)
-	log.Printf("AWS Bucket:     %s\n", os.Getenv("AWS_BUCKET"))
-	if len(logPrefix) > 0 {
-		log.Printf("Log prefix:     %s\n", logPrefix)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(settings.ShutdownTimeout)*time.Second)
+	err = server.Shutdown(ctx)
+	cancel()
+	if err != nil {
+		slog.Error("Shutdown failed", "error", err)
 	}
-	log.Printf("AWS Region:     %s\n", os.Getenv("AWS_REGION"))
-	log.Printf("AWS Access Key: %s\n", os.Getenv("AWS_ACCESS_KEY_ID"))
-
-	<-done
+	os.Exit(exitCode(err))
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -8,11 +9,11 @@ import (
 	"net"
 	"os"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
@@ -22,6 +23,10 @@ const testIPv4 = "0.0.0.0"
 const testIPv6 = "0000:0000:0000:0000:0000:0000:0000:0000"
 const testCmd = "AT+TESTING"
 
+// testRemoteAddr and testLocalAddr are the addresses of messages handed to HandleData directly
+var testRemoteAddr = &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}
+var testLocalAddr = &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: defaultUDPPort}
+
 var NATtestCases [][]byte = [][]byte{
 	[]byte("{\"op\":\"24201\",\"ip\":[\"" + testIPv4 + "\"],\"cell_id\":21229824,\"ue_mode\":2,\"lte_mode\":1,\"nbiot_mode\":1,\"iccid\":\"8931089318104314834F\",\"imei\":\"352656100367872\",\"interval\":1}\n"),
 	[]byte("{\"op\":\"24201\",\"ip\":[\"" + testIPv4 + "\"],\"cell_id\":21229824,\"ue_mode\":2,\"lte_mode\":1,\"nbiot_mode\":1,\"iccid\":\"8931089318104314834\",\"imei\":\"352656100367872\",\"interval\":2}\n"),
@@ -54,12 +59,187 @@ var errorCases [][]byte = [][]byte{
 
 var ATTestCase []byte = []byte("{\"op\":\"24201\",\"iccid\":\"8931089318104314834F\",\"imei\":\"352656100367872\",\"cmd\":\"" + testCmd + "\",\"result\":\"+TESTING: 0,0,0\"}\n")
 
-const ATLogWaitTimeInSeconds = 20
-
 const threadCount = 3
 
+// replyTimeout is how long the tests wait for a response once the fake clock has been advanced
+const replyTimeout = 5 * time.Second
+
 var testPrefix string
 
+var testServer *Server
+
+// memorySink keeps the saved log entries in memory
+type memorySink struct {
+	Entries []logEntry
+	Mux     sync.Mutex
+}
+
+func (s *memorySink) Save(ctx context.Context, entry logEntry) error {
+	s.Mux.Lock()
+	defer s.Mux.Unlock()
+	s.Entries = append(s.Entries, entry)
+	return nil
+}
+
+// natLogEntries returns the NAT log entries saved so far
+func (s *memorySink) natLogEntries() []NATLogEntry {
+	s.Mux.Lock()
+	defer s.Mux.Unlock()
+	var entries []NATLogEntry
+	for _, entry := range s.Entries {
+		if natLogEntry, ok := entry.(NATLogEntry); ok {
+			entries = append(entries, natLogEntry)
+		}
+	}
+	return entries
+}
+
+// newTestServer starts a server for config on random local ports.
+// Servers in another IP mode than the system one open their own listeners on the configured ports,
+// the local listeners would bypass the mode.
+func newTestServer(config Config) (*Server, error) {
+	if config.IPMode != ipModeSystem {
+		return startServer(config)
+	}
+	udpConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	config.UDPConns = append(config.UDPConns, udpConn)
+	config.TCPListeners = append(config.TCPListeners, tcpListener)
+	config.ATListener, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	return startServer(config)
+}
+
+// startServer creates and starts a server for config
+func startServer(config Config) (*Server, error) {
+	server, err := NewServer(config)
+	if err != nil {
+		return nil, err
+	}
+	return server, server.Start(context.Background())
+}
+
+// newFakeClockServer starts a server for t which saves to sink and only sees time pass when its clock is advanced,
+// options change the configuration before the server starts.
+// The server is shut down once t has finished, so all log entries have been saved before the next test starts.
+func newFakeClockServer(t *testing.T, sink Sink, options ...func(*Config)) (*Server, *fakeClock) {
+	clock := newFakeClock()
+	config := defaultConfig()
+	config.Sink = sink
+	config.Clock = clock
+	for _, option := range options {
+		option(&config)
+	}
+	server, err := newTestServer(config)
+	if err != nil {
+		t.Fatalf("Failed to start server: %s", err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		assert.NoError(t, server.Shutdown(ctx), "The server should shut down")
+	})
+	return server, clock
+}
+
+// localTCPListener returns a TCP listener on a random local port
+func localTCPListener(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	return l
+}
+
+// localUDPConn returns a UDP socket on a random local port
+func localUDPConn(t *testing.T) net.PacketConn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	return conn
+}
+
+// probe sends message on conn, advances clock by the interval requested in message and returns the server's response
+func probe(t *testing.T, clock *fakeClock, conn net.Conn, message []byte) string {
+	var m deviceMessage
+	err := json.Unmarshal(message, &m)
+	if err != nil {
+		t.Fatalf("Invalid test message: %s", err)
+	}
+
+	if _, err = conn.Write(message); err != nil {
+		t.Fatalf("Failed to write: %s", err)
+	}
+	interval := time.Duration(m.Interval) * time.Second
+	if !clock.WaitForTimer(interval) {
+		t.Fatalf("Server did not wait for the interval of %s", interval)
+	}
+	clock.Advance(interval)
+
+	conn.SetReadDeadline(time.Now().Add(replyTimeout))
+	tempBuf := make([]byte, 256)
+	n, err := conn.Read(tempBuf)
+	if err != nil {
+		t.Fatalf("Server failed to answer packet: %s", err)
+	}
+	return string(tempBuf[:n])
+}
+
+// dialUDP connects to the server's UDP port from a new local port
+func dialUDP(t *testing.T, server *Server) *net.UDPConn {
+	LocalAddr, _ := net.ResolveUDPAddr("udp", "127.0.0.1:0")
+	conn, err := net.DialUDP("udp", LocalAddr, server.UDPAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("Failed to connect to the server: %s", err)
+	}
+	return conn
+}
+
+// replyTraceID returns the TraceID the server sent in reply
+func replyTraceID(reply string) string {
+	for _, line := range strings.Split(reply, "\n") {
+		if strings.HasPrefix(line, "TraceID:") {
+			return strings.TrimSpace(strings.TrimPrefix(line, "TraceID:"))
+		}
+	}
+	return ""
+}
+
+// assertNATLogEntries checks that there is exactly one entry for each of the replies to NATtestCases,
+// and that only the last probe timed out because no message followed it.
+func assertNATLogEntries(t *testing.T, entries []NATLogEntry, protocol string, replies []string) {
+	assert := assert.New(t)
+	assert.Len(entries, len(replies), "There should be one log entry per probe")
+
+	byTraceID := make(map[string]NATLogEntry)
+	for _, entry := range entries {
+		byTraceID[entry.TraceID] = entry
+	}
+	for i, reply := range replies {
+		entry, ok := byTraceID[replyTraceID(reply)]
+		if !assert.True(ok, "The TraceID of the reply should be logged: %q", reply) {
+			continue
+		}
+		var message deviceMessage
+		json.Unmarshal(NATtestCases[i], &message)
+		assert.Equal(protocol, entry.Protocol, "The protocol should be logged")
+		assert.Equal(message, entry.Message, "The message should be logged")
+		assert.Equal(version, entry.ServerVersion, "The server version should be logged")
+		assert.Equal(i == len(replies)-1, entry.Timeout, "Only the last probe should time out: %+v", entry)
+		assert.False(entry.Interrupted, "No probe should be interrupted")
+	}
+}
+
 func TestMain(m *testing.M) {
 	newUUID, err := uuid.NewRandom()
 	if err != nil {
@@ -69,16 +249,22 @@ func TestMain(m *testing.M) {
 	}
 	testPrefix = fmt.Sprintf("%s", newUUID)
 
-	os.Setenv("LOG_PREFIX", testPrefix)
-	defer os.Unsetenv("LOG_PREFIX")
-
-	go main()
-
-	// Make sure server has started before trying to run tests
-	time.Sleep(time.Duration(5) * time.Second)
+	config := defaultConfig()
+	config.Sink = &memorySink{}
+	config.Clock = newFakeClock()
+	testServer, err = newTestServer(config)
+	if err != nil {
+		log.Printf("Failed to start server: %s\n", err)
+		os.Exit(1)
+		return
+	}
 
 	code := m.Run()
 
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	testServer.Shutdown(ctx)
+	cancel()
+
 	os.Exit(code)
 }
 
@@ -92,37 +278,26 @@ func TCPFunc(t *testing.T) {
 	assert := assert.New(t)
 	t.Parallel()
 
-	doneChan := make(chan bool)
-
-	conn, err := net.Dial("tcp", ":3051")
-	assert.NoError(err, "It should be able to connect to the server")
-	defer conn.Close()
-
-	for i, v := range NATtestCases {
-
-		if _, err = conn.Write(v); err != nil {
-			conn.Close()
-			t.Error("Failed to write")
-			return
-		}
+	sink := &memorySink{}
+	server, clock := newFakeClockServer(t, sink)
+	conn, err := net.Dial("tcp", server.TCPAddr().String())
+	if err != nil {
+		t.Fatalf("It should be able to connect to the server: %s", err)
+	}
 
-		timer := time.NewTimer(time.Duration(i+5) * time.Second)
-		go func() {
-			select {
-			case <-timer.C:
-				t.Error("Server failed to answer packet")
-				conn.Close()
-			case <-doneChan:
-				timer.Stop()
-			}
-		}()
-
-		tempBuf := make([]byte, 256)
-		n, err := conn.Read(tempBuf)
-		assert.NoError(err, "It should read the response")
-		assert.NotEqual(tempBuf[:n], genericErrorMessage, "it should return an error message")
-		doneChan <- true
+	var replies []string
+	for _, v := range NATtestCases {
+		reply := probe(t, clock, conn, v)
+		assert.NotEqual(string(genericErrorMessage), reply, "it should return an error message")
+		replies = append(replies, reply)
 	}
+
+	// The server registers the last message as timed out once the connection is closed
+	conn.Close()
+	assert.Eventually(func() bool {
+		return len(sink.natLogEntries()) == len(NATtestCases)
+	}, replyTimeout, time.Millisecond, "The server should notice the closed connection")
+	assertNATLogEntries(t, sink.natLogEntries(), "TCP", replies)
 }
 
 func TestUDP(t *testing.T) {
@@ -135,45 +310,155 @@ func UDPFunc(t *testing.T) {
 	assert := assert.New(t)
 	t.Parallel()
 
-	doneChan := make(chan bool)
+	sink := &memorySink{}
+	server, clock := newFakeClockServer(t, sink)
+	conn := dialUDP(t, server)
+	defer conn.Close()
 
-	ServerAddr, _ := net.ResolveUDPAddr("udp", "127.0.0.1:3050")
-	LocalAddr, _ := net.ResolveUDPAddr("udp", "127.0.0.1:0")
-	conn, err := net.DialUDP("udp", LocalAddr, ServerAddr)
+	var replies []string
+	for _, v := range NATtestCases {
+		reply := probe(t, clock, conn, v)
+		assert.NotEqual(string(genericErrorMessage), reply, "it should return an error message")
+		replies = append(replies, reply)
+	}
+
+	// The last message is registered as timed out because no further message follows it
+	assert.True(clock.WaitForTimer(server.config.UDPTimeout), "The server should wait for the next message")
+	clock.Advance(server.config.UDPTimeout)
+	assert.Eventually(func() bool {
+		return len(sink.natLogEntries()) == len(NATtestCases)
+	}, replyTimeout, time.Millisecond, "The server should stop waiting for the next message")
+	assertNATLogEntries(t, sink.natLogEntries(), "UDP", replies)
+}
+
+func TestUDPRebinding(t *testing.T) {
+	assert := assert.New(t)
+	sink := &memorySink{}
+	server, clock := newFakeClockServer(t, sink)
+
+	conn := dialUDP(t, server)
+	defer conn.Close()
+	probe(t, clock, conn, NATtestCases[0])
+
+	// The NAT assigns a new port, so the follow-up message arrives from a different address
+	rebound := dialUDP(t, server)
+	defer rebound.Close()
+	probe(t, clock, rebound, NATtestCases[1])
+	probe(t, clock, rebound, NATtestCases[2])
+
+	assert.True(clock.WaitForTimer(server.config.UDPTimeout), "The server should wait for the next message")
+	clock.Advance(server.config.UDPTimeout)
+
+	assert.Eventually(func() bool {
+		return len(sink.natLogEntries()) == 3
+	}, replyTimeout, time.Millisecond, "All probes should be logged")
+	for _, entry := range sink.natLogEntries() {
+		switch entry.Message.Interval {
+		case 1:
+			assert.Equal(conn.LocalAddr().String(), entry.IP, "The first probe should be logged for the first address")
+			assert.True(entry.Timeout, "The probe whose follow-up came from a new address should time out")
+		case 2:
+			assert.Equal(rebound.LocalAddr().String(), entry.IP, "The second probe should be logged for the new address")
+			assert.False(entry.Timeout, "The probe followed up from the same address should succeed")
+		case 3:
+			assert.True(entry.Timeout, "The last probe should time out")
+		}
+	}
+}
+
+func TestUDPLowerInterval(t *testing.T) {
+	assert := assert.New(t)
+	sink := &memorySink{}
+	server, clock := newFakeClockServer(t, sink)
+
+	conn := dialUDP(t, server)
+	defer conn.Close()
+	probe(t, clock, conn, NATtestCases[1])
+	// A lower interval means the device did not receive the response and restarts its search
+	probe(t, clock, conn, NATtestCases[0])
+
+	assert.Eventually(func() bool {
+		return len(sink.natLogEntries()) == 1
+	}, replyTimeout, time.Millisecond, "The first probe should be logged")
+	entries := sink.natLogEntries()
+	if assert.Len(entries, 1) {
+		assert.Equal(2, entries[0].Message.Interval, "The first probe should be logged")
+		assert.True(entries[0].Timeout, "The first probe should time out")
+	}
+}
+
+func TestMultiplePorts(t *testing.T) {
+	assert := assert.New(t)
+	sink := &memorySink{}
+	clock := newFakeClock()
+
+	udpConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(err, "A second UDP port should be opened")
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(err, "A second TCP port should be opened")
+	config := defaultConfig()
+	config.Sink = sink
+	config.Clock = clock
+	config.UDPConns = []net.PacketConn{udpConn}
+	config.TCPListeners = []net.Listener{tcpListener}
+	server, err := newTestServer(config)
+	if err != nil {
+		t.Fatalf("Failed to start server: %s", err)
+	}
+	defer server.Shutdown(context.Background())
+	assert.Len(server.UDPAddrs(), 2, "The server should listen on both UDP ports")
+	assert.Len(server.TCPAddrs(), 2, "The server should listen on both TCP ports")
+
+	// The same client probes both UDP ports one after the other
+	first := server.UDPAddrs()[0].(*net.UDPAddr)
+	second := server.UDPAddrs()[1].(*net.UDPAddr)
+	conn, err := net.DialUDP("udp", nil, first)
 	assert.NoError(err, "It should be able to connect to the server")
+	probe(t, clock, conn, NATtestCases[0])
+	conn.Close()
+	conn, err = net.DialUDP("udp", conn.LocalAddr().(*net.UDPAddr), second)
+	assert.NoError(err, "It should be able to connect to the server from the same address")
 	defer conn.Close()
+	probe(t, clock, conn, NATtestCases[1])
 
-	for i, v := range NATtestCases {
-		if _, err = conn.Write(v); err != nil {
-			conn.Close()
-			t.Error("Failed to write")
-			return
+	tcpConn, err := net.Dial("tcp", server.TCPAddrs()[1].String())
+	assert.NoError(err, "It should be able to connect to the server")
+	probe(t, clock, tcpConn, NATtestCases[2])
+	tcpConn.Close()
+
+	assert.True(clock.WaitForTimer(server.config.UDPTimeout), "The server should wait for the next message")
+	clock.Advance(server.config.UDPTimeout)
+	assert.Eventually(func() bool {
+		return len(sink.natLogEntries()) == 3
+	}, replyTimeout, time.Millisecond, "All probes should be logged")
+
+	for _, entry := range sink.natLogEntries() {
+		switch entry.Message.Interval {
+		case 1:
+			assert.Equal(first.Port, entry.LocalPort, "The UDP port the message arrived on should be logged")
+			assert.True(entry.Timeout, "A message to another port should not follow up the probe")
+		case 2:
+			assert.Equal(second.Port, entry.LocalPort, "The UDP port the message arrived on should be logged")
+		case 3:
+			assert.Equal("TCP", entry.Protocol, "The TCP probe should be logged")
+			assert.Equal(localPort(server.TCPAddrs()[1]), entry.LocalPort, "The TCP port the message arrived on should be logged")
 		}
-
-		timer := time.NewTimer(time.Duration(i+5) * time.Second)
-		go func() {
-			select {
-			case <-timer.C:
-				t.Error("Server failed to answer packet")
-				conn.Close()
-			case <-doneChan:
-				timer.Stop()
-				return
-			}
-		}()
-
-		tempBuf := make([]byte, 256)
-		n, err := conn.Read(tempBuf)
-		assert.NoError(err, "It should read the response")
-		assert.NotEqual(tempBuf[:n], genericErrorMessage, "it should return an error message")
-		doneChan <- true
 	}
 }
 
 func TestAT(t *testing.T) {
 	assert := assert.New(t)
 
-	conn, err := net.Dial("tcp", ":3060")
+	fake := newFakeS3()
+	defer fake.Close()
+
+	config := defaultConfig()
+	config.Sink = fake.sink(testPrefix)
+	server, err := newTestServer(config)
+	if err != nil {
+		t.Fatalf("Failed to start server: %s", err)
+	}
+	conn, err := net.Dial("tcp", server.ATAddr().String())
 	assert.NoError(err, "It should be able to connect to the server")
 	defer conn.Close()
 
@@ -183,84 +468,88 @@ func TestAT(t *testing.T) {
 		return
 	}
 
-	// Wait to guarantee log entry has been written
-	time.Sleep(time.Duration(ATLogWaitTimeInSeconds) * time.Second)
-
+	conn.SetReadDeadline(time.Now().Add(replyTimeout))
 	tempBuf := make([]byte, 256)
 	n, err := conn.Read(tempBuf)
 	assert.NoError(err, "It should read the response")
 	assert.NotEqual(tempBuf[:n], genericErrorMessage, "it should return an error message")
 
-	sess, err := session.NewSession(&aws.Config{})
-	assert.NoError(err, "A session should be created")
-	svc := s3.New(sess, &aws.Config{})
+	// Shut down the server to guarantee log entry has been written
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	assert.NoError(server.Shutdown(ctx), "The log entry should be saved")
 
-	resp, err := svc.ListObjectsV2(&s3.ListObjectsV2Input{Bucket: aws.String(os.Getenv("AWS_BUCKET")), Prefix: aws.String(testPrefix)})
+	svc := fake.client()
+	resp, err := svc.ListObjectsV2(&s3.ListObjectsV2Input{Bucket: aws.String(testBucket), Prefix: aws.String(testPrefix + "/ATLog")})
 	assert.NoError(err, "Items in the bucket should be listed")
-
-	var foundCount = 0
-	for _, item := range resp.Contents {
-		obj, err := svc.GetObject(&s3.GetObjectInput{Bucket: aws.String(os.Getenv("AWS_BUCKET")), Key: aws.String(*item.Key)})
-		assert.NoError(err, "The item should be read")
-		body, err := ioutil.ReadAll(obj.Body)
-		assert.NoError(err, "The item's body should be read")
-
-		if strings.Contains(*item.Key, "ATLog") {
-			var log ATLogEntry
-			err = json.Unmarshal(body, &log)
-			assert.NoError(err, "The item should be parsed to JSON")
-			if log.Message.Cmd == testCmd {
-				foundCount++
-			}
-		}
+	if !assert.Len(resp.Contents, 1, "There should be one log entry") {
+		return
 	}
 
-	assert.Equal(1, foundCount, "The number of log entries should be equal.")
+	obj, err := svc.GetObject(&s3.GetObjectInput{Bucket: aws.String(testBucket), Key: resp.Contents[0].Key})
+	assert.NoError(err, "The item should be read")
+	body, err := ioutil.ReadAll(obj.Body)
+	assert.NoError(err, "The item's body should be read")
+
+	var log ATLogEntry
+	err = json.Unmarshal(body, &log)
+	assert.NoError(err, "The item should be parsed to JSON")
+	assert.Equal(replyTraceID(string(tempBuf[:n])), log.TraceID, "The TraceID of the reply should be logged")
+	assert.Equal(conn.LocalAddr().String(), log.IP, "The address of the client should be logged")
+	assert.Equal(testCmd, log.Message.Cmd, "The command should be logged")
+	assert.Equal("352656100367872", log.Message.IMEI, "The IMEI should be logged")
+	assert.Equal(testPrefix+"/"+log.getKey(), *resp.Contents[0].Key, "The log entry should be stored below the prefix")
 }
 
 func TestHandleData(t *testing.T) {
 	assert := assert.New(t)
 	for _, errorCase := range errorCases {
-		_, _, err := HandleData(errorCase, "UDP", testIPv4)
+		_, _, err := testServer.HandleData(errorCase, "UDP", testRemoteAddr, testLocalAddr)
 		assert.Error(err, "An invalid message should not be accepted by the server: %s", errorCase)
 	}
 }
 
 func TestNATLogEntries(t *testing.T) {
 	assert := assert.New(t)
-	// Wait for timeout + 10% for timeout packets to be written
-	time.Sleep(time.Duration(newUDPMessageTimeoutInSeconds*1.1) * time.Second)
 
-	sess, err := session.NewSession(&aws.Config{})
-	assert.NoError(err, "A session should be created")
-	svc := s3.New(sess, &aws.Config{})
+	fake := newFakeS3()
+	t.Cleanup(fake.Close)
+
+	server, clock := newFakeClockServer(t, fake.sink(testPrefix))
+	conn := dialUDP(t, server)
+	defer conn.Close()
 
-	resp, err := svc.ListObjectsV2(&s3.ListObjectsV2Input{Bucket: aws.String(os.Getenv("AWS_BUCKET")), Prefix: aws.String(testPrefix)})
+	var replies []string
+	for _, v := range NATtestCases {
+		replies = append(replies, probe(t, clock, conn, v))
+	}
+	assert.True(clock.WaitForTimer(server.config.UDPTimeout), "The server should wait for the next message")
+	clock.Advance(server.config.UDPTimeout)
+
+	prefix := testPrefix + "/NATLog"
+	assert.Eventually(func() bool {
+		return len(fake.keys(testBucket, prefix)) == len(NATtestCases)
+	}, replyTimeout, time.Millisecond, "All log entries should be uploaded")
+
+	svc := fake.client()
+	resp, err := svc.ListObjectsV2(&s3.ListObjectsV2Input{Bucket: aws.String(testBucket), Prefix: aws.String(prefix)})
 	assert.NoError(err, "Items in the bucket should be listed")
 
-	var foundCount = 0
-	var timedOutCount = 0
+	var entries []NATLogEntry
 	for _, item := range resp.Contents {
-		obj, err := svc.GetObject(&s3.GetObjectInput{Bucket: aws.String(os.Getenv("AWS_BUCKET")), Key: aws.String(*item.Key)})
+		obj, err := svc.GetObject(&s3.GetObjectInput{Bucket: aws.String(testBucket), Key: aws.String(*item.Key)})
 		assert.NoError(err, "The item should be read")
 		body, err := ioutil.ReadAll(obj.Body)
 		assert.NoError(err, "The item's body should be read")
 
-		if strings.Contains(*item.Key, "NATLog") {
-			var log NATLogEntry
-			err = json.Unmarshal(body, &log)
-			assert.NoError(err, "The item should be parsed to JSON")
-			if log.Message.IP[0] == testIPv4 || log.Message.IP[0] == testIPv6 {
-				foundCount++
-			}
-			if log.Timeout {
-				timedOutCount++
-			}
-		}
+		var log NATLogEntry
+		err = json.Unmarshal(body, &log)
+		assert.NoError(err, "The item should be parsed to JSON")
+		assert.Equal(testPrefix+"/"+log.getKey(), *item.Key, "The log entry should be stored below the prefix")
+		entries = append(entries, log)
 	}
 
-	assert.Equal(threadCount*2*len(NATtestCases), foundCount, "The number of log entries should be equal.")
-	// The TCP messages will not timeout because the server sends the response in sync, while for UDP it waits for the *next* message to arrive before registering a success/timeout.
-	// This message never arrives, because the test client is terminated after the last test case.
-	assert.Equal(threadCount*2, timedOutCount, "The last UDP and TCP messages should be registered as a timeout")
+	// The server waits for the *next* UDP message to arrive before registering a success/timeout.
+	// This message never arrives for the last test case, because the test client is terminated afterwards.
+	assertNATLogEntries(t, entries, "UDP", replies)
 }
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// pendingSession is a UDP probe whose response has been sent, and which is waiting for the client's next message
+type pendingSession struct {
+	Addr     string
+	Deadline time.Time
+	Log      NATLogEntry
+}
+
+// SessionStore keeps the pending sessions while the server is restarted
+type SessionStore interface {
+	// Save stores the sessions, replacing the ones stored before
+	Save(sessions []pendingSession) error
+	// Load returns the stored sessions and removes them from the store
+	Load() ([]pendingSession, error)
+}
+
+// fileSessionStore stores the pending sessions as JSON in a local file
+type fileSessionStore struct {
+	Path string
+}
+
+func (s fileSessionStore) Save(sessions []pendingSession) error {
+	buffer, err := json.Marshal(sessions)
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first, so a crash does not leave a partial snapshot behind
+	tmp := s.Path + ".tmp"
+	err = ioutil.WriteFile(tmp, buffer, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.Path)
+}
+
+func (s fileSessionStore) Load() ([]pendingSession, error) {
+	buffer, err := ioutil.ReadFile(s.Path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var sessions []pendingSession
+	err = json.Unmarshal(buffer, &sessions)
+	if err != nil {
+		return nil, err
+	}
+	return sessions, os.Remove(s.Path)
+}
+
+// s3SessionStore stores the pending sessions as JSON in an S3 object, so they survive the task being replaced
+type s3SessionStore struct {
+	svc    *s3.S3
+	Bucket string
+	Key    string
+}
+
+func (s s3SessionStore) Save(sessions []pendingSession) error {
+	buffer, err := json.Marshal(sessions)
+	if err != nil {
+		return err
+	}
+	_, err = s.svc.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(s.Key),
+		Body:   bytes.NewReader(buffer),
+	})
+	return err
+}
+
+func (s s3SessionStore) Load() ([]pendingSession, error) {
+	obj, err := s.svc.GetObject(&s3.GetObjectInput{Bucket: aws.String(s.Bucket), Key: aws.String(s.Key)})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer obj.Body.Close()
+	var sessions []pendingSession
+	err = json.NewDecoder(obj.Body).Decode(&sessions)
+	if err != nil {
+		return nil, err
+	}
+	_, err = s.svc.DeleteObject(&s3.DeleteObjectInput{Bucket: aws.String(s.Bucket), Key: aws.String(s.Key)})
+	return sessions, err
+}
+
+// snapshotSessions takes all clients waiting to follow up out of updClientTimeouts and saves them to the session store
+func (s *Server) snapshotSessions() {
+	if s.config.Sessions == nil {
+		return
+	}
+
+	s.updClientTimeouts.Mux.Lock()
+	snapshot := make([]pendingSession, 0, len(s.updClientTimeouts.Map))
+	for key, v := range s.updClientTimeouts.Map {
+		s.scheduler.Cancel(v.Timeout)
+		delete(s.updClientTimeouts.Map, key)
+		snapshot = append(snapshot, pendingSession{Addr: v.Log.IP, Deadline: v.Timeout.At, Log: v.Log})
+		s.releaseHandler()
+	}
+	s.updClientTimeouts.Mux.Unlock()
+
+	err := s.config.Sessions.Save(snapshot)
+	if err != nil {
+		slog.Error("Failed to save pending sessions", "sessions", len(snapshot), "error", err)
+		for _, session := range snapshot {
+			session.Log.Interrupted = true
+			s.writeLog <- session.Log
+		}
+		return
+	}
+	slog.Info("Saved pending sessions", "sessions", len(snapshot))
+}
+
+// restoreSessions waits again for the clients which were waiting to follow up when the server was stopped.
+// Sessions whose deadline has passed in the meantime are recorded as interrupted,
+// because it is not known whether the client tried to follow up while the server was down.
+func (s *Server) restoreSessions() {
+	if s.config.Sessions == nil {
+		return
+	}
+
+	restored, err := s.config.Sessions.Load()
+	if err != nil {
+		slog.Error("Failed to restore pending sessions", "error", err)
+		return
+	}
+
+	for _, session := range restored {
+		remaining := session.Deadline.Sub(s.config.Clock.Now())
+		if remaining <= 0 || s.acquireHandler() != nil {
+			entryLogger(session.Log).Info("Session expired during restart")
+			session.Log.Interrupted = true
+			s.writeLog <- session.Log
+			continue
+		}
+		s.awaitUDPFollowUp(session.Addr, session.Log, remaining)
+	}
+	if len(restored) > 0 {
+		slog.Info("Restored pending sessions", "sessions", len(restored))
+	}
+}
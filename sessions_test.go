@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileSessionStore(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "sessions")
+	assert.NoError(err, "A temporary directory should be created")
+	defer os.RemoveAll(dir)
+
+	store := fileSessionStore{Path: filepath.Join(dir, "sessions.json")}
+	loaded, err := store.Load()
+	assert.NoError(err, "A missing file should not be an error")
+	assert.Empty(loaded, "There should be no sessions before saving")
+
+	saved := []pendingSession{{
+		Addr:     "192.0.2.1:1234",
+		Deadline: time.Now().Add(time.Minute).Round(0),
+		Log:      NATLogEntry{Protocol: "UDP", IP: "192.0.2.1:1234", TraceID: "trace", Message: deviceMessage{Interval: 5}},
+	}}
+	assert.NoError(store.Save(saved), "The sessions should be saved")
+
+	loaded, err = store.Load()
+	assert.NoError(err, "The sessions should be loaded")
+	assert.Equal(len(saved), len(loaded), "All sessions should be loaded")
+	assert.True(saved[0].Deadline.Equal(loaded[0].Deadline), "The deadline should be kept")
+	assert.Equal(saved[0].Log.TraceID, loaded[0].Log.TraceID, "The log entry should be kept")
+
+	_, err = os.Stat(store.Path)
+	assert.True(os.IsNotExist(err), "Loaded sessions should be removed from the store")
+}
+
+func TestRestoreSessions(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "sessions")
+	assert.NoError(err, "A temporary directory should be created")
+	defer os.RemoveAll(dir)
+
+	store := fileSessionStore{Path: filepath.Join(dir, "sessions.json")}
+	addr := "192.0.2.2:1234"
+	assert.NoError(store.Save([]pendingSession{{
+		Addr:     addr,
+		Deadline: time.Now().Add(time.Minute),
+		Log:      NATLogEntry{Protocol: "UDP", IP: addr, LocalPort: defaultUDPPort, TraceID: "restored", Message: deviceMessage{Interval: 5}},
+	}}), "The sessions should be saved")
+
+	config := defaultConfig()
+	config.Sink = discardSink{}
+	config.Sessions = store
+	server, err := newTestServer(config)
+	assert.NoError(err, "The server should start")
+	defer server.Shutdown(context.Background())
+
+	server.updClientTimeouts.Mux.Lock()
+	v, ok := server.updClientTimeouts.Map[udpSessionKey(defaultUDPPort, addr)]
+	server.updClientTimeouts.Mux.Unlock()
+	assert.True(ok, "The restored session should wait for the client to follow up")
+	if ok {
+		assert.Equal("restored", v.Log.TraceID, "The follow-up should be matched against the previous probe")
+	}
+}
+
+// discardSink drops all log entries
+type discardSink struct{}
+
+func (discardSink) Save(ctx context.Context, entry logEntry) error {
+	return nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/google/uuid"
+)
+
+// openConnectionSet stores the TCP, WebSocket, QUIC and AT connections which are currently handled
+type openConnectionSet struct {
+	Map map[net.Conn]*openConnection
+	// ByAddr finds a connection by connectionKey of its local and remote address
+	ByAddr map[string]*openConnection
+	Mux    sync.Mutex
+}
+
+// openConnection is a connection in the openConnectionSet and the session the admin API lists for it
+type openConnection struct {
+	Conn net.Conn
+	// Key is the connectionKey of the addresses the connection was accepted with
+	Key     string
+	Session AdminSession
+	// Closed is true if the connection was closed through the admin API
+	Closed bool
+}
+
+// Exit codes of the server after a shutdown
+const (
+	exitOK              = 0
+	exitShutdownTimeout = 2
+	exitUploadFailed    = 3
+)
+
+const defaultShutdownTimeoutInSeconds = 30
+
+var errInterrupted = errors.New("Server is shutting down")
+var errShutdownTimeout = errors.New("Shutdown timed out before all log entries were saved")
+var errUploadFailed = errors.New("Log entries failed to upload during shutdown")
+
+// isStopping returns true once the server has started shutting down
+func (s *Server) isStopping() bool {
+	select {
+	case <-s.stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// trackConnection adds conn to the open connections, protocol is the protocol of the listener it was accepted on
+func (s *Server) trackConnection(conn net.Conn, protocol string) {
+	c := &openConnection{
+		Conn: conn,
+		Key:  connectionKey(conn.LocalAddr(), conn.RemoteAddr()),
+		Session: AdminSession{
+			ID:       uuid.New().String(),
+			Protocol: protocol,
+			Remote:   conn.RemoteAddr().String(),
+			Started:  s.config.Clock.Now(),
+		},
+	}
+	s.openConnections.Mux.Lock()
+	s.openConnections.Map[conn] = c
+	s.openConnections.ByAddr[c.Key] = c
+	s.openConnections.Mux.Unlock()
+}
+
+func (s *Server) untrackConnection(conn net.Conn) {
+	s.openConnections.Mux.Lock()
+	if c, ok := s.openConnections.Map[conn]; ok {
+		delete(s.openConnections.ByAddr, c.Key)
+		delete(s.openConnections.Map, conn)
+	}
+	s.openConnections.Mux.Unlock()
+}
+
+// connectionKey identifies a connection in openConnections by its addresses
+func connectionKey(local net.Addr, remote net.Addr) string {
+	return local.String() + "-" + remote.String()
+}
+
+// connectionInterrupted returns true if the server is stopping or conn was closed through the admin API,
+// the probe waiting on conn is then recorded as interrupted rather than timed out.
+// conn may wrap the tracked connection, like a TLS connection does.
+func (s *Server) connectionInterrupted(conn net.Conn) bool {
+	if s.isStopping() {
+		return true
+	}
+	s.openConnections.Mux.Lock()
+	defer s.openConnections.Mux.Unlock()
+	c, ok := s.openConnections.Map[conn]
+	if !ok {
+		c, ok = s.openConnections.ByAddr[connectionKey(conn.LocalAddr(), conn.RemoteAddr())]
+	}
+	return ok && c.Closed
+}
+
+// closeConnections closes all open TCP, WebSocket, QUIC and AT connections so their handlers return,
+// and the idle HTTP connections
+func (s *Server) closeConnections() {
+	if s.httpServer != nil {
+		s.httpServer.Close()
+	}
+	s.openConnections.Mux.Lock()
+	defer s.openConnections.Mux.Unlock()
+	for conn := range s.openConnections.Map {
+		conn.Close()
+	}
+}
+
+// waitFor waits for wg until done is closed and returns false if done was closed before
+func waitFor(wg *sync.WaitGroup, done <-chan struct{}) bool {
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+// Shutdown stops accepting messages, records all probes in flight as interrupted
+// and waits until all log entries have been saved or ctx is done.
+func (s *Server) Shutdown(ctx context.Context) error {
+	failuresBefore := atomic.LoadInt64(&s.uploadFailures)
+	// The metrics stay available until the log entries have been saved
+	defer s.closeMonitoring()
+
+	close(s.stopping)
+	s.closeListeners()
+	if !waitFor(&s.runningAcceptors, ctx.Done()) {
+		slog.Error("Timed out waiting for listeners to close")
+		s.cancelUploads()
+		return errShutdownTimeout
+	}
+
+	// Clients waiting to follow up are saved to the session store if there is one,
+	// all other handlers record the probes they are waiting for once their connection is closed or the scheduler is stopped
+	s.snapshotSessions()
+	s.closeConnections()
+	s.scheduler.Stop()
+	if !waitFor(&s.runningHandlers, ctx.Done()) {
+		slog.Error("Timed out waiting for handlers to finish")
+		s.cancelUploads()
+		return errShutdownTimeout
+	}
+
+	close(s.writeLog)
+	if !waitFor(&s.saved, ctx.Done()) {
+		slog.Error("Timed out waiting for log entries to be saved")
+		s.cancelUploads()
+		return errShutdownTimeout
+	}
+	s.cancelUploads()
+
+	if failures := atomic.LoadInt64(&s.uploadFailures) - failuresBefore; failures > 0 {
+		return fmt.Errorf("%w: %d entries", errUploadFailed, failures)
+	}
+	slog.Info("Shutdown complete")
+	return nil
+}
+
+// exitCode returns the exit code for the process after Shutdown returned err
+func exitCode(err error) int {
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.Is(err, errUploadFailed):
+		return exitUploadFailed
+	default:
+		return exitShutdownTimeout
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"sort"
+)
+
+var errNoSimIssuers = errors.New("The SIM issuer list is empty")
+
+// simIssuerList identifies the issuer of a SIM by the issuer identification number (IIN) its ICCID starts with, ITU-T E.118
+type simIssuerList struct {
+	// Issuers holds the issuer objects of the list by their IIN
+	Issuers map[string]json.RawMessage
+	// lengths are the lengths of the IINs in the list, longest first
+	lengths []int
+}
+
+// parseSimIssuers reads a JSON array of issuer objects, each with its IIN in the field iin as number or string.
+// The objects are added to the log entries as they are, so the list decides which details the entries carry.
+func parseSimIssuers(body []byte) (*simIssuerList, error) {
+	var issuers []json.RawMessage
+	err := json.Unmarshal(body, &issuers)
+	if err != nil {
+		return nil, err
+	}
+	list := &simIssuerList{Issuers: make(map[string]json.RawMessage)}
+	lengths := make(map[int]bool)
+	for _, issuer := range issuers {
+		var v struct {
+			IIN json.Number `json:"iin"`
+		}
+		decoder := json.NewDecoder(bytes.NewReader(issuer))
+		decoder.UseNumber()
+		if err := decoder.Decode(&v); err != nil {
+			return nil, err
+		}
+		iin := v.IIN.String()
+		if len(iin) == 0 {
+			slog.Warn("Ignoring SIM issuer without an IIN", "issuer", string(issuer))
+			continue
+		}
+		list.Issuers[iin] = issuer
+		lengths[len(iin)] = true
+	}
+	if len(list.Issuers) == 0 {
+		return nil, errNoSimIssuers
+	}
+	for length := range lengths {
+		list.lengths = append(list.lengths, length)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(list.lengths)))
+	return list, nil
+}
+
+// loadSimIssuers reads the list of SIM issuers from the file at path
+func loadSimIssuers(path string) (*simIssuerList, error) {
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseSimIssuers(body)
+}
+
+// identify returns the issuer with the longest IIN the ICCID starts with
+func (l *simIssuerList) identify(iccid string) (json.RawMessage, bool) {
+	for _, length := range l.lengths {
+		if len(iccid) < length {
+			continue
+		}
+		if issuer, ok := l.Issuers[iccid[:length]]; ok {
+			return issuer, true
+		}
+	}
+	return nil, false
+}
+
+// enrich adds the issuer of the SIM to the NAT log entry as simIssuer, like the lambda concatenating the raw log entries.
+// Entries which were enriched before, and entries whose issuer is not known, are returned unchanged.
+func (l *simIssuerList) enrich(entry json.RawMessage) json.RawMessage {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(entry, &fields); err != nil {
+		slog.Warn("Log entry is not a JSON object, not enriching it with the SIM issuer", "entry", string(entry))
+		return entry
+	}
+	if _, ok := fields["simIssuer"]; ok {
+		return entry
+	}
+	var e struct {
+		TraceID string
+		Message struct {
+			ICCID string `json:"iccid"`
+		}
+	}
+	json.Unmarshal(entry, &e)
+	if len(e.Message.ICCID) == 0 {
+		slog.Warn("Log entry has no ICCID, not enriching it with the SIM issuer", "traceID", e.TraceID)
+		return entry
+	}
+	issuer, ok := l.identify(e.Message.ICCID)
+	if !ok {
+		slog.Warn("Unknown SIM issuer, update the SIM issuer list", "traceID", e.TraceID, "iccid", e.Message.ICCID)
+		return entry
+	}
+	fields["simIssuer"] = issuer
+	enriched, err := json.Marshal(fields)
+	if err != nil {
+		return entry
+	}
+	return enriched
+}
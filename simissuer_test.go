@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testSimIssuers is a SIM issuer list with IINs of different lengths, one of them given as string
+const testSimIssuers = `[
+	{"iin": 8931, "companyName": "Country"},
+	{"iin": 893108, "companyName": "Issuer A"},
+	{"iin": "8947", "companyName": "Issuer B"}
+]`
+
+func TestSimIssuerList(t *testing.T) {
+	assert := assert.New(t)
+	issuers, err := parseSimIssuers([]byte(testSimIssuers))
+	if !assert.Nil(err) {
+		return
+	}
+
+	issuer, ok := issuers.identify("8931089318104314834F")
+	assert.True(ok)
+	assert.JSONEq(`{"iin": 893108, "companyName": "Issuer A"}`, string(issuer), "The longest IIN should win")
+	issuer, ok = issuers.identify("8931099318104314834F")
+	assert.True(ok)
+	assert.JSONEq(`{"iin": 8931, "companyName": "Country"}`, string(issuer))
+	issuer, ok = issuers.identify("8947000000000000000")
+	assert.True(ok)
+	assert.JSONEq(`{"iin": "8947", "companyName": "Issuer B"}`, string(issuer))
+	_, ok = issuers.identify("8944000000000000000")
+	assert.False(ok, "Unknown issuers should not be identified")
+	_, ok = issuers.identify("89")
+	assert.False(ok)
+
+	_, err = parseSimIssuers([]byte(`[]`))
+	assert.Equal(errNoSimIssuers, err)
+	_, err = parseSimIssuers([]byte(`{}`))
+	assert.NotNil(err, "The list should be an array")
+}
+
+func TestEnrichWithSimIssuer(t *testing.T) {
+	assert := assert.New(t)
+	issuers, err := parseSimIssuers([]byte(testSimIssuers))
+	if !assert.Nil(err) {
+		return
+	}
+	entry := searchEntry("192.0.2.1:1000", 60, false, time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC))
+	entry.Message.ICCID = "8931089318104314834F"
+	raw, err := json.Marshal(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	enriched := issuers.enrich(raw)
+	var fields map[string]json.RawMessage
+	assert.Nil(json.Unmarshal(enriched, &fields))
+	assert.JSONEq(`{"iin": 893108, "companyName": "Issuer A"}`, string(fields["simIssuer"]), "The issuer should be added")
+	var e NATLogEntry
+	assert.Nil(json.Unmarshal(enriched, &e))
+	assert.Equal(entry.TraceID, e.TraceID, "The entry should be kept")
+	assert.Equal(string(enriched), string(issuers.enrich(enriched)), "An enriched entry should not change")
+
+	entry.Message.ICCID = "8944000000000000000"
+	raw, _ = json.Marshal(entry)
+	assert.Equal(string(raw), string(issuers.enrich(raw)), "Entries of unknown issuers should not change")
+	entry.Message.ICCID = ""
+	raw, _ = json.Marshal(entry)
+	assert.Equal(string(raw), string(issuers.enrich(raw)), "Entries without ICCID should not change")
+}
+
+func TestConcatenateWithSimIssuers(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	store := dirStore{Dir: dir}
+	now := time.Now().UTC()
+	entry := searchEntry("192.0.2.1:1000", 60, false, now.Add(-2*time.Hour))
+	entry.Message.ICCID = "8947000000000000000"
+	writeObject(t, dir, "raw/"+entry.getKey(), entry)
+	list := filepath.Join(t.TempDir(), "iin.json")
+	if err := os.WriteFile(list, []byte(testSimIssuers), 0644); err != nil {
+		t.Fatal(err)
+	}
+	getenv := func(string) string { return "" }
+
+	assert.Nil(runConcatenate([]string{"--dir", dir, "--prefix", "raw", "--iin-list", list}, getenv, now))
+	hours := listAll(t, store, "hours/")
+	if assert.Len(hours, 1) {
+		body, err := store.Get(hours[0])
+		assert.Nil(err)
+		assert.Contains(string(body), `"simIssuer":{"iin":"8947","companyName":"Issuer B"}`, "The entry should be enriched like by the lambda")
+		assert.Equal(1, strings.Count(string(body), "simIssuer"))
+	}
+
+	assert.NotNil(runConcatenate([]string{"--dir", dir, "--iin-list", filepath.Join(dir, "missing.json")}, getenv, now))
+}
+
+func TestEnrichLogs(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	store := dirStore{Dir: dir}
+	known := searchEntry("192.0.2.1:1000", 60, false, time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC))
+	known.Message.ICCID = "8931089318104314834F"
+	unknown := searchEntry("192.0.2.1:1000", 90, false, time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC))
+	unknown.Message.ICCID = "8944000000000000000"
+	// The issuer of unknown was missing from the list when the files were concatenated
+	writeObject(t, dir, "days/2021-03-01-4c3b0e4c-6b8f-4c36-8b0a-0dd1d1b3e4a1.txt", known, unknown)
+	writeObject(t, dir, "months/2021-02-8f0a1b4c-3d2e-4f5a-9b6c-7d8e9f0a1b2c.txt", unknown)
+	list := filepath.Join(t.TempDir(), "iin.json")
+	updated := strings.Replace(testSimIssuers, "]", `, {"iin": 8944, "companyName": "Issuer C"}]`, 1)
+	if err := os.WriteFile(list, []byte(updated), 0644); err != nil {
+		t.Fatal(err)
+	}
+	getenv := func(string) string { return "" }
+
+	assert.Equal(errNoSimIssuerList, runConcatenate([]string{"--dir", dir, "--enrich"}, getenv, time.Now()))
+	assert.Nil(runConcatenate([]string{"--dir", dir, "--enrich", "--iin-list", list}, getenv, time.Now()))
+	for _, key := range append(listAll(t, store, "days/"), listAll(t, store, "months/")...) {
+		body, err := store.Get(key)
+		assert.Nil(err)
+		assert.Equal(countEntries(t, store, key), strings.Count(string(body), "simIssuer"), "Every entry should be enriched")
+	}
+	body, err := store.Get("days/2021-03-01-4c3b0e4c-6b8f-4c36-8b0a-0dd1d1b3e4a1.txt")
+	assert.Nil(err)
+	assert.Contains(string(body), `"companyName":"Issuer A"`)
+	assert.Contains(string(body), `"companyName":"Issuer C"`)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Sink stores the log entries written by the server
+type Sink interface {
+	Save(ctx context.Context, entry logEntry) error
+}
+
+// s3Sink uploads every log entry as a JSON object to an S3 bucket
+type s3Sink struct {
+	svc    *s3.S3
+	Bucket string
+	Prefix string
+}
+
+func (s *s3Sink) Save(ctx context.Context, entry logEntry) error {
+	buffer, err := json.Marshal(entry)
+	if err != nil {
+		slog.Error("Invalid JSON, cannot upload the log entry", "error", err)
+		return err
+	}
+
+	key := entry.getKey()
+	slog.Debug("Uploading log entry", "key", key, "entry", string(buffer))
+
+	if len(s.Prefix) > 0 {
+		key = fmt.Sprintf("%s/%s", s.Prefix, key)
+	}
+	_, err = s.svc.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(key),
+		Body:   strings.NewReader(string(buffer)),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == request.CanceledErrorCode {
+			slog.Error("Upload canceled due to timeout", "key", key, "error", err)
+		} else {
+			slog.Error("Failed to upload log entry", "key", key, "error", err)
+		}
+	}
+	return err
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/stretchr/testify/assert"
+)
+
+const testBucket = "nat-test"
+
+// fakeS3 is a local HTTP server implementing the parts of the S3 API the server uses, with path-style bucket addressing
+type fakeS3 struct {
+	Server *httptest.Server
+	// Objects are stored by bucket and key
+	Objects map[string][]byte
+	Mux     sync.Mutex
+}
+
+type listBucketResult struct {
+	XMLName     xml.Name      `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+	Name        string        `xml:"Name"`
+	Prefix      string        `xml:"Prefix"`
+	KeyCount    int           `xml:"KeyCount"`
+	MaxKeys     int           `xml:"MaxKeys"`
+	IsTruncated bool          `xml:"IsTruncated"`
+	Contents    []listContent `xml:"Contents"`
+}
+
+type listContent struct {
+	Key  string `xml:"Key"`
+	Size int    `xml:"Size"`
+}
+
+type s3Error struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string   `xml:"Code"`
+	Message string   `xml:"Message"`
+}
+
+func newFakeS3() *fakeS3 {
+	f := &fakeS3{Objects: make(map[string][]byte)}
+	f.Server = httptest.NewServer(f)
+	return f
+}
+
+func (f *fakeS3) Close() {
+	f.Server.Close()
+}
+
+// client returns an S3 client which talks to the fake server
+func (f *fakeS3) client() *s3.S3 {
+	sess := session.Must(session.NewSession(&aws.Config{
+		Endpoint:         aws.String(f.Server.URL),
+		Region:           aws.String("eu-central-1"),
+		S3ForcePathStyle: aws.Bool(true),
+		Credentials:      credentials.NewStaticCredentials("id", "secret", ""),
+	}))
+	return s3.New(sess)
+}
+
+// sink returns a sink which uploads to the fake server
+func (f *fakeS3) sink(prefix string) *s3Sink {
+	return &s3Sink{svc: f.client(), Bucket: testBucket, Prefix: prefix}
+}
+
+// keys returns the sorted keys of the objects in bucket starting with prefix
+func (f *fakeS3) keys(bucket string, prefix string) []string {
+	f.Mux.Lock()
+	defer f.Mux.Unlock()
+	var keys []string
+	for path := range f.Objects {
+		key := strings.TrimPrefix(path, bucket+"/")
+		if key != path && strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	bucket := strings.SplitN(path, "/", 2)[0]
+
+	switch {
+	case r.Method == http.MethodGet && path == bucket && r.URL.Query().Get("list-type") == "2":
+		prefix := r.URL.Query().Get("prefix")
+		result := listBucketResult{Name: bucket, Prefix: prefix, MaxKeys: 1000}
+		for _, key := range f.keys(bucket, prefix) {
+			f.Mux.Lock()
+			result.Contents = append(result.Contents, listContent{Key: key, Size: len(f.Objects[bucket+"/"+key])})
+			f.Mux.Unlock()
+		}
+		result.KeyCount = len(result.Contents)
+		w.Header().Set("Content-Type", "application/xml")
+		xml.NewEncoder(w).Encode(result)
+	case r.Method == http.MethodPut && path != bucket:
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.Mux.Lock()
+		f.Objects[path] = body
+		f.Mux.Unlock()
+	case r.Method == http.MethodGet && path != bucket:
+		f.Mux.Lock()
+		body, ok := f.Objects[path]
+		f.Mux.Unlock()
+		if !ok {
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(http.StatusNotFound)
+			xml.NewEncoder(w).Encode(s3Error{Code: s3.ErrCodeNoSuchKey, Message: "The specified key does not exist."})
+			return
+		}
+		w.Write(body)
+	case r.Method == http.MethodDelete && path != bucket:
+		f.Mux.Lock()
+		delete(f.Objects, path)
+		f.Mux.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+func TestS3Sink(t *testing.T) {
+	assert := assert.New(t)
+	fake := newFakeS3()
+	defer fake.Close()
+
+	entry := NATLogEntry{
+		Protocol:  "UDP",
+		IP:        "192.0.2.1:1234",
+		Timeout:   true,
+		Timestamp: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		Message:   deviceMessage{Operator: "24201", IMEI: "352656100367872", Interval: 5},
+		TraceID:   "trace",
+	}
+	assert.NoError(fake.sink("prefix").Save(context.Background(), entry), "The entry should be uploaded")
+
+	keys := fake.keys(testBucket, "")
+	if assert.Equal([]string{"prefix/" + entry.getKey()}, keys, "The entry should be stored below the prefix") {
+		var saved NATLogEntry
+		assert.NoError(json.Unmarshal(fake.Objects[testBucket+"/"+keys[0]], &saved), "The entry should be stored as JSON")
+		assert.Equal(entry, saved, "The entry should be stored unchanged")
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// objectStore holds the objects the sink saved the log entries to, in S3 or in a local directory with the same layout
+type objectStore interface {
+	// List returns the keys of all non-empty objects starting with prefix, in lexical order
+	List(prefix string) ([]string, error)
+	Get(key string) ([]byte, error)
+	Put(key string, body []byte) error
+	// Delete removes the objects of keys, keys which do not exist are ignored
+	Delete(keys []string) error
+}
+
+var errNoObjectStore = errors.New("Set awsBucket or --dir")
+
+// s3DeleteBatchSize is the largest number of objects S3 deletes in one request
+const s3DeleteBatchSize = 1000
+
+// s3Store reads the objects of an S3 bucket
+type s3Store struct {
+	svc    *s3.S3
+	Bucket string
+}
+
+func (s s3Store) List(prefix string) ([]string, error) {
+	var keys []string
+	err := s.svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(s.Bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, last bool) bool {
+		for _, object := range page.Contents {
+			// Ignore folders
+			if aws.Int64Value(object.Size) > 0 {
+				keys = append(keys, aws.StringValue(object.Key))
+			}
+		}
+		return true
+	})
+	return keys, err
+}
+
+func (s s3Store) Get(key string) ([]byte, error) {
+	object, err := s.svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer object.Body.Close()
+	return ioutil.ReadAll(object.Body)
+}
+
+func (s s3Store) Put(key string, body []byte) error {
+	_, err := s.svc.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(body),
+	})
+	return err
+}
+
+func (s s3Store) Delete(keys []string) error {
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > s3DeleteBatchSize {
+			n = s3DeleteBatchSize
+		}
+		var objects []*s3.ObjectIdentifier
+		for _, key := range keys[:n] {
+			objects = append(objects, &s3.ObjectIdentifier{Key: aws.String(key)})
+		}
+		output, err := s.svc.DeleteObjects(&s3.DeleteObjectsInput{
+			Bucket: aws.String(s.Bucket),
+			Delete: &s3.Delete{Objects: objects},
+		})
+		if err != nil {
+			return err
+		}
+		if len(output.Errors) > 0 {
+			return fmt.Errorf("Failed to delete %s: %s", aws.StringValue(output.Errors[0].Key), aws.StringValue(output.Errors[0].Message))
+		}
+		keys = keys[n:]
+	}
+	return nil
+}
+
+// dirStore keeps the objects in files below Dir, the key of an object is its slash separated path relative to Dir.
+// Files starting with a dot are not listed, Put writes to them before renaming.
+type dirStore struct {
+	Dir string
+}
+
+func (s dirStore) path(key string) string {
+	return filepath.Join(s.Dir, filepath.FromSlash(key))
+}
+
+func (s dirStore) List(prefix string) ([]string, error) {
+	// Only walk the directory the prefix ends in
+	root := s.Dir
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		root = s.path(prefix[:i])
+	}
+	var keys []string
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".") {
+			return nil
+		}
+		rel, err := filepath.Rel(s.Dir, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if info, err := d.Info(); err == nil && info.Size() > 0 && strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	return keys, err
+}
+
+func (s dirStore) Get(key string) ([]byte, error) {
+	return ioutil.ReadFile(s.path(key))
+}
+
+func (s dirStore) Put(key string, body []byte) error {
+	path := s.path(key)
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	// Readers never see a partially written object
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(body)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func (s dirStore) Delete(keys []string) error {
+	for _, key := range keys {
+		err := os.Remove(s.path(key))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// objectStore returns the directory dir, or the configured bucket if dir is empty
+func (s Settings) objectStore(dir string) (objectStore, error) {
+	if len(dir) > 0 {
+		return dirStore{Dir: dir}, nil
+	}
+	if len(s.AWSBucket) == 0 {
+		return nil, errNoObjectStore
+	}
+	svc, err := s.s3Client()
+	if err != nil {
+		return nil, err
+	}
+	return s3Store{svc: svc, Bucket: s.AWSBucket}, nil
+}
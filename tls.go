@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+// handshakeTimeout is how long a client may take to complete a TLS or DTLS handshake
+const handshakeTimeout = 30 * time.Second
+
+// TLSInfo describes the TLS session a NAT test message was received in
+type TLSInfo struct {
+	// HandshakeDuration is the time the handshake took in nanoseconds
+	HandshakeDuration time.Duration
+	Version           string
+	CipherSuite       string
+	// ClientCertificate is the subject of the certificate the client authenticated with, if mutual TLS is used
+	ClientCertificate string `json:",omitempty"`
+}
+
+// newTLSConfig loads the server certificate, and requires clients to authenticate with a certificate signed by
+// one of the certificate authorities in clientCAFile unless it is empty
+func newTLSConfig(certFile string, keyFile string, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if len(clientCAFile) == 0 {
+		return config, nil
+	}
+
+	pem, err := ioutil.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	config.ClientCAs = x509.NewCertPool()
+	if !config.ClientCAs.AppendCertsFromPEM(pem) {
+		return nil, errors.New("No certificates found in " + clientCAFile)
+	}
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	return config, nil
+}
+
+// handshake completes the TLS handshake of conn and returns the negotiated session parameters
+func (s *Server) handshake(conn *tls.Conn) (*TLSInfo, error) {
+	start := s.config.Clock.Now()
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	err := conn.Handshake()
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	state := conn.ConnectionState()
+	info := &TLSInfo{
+		HandshakeDuration: s.config.Clock.Now().Sub(start),
+		Version:           tls.VersionName(state.Version),
+		CipherSuite:       tls.CipherSuiteName(state.CipherSuite),
+	}
+	if len(state.PeerCertificates) > 0 {
+		info.ClientCertificate = state.PeerCertificates[0].Subject.String()
+	}
+	return info, nil
+}
+
+// handleTLS handles TLS messages, they are answered like TCP messages once the handshake is complete
+func (s *Server) handleTLS(conn net.Conn) {
+	tlsConn := tls.Server(conn, s.config.TLSConfig)
+	info, err := s.handshake(tlsConn)
+	if err != nil {
+		connLogger("TLS", conn.RemoteAddr()).Warn("TLS handshake failed", "error", err)
+		conn.Close()
+		return
+	}
+	connLogger("TLS", conn.RemoteAddr()).Debug("TLS handshake completed", "duration", info.HandshakeDuration, "version", info.Version, "cipher", info.CipherSuite)
+	s.handleStream(tlsConn, "TLS", info)
+}
+
+func (s *Server) acceptTLS(l net.Listener) {
+	s.acceptConnections(l, "TLS", s.handleTLS)
+}
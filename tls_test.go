@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testPKI is a certificate authority with a server and a client certificate signed by it
+type testPKI struct {
+	CA     *x509.Certificate
+	CAKey  *ecdsa.PrivateKey
+	Pool   *x509.CertPool
+	Server tls.Certificate
+	Client tls.Certificate
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "NAT test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create CA certificate: %s", err)
+	}
+	pki := &testPKI{CAKey: key, Pool: x509.NewCertPool()}
+	pki.CA, err = x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Failed to parse CA certificate: %s", err)
+	}
+	pki.Pool.AddCert(pki.CA)
+	pki.Server = pki.issue(t, 2, "localhost", x509.ExtKeyUsageServerAuth)
+	pki.Client = pki.issue(t, 3, "352656100367872", x509.ExtKeyUsageClientAuth)
+	return pki
+}
+
+// issue returns a certificate for name signed by the CA
+func (pki *testPKI) issue(t *testing.T, serial int64, name string, usage x509.ExtKeyUsage) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, pki.CA, &key.PublicKey, pki.CAKey)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %s", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// tlsListener adds a TLS listener on a random local port, clients have to authenticate if mutual is true
+func tlsListener(t *testing.T, pki *testPKI, mutual bool) func(*Config) {
+	return func(config *Config) {
+		config.TLSConfig = &tls.Config{Certificates: []tls.Certificate{pki.Server}}
+		if mutual {
+			config.TLSConfig.ClientCAs = pki.Pool
+			config.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+		config.TLSListeners = []net.Listener{localTCPListener(t)}
+	}
+}
+
+func dialTLS(t *testing.T, server *Server, config *tls.Config) *tls.Conn {
+	conn, err := tls.Dial("tcp", server.TLSAddr().String(), config)
+	if err != nil {
+		t.Fatalf("Failed to connect to the server: %s", err)
+	}
+	return conn
+}
+
+func TestTLS(t *testing.T) {
+	assert := assert.New(t)
+	pki := newTestPKI(t)
+	sink := &memorySink{}
+	server, clock := newFakeClockServer(t, sink, tlsListener(t, pki, false))
+
+	conn := dialTLS(t, server, &tls.Config{RootCAs: pki.Pool, ServerName: "localhost"})
+	var replies []string
+	for _, message := range NATtestCases[:2] {
+		replies = append(replies, probe(t, clock, conn, message))
+	}
+	version := tls.VersionName(conn.ConnectionState().Version)
+	cipher := tls.CipherSuiteName(conn.ConnectionState().CipherSuite)
+	conn.Close()
+
+	assert.Eventually(func() bool {
+		return len(sink.natLogEntries()) == len(replies)
+	}, replyTimeout, time.Millisecond, "All TLS probes should be logged")
+	entries := sink.natLogEntries()
+	assertNATLogEntries(t, entries, "TLS", replies)
+	for _, entry := range entries {
+		if assert.NotNil(entry.TLS, "The TLS session should be recorded") {
+			assert.Equal(version, entry.TLS.Version, "The negotiated version should be recorded")
+			assert.Equal(cipher, entry.TLS.CipherSuite, "The negotiated cipher should be recorded")
+			assert.Empty(entry.TLS.ClientCertificate, "Clients do not authenticate without mutual TLS")
+		}
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	assert := assert.New(t)
+	pki := newTestPKI(t)
+	sink := &memorySink{}
+	server, clock := newFakeClockServer(t, sink, tlsListener(t, pki, true))
+
+	conn := dialTLS(t, server, &tls.Config{RootCAs: pki.Pool, ServerName: "localhost"})
+	// With TLS 1.3 the client only learns that it was rejected once it reads
+	conn.Write(NATtestCases[0])
+	conn.SetReadDeadline(time.Now().Add(replyTimeout))
+	_, err := conn.Read(make([]byte, 256))
+	assert.Error(err, "Clients without a certificate should be rejected")
+	conn.Close()
+
+	conn = dialTLS(t, server, &tls.Config{RootCAs: pki.Pool, ServerName: "localhost", Certificates: []tls.Certificate{pki.Client}})
+	reply := probe(t, clock, conn, NATtestCases[0])
+	conn.Close()
+
+	assert.Eventually(func() bool {
+		return len(sink.natLogEntries()) == 1
+	}, replyTimeout, time.Millisecond, "The probe should be logged")
+	entries := sink.natLogEntries()
+	assertNATLogEntries(t, entries, "TLS", []string{reply})
+	if len(entries) == 1 && assert.NotNil(entries[0].TLS, "The TLS session should be recorded") {
+		assert.Equal("CN=352656100367872", entries[0].TLS.ClientCertificate, "The client certificate should be recorded")
+	}
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	assert := assert.New(t)
+	pki := newTestPKI(t)
+	dir, err := ioutil.TempDir("", "tls")
+	assert.NoError(err, "A temporary directory should be created")
+	defer os.RemoveAll(dir)
+
+	keyDER, err := x509.MarshalECPrivateKey(pki.Server.PrivateKey.(*ecdsa.PrivateKey))
+	assert.NoError(err, "The key should be encoded")
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	caFile := filepath.Join(dir, "ca.pem")
+	assert.NoError(ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: pki.Server.Certificate[0]}), 0600))
+	assert.NoError(ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	assert.NoError(ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: pki.CA.Raw}), 0600))
+
+	config, err := newTLSConfig(certFile, keyFile, "")
+	if assert.NoError(err, "The certificate should be loaded") {
+		assert.Len(config.Certificates, 1, "The certificate should be used")
+		assert.Equal(tls.NoClientCert, config.ClientAuth, "Clients should not have to authenticate without a CA")
+	}
+
+	config, err = newTLSConfig(certFile, keyFile, caFile)
+	if assert.NoError(err, "The certificate authority should be loaded") {
+		assert.Equal(tls.RequireAndVerifyClientCert, config.ClientAuth, "Clients should have to authenticate with a CA")
+	}
+
+	_, err = newTLSConfig(certFile, keyFile, keyFile)
+	assert.Error(err, "Files without certificates should be rejected as certificate authority")
+	_, err = newTLSConfig(keyFile, certFile, "")
+	assert.Error(err, "Swapped certificate and key should be rejected")
+}